@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/tangthinker/controlman/pkg/client"
+)
+
+const apikeyHelp = `-actions is a comma separated list of allowed actions, e.g. "info,restart"
+(default: list,info,logs,runs). -services limits the key to service name
+patterns, e.g. "web-*". Send the token as "Authorization: Bearer <token>".`
+
+// apikeyCommand is "controlman apikey ...".
+func apikeyCommand() *command {
+	return &command{
+		name:    "apikey",
+		summary: "Manage API keys for automation (create, list, revoke)",
+		help:    apikeyHelp,
+		commands: []*command{
+			{
+				name:    "create",
+				args:    "<name>",
+				summary: "Create a key and print its token",
+				minArgs: 1,
+				maxArgs: 1,
+				setup: func(fs *flag.FlagSet) runFunc {
+					actions := fs.String("actions", "", "Comma separated actions the key may run")
+					services := fs.String("services", "", "Comma separated service name patterns the key is limited to")
+					return func(e *env, args []string) error {
+						c, err := e.client()
+						if err != nil {
+							return err
+						}
+						key, err := c.CreateAPIKey(e.ctx, args[0], &client.APIKeyOptions{
+							Actions:  splitList(*actions),
+							Services: splitList(*services),
+						})
+						if err != nil {
+							return fmt.Errorf("failed to create API key: %w", err)
+						}
+						fmt.Printf("API key '%s' created (id %s)\n", args[0], key.ID)
+						fmt.Printf("Actions:  %s\n", joinList(key.Actions, "-"))
+						fmt.Printf("Services: %s\n", joinList(key.Services, "*"))
+						fmt.Printf("\n%s\n\nStore the token now, it cannot be shown again.\n", key.Token)
+						return nil
+					}
+				},
+			},
+			{
+				name:    "list",
+				summary: "List the keys",
+				setup: func(fs *flag.FlagSet) runFunc {
+					return func(e *env, args []string) error {
+						c, err := e.client()
+						if err != nil {
+							return err
+						}
+						keys, err := c.ListAPIKeys(e.ctx)
+						if err != nil {
+							return fmt.Errorf("failed to list API keys: %w", err)
+						}
+						return e.out.print(keys, func(wide bool) { printAPIKeys(keys, wide) }, func() []string {
+							// revoke takes the ID
+							ids := make([]string, len(keys))
+							for i, k := range keys {
+								ids[i] = k.ID
+							}
+							return ids
+						})
+					}
+				},
+			},
+			{
+				name:     "revoke",
+				args:     "<id>",
+				summary:  "Revoke a key",
+				minArgs:  1,
+				maxArgs:  1,
+				argTypes: []completer{completeAPIKeys},
+				setup: func(fs *flag.FlagSet) runFunc {
+					return func(e *env, args []string) error {
+						c, err := e.client()
+						if err != nil {
+							return err
+						}
+						if err := c.RevokeAPIKey(e.ctx, args[0]); err != nil {
+							return fmt.Errorf("failed to revoke API key: %w", err)
+						}
+						fmt.Printf("API key '%s' revoked\n", args[0])
+						return nil
+					}
+				},
+			},
+		},
+	}
+}
+
+func printAPIKeys(keys []client.APIKeyInfo, wide bool) {
+	fmt.Printf("%-10s %-20s %-19s %-19s %-25s ", "ID", "NAME", "CREATED", "LAST USED", "ACTIONS")
+	if wide {
+		fmt.Printf("%-20s %s\n", "SERVICES", "CREATED BY")
+	} else {
+		fmt.Println("SERVICES")
+	}
+	for _, k := range keys {
+		lastUsed := "never"
+		if k.LastUsed != "" {
+			lastUsed = formatTime(k.LastUsed)
+		}
+		fmt.Printf("%-10s %-20s %-19s %-19s %-25s ", k.ID, k.Name, formatTime(k.CreatedAt),
+			lastUsed, joinList(k.Actions, "-"))
+		if wide {
+			fmt.Printf("%-20s %s\n", joinList(k.Services, "*"), k.CreatedBy)
+		} else {
+			fmt.Println(joinList(k.Services, "*"))
+		}
+	}
+}
+
+// joinList formats a list, or def when it is empty.
+func joinList(list []string, def string) string {
+	if len(list) == 0 {
+		return def
+	}
+	return strings.Join(list, ",")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/client"
+)
+
+// auditCommand is "controlman audit".
+func auditCommand() *command {
+	return &command{
+		name:      "audit",
+		summary:   "Show the audit log (-service, -actor, -since, -limit, -verify)",
+		flagTypes: map[string]completer{"service": completeServices},
+		setup: func(fs *flag.FlagSet) runFunc {
+			svc := fs.String("service", "", "Only show entries for this service")
+			actor := fs.String("actor", "", "Only show entries of this user or key (e.g. apikey:deploy)")
+			since := fs.String("since", "", "Only show entries newer than a duration (e.g. 1h) or time (RFC 3339)")
+			limit := fs.Int("limit", 100, "Maximum number of entries to show")
+			verify := fs.Bool("verify", false, "Check that the audit log has not been tampered with")
+			return func(e *env, args []string) error {
+				if !*verify {
+					if err := e.out.requireNames("audit", false); err != nil {
+						return err
+					}
+				}
+				q := &client.AuditQuery{Service: *svc, Actor: *actor, Limit: *limit}
+				if *since != "" {
+					t, err := parseSince(*since)
+					if err != nil {
+						return usageErrorf("invalid -since: %v", err)
+					}
+					q.Since = &t
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+
+				if *verify {
+					msg, err := c.VerifyAudit(e.ctx)
+					if err != nil {
+						return fmt.Errorf("audit log verification failed: %w", err)
+					}
+					fmt.Println(msg)
+					return nil
+				}
+
+				entries, err := c.Audit(e.ctx, q)
+				if err != nil {
+					return fmt.Errorf("failed to read audit log: %w", err)
+				}
+				return e.out.print(entries, func(wide bool) { printAudit(entries, wide) }, nil)
+			}
+		},
+	}
+}
+
+func printAudit(entries []client.AuditEntry, wide bool) {
+	fmt.Printf("%-6s %-19s %-20s ", "SEQ", "TIME", "ACTOR")
+	if wide {
+		fmt.Printf("%-9s ", "ROLE")
+	}
+	fmt.Printf("%-24s %-14s %-20s %s\n", "SOURCE", "ACTION", "TARGET", "RESULT")
+	for _, e := range entries {
+		result := "ok"
+		if !e.Success {
+			result = fmt.Sprintf("%s: %s", e.Code, e.Message)
+		}
+		target := e.Target
+		if e.Host != "" {
+			target = e.Host + ":" + target
+		}
+		if len(e.Params) > 0 {
+			target += " " + string(e.Params)
+		}
+		if e.Command != "" {
+			target += " " + e.Command
+		}
+		fmt.Printf("%-6d %-19s %-20s ", e.Seq, e.Time.Format("2006-01-02 15:04:05"), e.Actor)
+		if wide {
+			fmt.Printf("%-9s ", e.Role)
+		}
+		fmt.Printf("%-24s %-14s %-20s %s\n", e.Source, e.Action, target, result)
+	}
+}
+
+// parseSince accepts a duration relative to now or an absolute time.
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration nor a time", s)
+}
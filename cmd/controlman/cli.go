@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/tangthinker/controlman/pkg/client"
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+// Exit codes of the CLI
+const (
+	exitOK          = 0
+	exitFailure     = 1 // the command failed
+	exitUsage       = 2 // the command line is invalid
+	exitUnavailable = 3 // the daemon could not be reached
+	exitNotFound    = 4 // the service, user or key does not exist
+	exitForbidden   = 5 // the caller is not allowed to run the command
+)
+
+const exitCodesHelp = `Exit codes:
+    0  Success
+    1  The command failed
+    2  The command line is invalid
+    3  The daemon could not be reached
+    4  The service, user or key does not exist
+    5  Permission denied`
+
+const globalFlagsHelp = `Global flags (any position):
+    --context <name>       Send the command to a context instead of the current one
+    --host <url>           Send the command to the HTTP API at url (with --token)
+    --token <token>        API key or session token (default $CONTROLMAN_TOKEN)
+    --all-contexts         Run list or events against every context and merge the results
+    --agent <host>         Have the fleet hub send the command on to one of its agents
+                           ("all" with list: the services of every host)
+    -o <format>            Output of read commands: json, yaml, wide or name
+    --template <tmpl>      Print read results with a Go template using the
+                           API field names, e.g. '{{range .}}{{.name}}{{"\n"}}{{end}}'`
+
+// command is a command of the CLI, such as "add", or a group of them, such
+// as "user".
+type command struct {
+	name    string
+	args    string // synopsis of the arguments, e.g. "<name> <command>"
+	summary string // shown in the list of commands
+	help    string // shown by --help after the summary, optional
+
+	// Number of arguments; maxArgs < 0 allows any number
+	minArgs, maxArgs int
+	// argTypes completes the arguments by position in the shell
+	argTypes []completer
+	// flagTypes completes the values of the command's flags in the shell
+	flagTypes map[string]completer
+
+	// setup registers the flags of the command and returns the function
+	// that runs it once they are parsed. It must not do anything else, as
+	// shell completion calls it too.
+	setup func(fs *flag.FlagSet) runFunc
+
+	commands []*command // of a group
+	local    bool       // does not talk to a daemon and takes no global flags
+	hidden   bool       // left out of help
+	raw      bool       // gets its arguments unparsed, flags included
+}
+
+type runFunc func(e *env, args []string) error
+
+// env is what a command runs with.
+type env struct {
+	ctx        context.Context
+	global     *globalOptions
+	out        *printer
+	clientOpts []client.Option
+	c          *client.Client
+}
+
+// client connects to the daemon chosen by the global flags on first use.
+func (e *env) client() (*client.Client, error) {
+	if e.c != nil {
+		return e.c, nil
+	}
+	if e.global.allContexts {
+		return nil, usageErrorf("--all-contexts is supported by list and events only")
+	}
+	c, err := connect(*e.global, e.clientOpts...)
+	if err != nil {
+		return nil, &exitError{code: exitUnavailable, err: fmt.Errorf("failed to create client: %w", err)}
+	}
+	e.c = c
+	return c, nil
+}
+
+func (e *env) close() {
+	if e.c != nil {
+		e.c.Close()
+	}
+}
+
+// exitError is an error with its own exit code.
+type exitError struct {
+	code int
+	err  error
+	cmd  string // path of the command whose usage was wrong, if any
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func usageErrorf(format string, args ...any) error {
+	return &exitError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+// exitCode maps the error of a command to the exit code of the CLI.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	// The HTTP transport only connects with the first request
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return exitUnavailable
+	}
+	switch client.ErrorCode(err) {
+	case protocol.CodeNotFound:
+		return exitNotFound
+	case protocol.CodeForbidden:
+		return exitForbidden
+	}
+	return exitFailure
+}
+
+func (cmd *command) find(name string) *command {
+	for _, sub := range cmd.commands {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// flagSet returns the flags of the command, with the global flags unless it
+// is local. Flags of the command hide global ones of the same name, such as
+// -token of "context add". run is nil for groups.
+func (cmd *command) flagSet(path string, global *globalOptions) (fs, own *flag.FlagSet, run runFunc) {
+	own = flag.NewFlagSet(path, flag.ContinueOnError)
+	if cmd.setup != nil {
+		run = cmd.setup(own)
+	}
+	fs = flag.NewFlagSet(path, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	own.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	if !cmd.local {
+		global.register(fs)
+	}
+	return fs, own, run
+}
+
+// execute runs the command line args (without the program name).
+func execute(ctx context.Context, root *command, args []string) error {
+	global := &globalOptions{}
+	cmd, path := root, root.name
+	for {
+		fs, own, run := cmd.flagSet(path, global)
+		if cmd.raw {
+			return run(&env{ctx: ctx, global: global}, args)
+		}
+		rest, err := parseArgs(fs, args, len(cmd.commands) > 0)
+		if errors.Is(err, flag.ErrHelp) {
+			printHelp(os.Stdout, cmd, path, own)
+			return nil
+		}
+		if err != nil {
+			return &exitError{code: exitUsage, err: err, cmd: path}
+		}
+
+		if len(cmd.commands) > 0 {
+			if len(rest) == 0 {
+				printHelp(os.Stderr, cmd, path, own)
+				return &exitError{code: exitUsage, err: fmt.Errorf("%s needs a command", path)}
+			}
+			sub := cmd.find(rest[0])
+			if sub == nil {
+				return &exitError{code: exitUsage, err: fmt.Errorf("unknown command %q", rest[0]), cmd: path}
+			}
+			cmd, path, args = sub, path+" "+sub.name, rest[1:]
+			continue
+		}
+
+		if len(rest) < cmd.minArgs || (cmd.maxArgs >= 0 && len(rest) > cmd.maxArgs) {
+			err := fmt.Errorf("usage: %s %s", path, cmd.args)
+			if cmd.args == "" {
+				err = fmt.Errorf("%s takes no arguments", path)
+			}
+			return &exitError{code: exitUsage, err: err, cmd: path}
+		}
+		global.finish()
+		out, err := newPrinter(*global)
+		if err != nil {
+			return &exitError{code: exitUsage, err: err}
+		}
+		e := &env{ctx: ctx, global: global, out: out}
+		defer e.close()
+		return run(e, rest)
+	}
+}
+
+// parseArgs parses the flags in args, which may come before, after or
+// between the arguments, and returns the arguments. Everything after "--"
+// is an argument. Groups stop at their first argument, the subcommand.
+func parseArgs(fs *flag.FlagSet, args []string, group bool) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		remaining := fs.Args()
+		if len(remaining) == 0 {
+			return rest, nil
+		}
+		if group {
+			return append(rest, remaining...), nil
+		}
+		// flag has consumed the "--" it stopped at
+		if consumed := len(args) - len(remaining); consumed > 0 && args[consumed-1] == "--" {
+			return append(rest, remaining...), nil
+		}
+		rest = append(rest, remaining[0])
+		args = remaining[1:]
+	}
+}
+
+// printHelp writes the help of a command. own holds its flags, without the
+// global ones.
+func printHelp(w io.Writer, cmd *command, path string, own *flag.FlagSet) {
+	if len(cmd.commands) > 0 {
+		fmt.Fprintf(w, "Usage: %s <command> [arguments]\n", path)
+	} else {
+		fmt.Fprintf(w, "Usage: %s %s\n", path, strings.TrimSpace(cmd.args+" [flags]"))
+	}
+	if cmd.summary != "" {
+		fmt.Fprintf(w, "\n%s\n", cmd.summary)
+	}
+	if cmd.help != "" {
+		fmt.Fprintf(w, "\n%s\n", cmd.help)
+	}
+
+	if len(cmd.commands) > 0 {
+		fmt.Fprintf(w, "\nCommands:\n")
+		for _, sub := range cmd.commands {
+			if sub.hidden {
+				continue
+			}
+			fmt.Fprintf(w, "    %-28s %s\n", strings.TrimSpace(sub.name+" "+sub.args), sub.summary)
+		}
+	}
+	hasFlags := false
+	own.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintf(w, "\nFlags:\n")
+		own.SetOutput(w)
+		own.PrintDefaults()
+	}
+
+	if path == cmd.name {
+		// The root command
+		fmt.Fprintf(w, "\n%s\n\n%s\n", globalFlagsHelp, exitCodesHelp)
+	} else if !cmd.local {
+		fmt.Fprintf(w, "\nGlobal flags such as --context and -o are listed by \"controlman help\".\n")
+	}
+	if len(cmd.commands) > 0 {
+		fmt.Fprintf(w, "\nRun \"%s <command> --help\" for the flags and arguments of a command.\n", path)
+	}
+}
+
+// helpCommand is "controlman help [command]".
+func helpCommand() *command {
+	return &command{
+		name:     "help",
+		args:     "[command]",
+		summary:  "Show the help of a command",
+		maxArgs:  -1,
+		argTypes: []completer{completeCommands},
+		local:    true,
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				cmd, path := newRootCommand(), "controlman"
+				for _, name := range args {
+					sub := cmd.find(name)
+					if sub == nil {
+						return usageErrorf("unknown command %q", strings.Join(args, " "))
+					}
+					cmd, path = sub, path+" "+name
+				}
+				_, own, _ := cmd.flagSet(path, &globalOptions{})
+				printHelp(os.Stdout, cmd, path, own)
+				return nil
+			}
+		},
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/tangthinker/controlman/internal/daemon"
+	"github.com/tangthinker/controlman/pkg/client"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// How long completion waits for the daemon before giving up on names
+const completeTimeout = 2 * time.Second
+
+// completer lists the candidates for the word being completed. They are
+// filtered by the word afterwards, so it may return them all.
+type completer func(e *env, word string) []string
+
+func fixedValues(values ...string) completer {
+	return func(*env, string) []string { return values }
+}
+
+// listValues completes the last item of a comma separated list.
+func listValues(values ...string) completer {
+	return func(e *env, word string) []string {
+		prefix := ""
+		if i := strings.LastIndex(word, ","); i >= 0 {
+			prefix = word[:i+1]
+		}
+		candidates := make([]string, len(values))
+		for i, v := range values {
+			candidates[i] = prefix + v
+		}
+		return candidates
+	}
+}
+
+var (
+	outputFormats = fixedValues(outputJSON, outputYAML, outputWide, outputName)
+	eventTypes    = listValues(daemon.EventStart, daemon.EventStop, daemon.EventCrash, daemon.EventRestart,
+		daemon.EventReload, daemon.EventFailed, daemon.EventUnhealthy, daemon.EventTest,
+		daemon.EventAdded, daemon.EventRemoved, daemon.EventStatus, daemon.EventPID)
+)
+
+// globalFlagTypes completes the values of the global flags.
+var globalFlagTypes = map[string]completer{
+	"context": completeContexts,
+	"agent":   completeHosts,
+	"o":       outputFormats,
+	"output":  outputFormats,
+}
+
+// mergeCompleters returns the completers of all the maps.
+func mergeCompleters(types ...map[string]completer) map[string]completer {
+	merged := make(map[string]completer)
+	for _, t := range types {
+		maps.Copy(merged, t)
+	}
+	return merged
+}
+
+func completeServices(e *env, word string) []string {
+	return serviceCandidates(e, func(client.ServiceInfo) bool { return true })
+}
+
+// completeTargets completes the names of services and "all".
+func completeTargets(e *env, word string) []string {
+	return append(completeServices(e, word), service.AllServices)
+}
+
+func completeJobs(e *env, word string) []string {
+	return serviceCandidates(e, func(s client.ServiceInfo) bool {
+		return s.Type == service.TypeCron || s.Type == service.TypeOneshot
+	})
+}
+
+func serviceCandidates(e *env, match func(client.ServiceInfo) bool) []string {
+	c, err := e.client()
+	if err != nil {
+		return nil
+	}
+	services, err := c.ListServices(e.ctx)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, s := range services {
+		if match(s) {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+func completeUsers(e *env, word string) []string {
+	c, err := e.client()
+	if err != nil {
+		return nil
+	}
+	users, err := c.ListUsers(e.ctx)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Name
+	}
+	return names
+}
+
+func completeAPIKeys(e *env, word string) []string {
+	c, err := e.client()
+	if err != nil {
+		return nil
+	}
+	keys, err := c.ListAPIKeys(e.ctx)
+	if err != nil {
+		return nil
+	}
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = k.ID
+	}
+	return ids
+}
+
+func completeContexts(e *env, word string) []string {
+	names := []string{localContext}
+	if cfg, err := loadContexts(); err == nil {
+		for _, cc := range cfg.Contexts {
+			names = append(names, cc.Name)
+		}
+	}
+	return names
+}
+
+func completeHosts(e *env, word string) []string {
+	names := []string{"all"}
+	c, err := e.client()
+	if err != nil {
+		return names
+	}
+	hosts, err := c.Hosts(e.ctx)
+	if err != nil {
+		return names
+	}
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	return names
+}
+
+func completeCommands(e *env, word string) []string {
+	var names []string
+	for _, cmd := range newRootCommand().commands {
+		if !cmd.hidden {
+			names = append(names, cmd.name)
+		}
+	}
+	return names
+}
+
+// completeCommand is "controlman __complete <words>", which the completion
+// scripts run with the words of the command line up to the one being
+// completed. It prints the candidates one per line.
+func completeCommand() *command {
+	return &command{
+		name:    "__complete",
+		maxArgs: -1,
+		local:   true,
+		hidden:  true,
+		raw:     true,
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				for _, candidate := range complete(e.ctx, args) {
+					fmt.Println(candidate)
+				}
+				return nil
+			}
+		},
+	}
+}
+
+// complete returns the candidates for the last of words.
+func complete(ctx context.Context, words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	word := words[len(words)-1]
+	global := &globalOptions{}
+	cmd, path := newRootCommand(), "controlman"
+	fs, _, _ := cmd.flagSet(path, global)
+
+	var args []string
+	var pending *flag.Flag // whose value is the word
+	dashdash := false
+	for i := 0; i < len(words)-1; i++ {
+		w := words[i]
+		switch {
+		case dashdash || !strings.HasPrefix(w, "-") || w == "-":
+			if len(cmd.commands) > 0 {
+				sub := cmd.find(w)
+				if sub == nil {
+					return nil
+				}
+				cmd, path = sub, path+" "+w
+				fs, _, _ = cmd.flagSet(path, global)
+				continue
+			}
+			args = append(args, w)
+		case w == "--":
+			dashdash = true
+		default:
+			name, value, hasValue := strings.Cut(strings.TrimLeft(w, "-"), "=")
+			f := fs.Lookup(name)
+			switch {
+			case f == nil:
+			case hasValue:
+				f.Value.Set(value)
+			case isBoolFlag(f):
+				f.Value.Set("true")
+			case i+1 < len(words)-1:
+				i++
+				f.Value.Set(words[i])
+			default:
+				pending = f
+			}
+		}
+	}
+
+	global.finish()
+	ctx, cancel := context.WithTimeout(ctx, completeTimeout)
+	defer cancel()
+	e := &env{ctx: ctx, global: global, clientOpts: []client.Option{client.WithTimeout(completeTimeout)}}
+	defer e.close()
+
+	var prefix string
+	var candidates []string
+	switch {
+	case pending != nil:
+		if c := flagCompleter(cmd, pending.Name); c != nil {
+			candidates = c(e, word)
+		}
+	case strings.HasPrefix(word, "-") && strings.Contains(word, "=") && !dashdash:
+		// --flag=value
+		var name string
+		name, word, _ = strings.Cut(word, "=")
+		prefix = name + "="
+		if c := flagCompleter(cmd, strings.TrimLeft(name, "-")); c != nil {
+			candidates = c(e, word)
+		}
+	case strings.HasPrefix(word, "-") && !dashdash:
+		fs.VisitAll(func(f *flag.Flag) {
+			if len(f.Name) == 1 {
+				candidates = append(candidates, "-"+f.Name)
+			} else {
+				candidates = append(candidates, "--"+f.Name)
+			}
+		})
+	case len(cmd.commands) > 0:
+		for _, sub := range cmd.commands {
+			if !sub.hidden {
+				candidates = append(candidates, sub.name)
+			}
+		}
+	case len(args) < len(cmd.argTypes) && cmd.argTypes[len(args)] != nil:
+		candidates = cmd.argTypes[len(args)](e, word)
+	}
+
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, prefix+c)
+		}
+	}
+	return matches
+}
+
+func flagCompleter(cmd *command, name string) completer {
+	if c, ok := cmd.flagTypes[name]; ok {
+		return c
+	}
+	if cmd.local {
+		return nil
+	}
+	return globalFlagTypes[name]
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+const bashCompletion = `# bash completion for controlman
+_controlman() {
+    local IFS=$'\n'
+    COMPREPLY=($(controlman __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _controlman controlman
+`
+
+const zshCompletion = `#compdef controlman
+_controlman() {
+    local -a candidates
+    candidates=(${(f)"$(controlman __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+    if (( ${#candidates} )); then
+        compadd -- "${candidates[@]}"
+    else
+        _files
+    fi
+}
+if [ "$funcstack[1]" = "_controlman" ]; then
+    _controlman "$@"
+else
+    compdef _controlman controlman
+fi
+`
+
+const fishCompletion = `# fish completion for controlman
+function __controlman_complete
+    set -l tokens (commandline -opc)
+    set -l current (commandline -ct)
+    controlman __complete $tokens[2..-1] "$current" 2>/dev/null
+end
+complete -c controlman -f -a '(__controlman_complete)'
+`
+
+// completionCommand is "controlman completion <shell>".
+func completionCommand() *command {
+	return &command{
+		name:    "completion",
+		args:    "<bash|zsh|fish>",
+		summary: "Print the shell completion script",
+		help: `Service, user, key, context and host names are completed by asking the
+daemon. To load the completion:
+    bash:  source <(controlman completion bash)        # e.g. in ~/.bashrc
+    zsh:   controlman completion zsh > "${fpath[1]}/_controlman"
+    fish:  controlman completion fish > ~/.config/fish/completions/controlman.fish`,
+		minArgs:  1,
+		maxArgs:  1,
+		argTypes: []completer{fixedValues("bash", "zsh", "fish")},
+		local:    true,
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				switch args[0] {
+				case "bash":
+					fmt.Print(bashCompletion)
+				case "zsh":
+					fmt.Print(zshCompletion)
+				case "fish":
+					fmt.Print(fishCompletion)
+				default:
+					return usageErrorf("unsupported shell %q (expected bash, zsh or fish)", args[0])
+				}
+				return nil
+			}
+		},
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tangthinker/controlman/pkg/client"
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+// localContext is the name of the local daemon, reached through its socket.
+const localContext = "local"
+
+// cliContext is a remote daemon the CLI can send commands to.
+type cliContext struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Token    string `json:"token,omitempty"`
+	CAFile   string `json:"ca_file,omitempty"`
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"` // skip verifying the server certificate
+}
+
+// contextConfig is stored in ~/.controlman/contexts.json.
+type contextConfig struct {
+	Current  string       `json:"current,omitempty"`
+	Contexts []cliContext `json:"contexts"`
+}
+
+func contextConfigPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".controlman", "contexts.json"), nil
+}
+
+func loadContexts() (*contextConfig, error) {
+	path, err := contextConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &contextConfig{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// save writes the config readable only by the user, since it holds tokens.
+// It writes a new file and renames it over the old one, so that a file
+// created with looser permissions by hand or by an earlier version does not
+// keep them.
+func (cfg *contextConfig) save() error {
+	path, err := contextConfigPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// CreateTemp creates the file with mode 0600
+	f, err := os.CreateTemp(filepath.Dir(path), ".contexts-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (cfg *contextConfig) find(name string) *cliContext {
+	for i := range cfg.Contexts {
+		if cfg.Contexts[i].Name == name {
+			return &cfg.Contexts[i]
+		}
+	}
+	return nil
+}
+
+// dial connects to the daemon of the context through its HTTP API.
+func (cc *cliContext) dial(opts ...client.Option) (*client.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cc.Insecure}
+	if cc.CAFile != "" {
+		pem, err := os.ReadFile(cc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cc.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	opts = append(opts, client.WithHTTPClient(&http.Client{Transport: transport}), client.WithClientName("controlman-cli"))
+	return client.DialHTTP(cc.URL, cc.Token, opts...)
+}
+
+// globalOptions are the flags that select the daemon a command goes to and
+// how it prints its results. They are accepted anywhere on the command line.
+type globalOptions struct {
+	context     string
+	host        string
+	token       string
+	allContexts bool
+	agent       string // fleet host the hub sends commands on to
+	output      string // -o format of read commands
+	template    string
+}
+
+// register adds the global flags to fs, except those the command has
+// flags of its own for.
+func (g *globalOptions) register(fs *flag.FlagSet) {
+	str := func(p *string, name, usage string) {
+		if fs.Lookup(name) == nil {
+			fs.StringVar(p, name, *p, usage)
+		}
+	}
+	str(&g.context, "context", "Send the command to a context instead of the current one")
+	str(&g.host, "host", "Send the command to the HTTP API at this URL")
+	str(&g.token, "token", "API key or session token (default $CONTROLMAN_TOKEN)")
+	str(&g.agent, "agent", "Have the fleet hub send the command on to one of its agents (\"all\" with list)")
+	str(&g.output, "o", "Output format: json, yaml, wide or name")
+	str(&g.output, "output", "Output format: json, yaml, wide or name")
+	str(&g.template, "template", "Go template to print the result with")
+	if fs.Lookup("all-contexts") == nil {
+		fs.BoolVar(&g.allContexts, "all-contexts", g.allContexts, "Run the command against every context")
+	}
+}
+
+// finish applies the defaults of the global flags once they are parsed.
+func (g *globalOptions) finish() {
+	if g.token == "" {
+		g.token = os.Getenv("CONTROLMAN_TOKEN")
+	}
+	if g.agent == "all" {
+		g.agent = protocol.AllHosts
+	}
+}
+
+// connect returns a client of the daemon selected by the global flags,
+// $CONTROLMAN_CONTEXT or the current context, the local socket by default.
+func connect(opts globalOptions, extra ...client.Option) (*client.Client, error) {
+	clientOpts := append([]client.Option{client.WithHost(opts.agent)}, extra...)
+	if opts.host != "" {
+		cc := &cliContext{Name: opts.host, URL: opts.host, Token: opts.token}
+		return cc.dial(clientOpts...)
+	}
+
+	cfg, err := loadContexts()
+	if err != nil {
+		return nil, err
+	}
+	name := opts.context
+	if name == "" {
+		name = os.Getenv("CONTROLMAN_CONTEXT")
+	}
+	if name == "" {
+		name = cfg.Current
+	}
+	if name == "" || name == localContext {
+		return client.Dial("", append(clientOpts, client.WithClientName("controlman-cli"))...)
+	}
+
+	cc := cfg.find(name)
+	if cc == nil {
+		return nil, fmt.Errorf("unknown context %q (see controlman context list)", name)
+	}
+	if opts.token != "" {
+		cc.Token = opts.token
+	}
+	return cc.dial(clientOpts...)
+}
+
+const contextHelp = `A context is a remote daemon reached through its HTTP API, e.g.
+    controlman context add prod-1 -url https://prod-1:1984 -token cm_...
+    controlman --context prod-1 restart web
+    controlman list --all-contexts
+
+The token is an API key (see "controlman apikey create") or a session token.`
+
+// contextCommand is "controlman context ...".
+func contextCommand() *command {
+	return &command{
+		name:    "context",
+		summary: "Manage remote daemons to send commands to (add, list, use, remove)",
+		help:    contextHelp,
+		local:   true,
+		commands: []*command{
+			{
+				name:    "add",
+				args:    "<name>",
+				summary: "Add or replace a context",
+				minArgs: 1,
+				maxArgs: 1,
+				local:   true,
+				setup: func(fs *flag.FlagSet) runFunc {
+					url := fs.String("url", "", "URL of the daemon's HTTP API, including its base path")
+					token := fs.String("token", "", "API key or session token")
+					caFile := fs.String("ca-file", "", "CA certificate to verify the server with")
+					certFile := fs.String("cert-file", "", "Client certificate, for APIs that require one")
+					keyFile := fs.String("key-file", "", "Private key of the client certificate")
+					insecure := fs.Bool("insecure", false, "Do not verify the server certificate")
+					return func(e *env, args []string) error {
+						name := args[0]
+						if name == localContext {
+							return usageErrorf("%q is reserved for the local daemon", localContext)
+						}
+						if *url == "" {
+							return usageErrorf("-url is required")
+						}
+						if (*certFile == "") != (*keyFile == "") {
+							return usageErrorf("-cert-file and -key-file must be given together")
+						}
+						cfg, err := loadContexts()
+						if err != nil {
+							return fmt.Errorf("failed to load contexts: %w", err)
+						}
+
+						cc := cliContext{Name: name, URL: strings.TrimSuffix(*url, "/"), Token: *token, CAFile: *caFile, CertFile: *certFile, KeyFile: *keyFile, Insecure: *insecure}
+						if _, err := cc.dial(); err != nil {
+							return fmt.Errorf("invalid context: %w", err)
+						}
+						if existing := cfg.find(name); existing != nil {
+							*existing = cc
+						} else {
+							cfg.Contexts = append(cfg.Contexts, cc)
+						}
+						if err := cfg.save(); err != nil {
+							return fmt.Errorf("failed to save contexts: %w", err)
+						}
+						fmt.Printf("Context '%s' saved\n", name)
+						return nil
+					}
+				},
+			},
+			{
+				name:    "list",
+				summary: "List the contexts; the current one is marked with *",
+				local:   true,
+				setup: func(fs *flag.FlagSet) runFunc {
+					return func(e *env, args []string) error {
+						cfg, err := loadContexts()
+						if err != nil {
+							return fmt.Errorf("failed to load contexts: %w", err)
+						}
+						current := cfg.Current
+						if current == "" {
+							current = localContext
+						}
+						fmt.Printf("%-2s %-20s %s\n", "", "NAME", "URL")
+						mark := func(name string) string {
+							if name == current {
+								return "*"
+							}
+							return ""
+						}
+						fmt.Printf("%-2s %-20s %s\n", mark(localContext), localContext, "(unix socket)")
+						for _, cc := range cfg.Contexts {
+							fmt.Printf("%-2s %-20s %s\n", mark(cc.Name), cc.Name, cc.URL)
+						}
+						return nil
+					}
+				},
+			},
+			{
+				name:     "use",
+				args:     "<name>",
+				summary:  "Send commands to this context by default (\"local\" for the local daemon)",
+				minArgs:  1,
+				maxArgs:  1,
+				argTypes: []completer{completeContexts},
+				local:    true,
+				setup: func(fs *flag.FlagSet) runFunc {
+					return func(e *env, args []string) error {
+						cfg, err := loadContexts()
+						if err != nil {
+							return fmt.Errorf("failed to load contexts: %w", err)
+						}
+						if args[0] != localContext && cfg.find(args[0]) == nil {
+							return &exitError{code: exitNotFound, err: fmt.Errorf("unknown context %q", args[0])}
+						}
+						cfg.Current = args[0]
+						if cfg.Current == localContext {
+							cfg.Current = ""
+						}
+						if err := cfg.save(); err != nil {
+							return fmt.Errorf("failed to save contexts: %w", err)
+						}
+						fmt.Printf("Using context '%s'\n", args[0])
+						return nil
+					}
+				},
+			},
+			{
+				name:     "remove",
+				args:     "<name>",
+				summary:  "Remove a context",
+				minArgs:  1,
+				maxArgs:  1,
+				argTypes: []completer{completeContexts},
+				local:    true,
+				setup: func(fs *flag.FlagSet) runFunc {
+					return func(e *env, args []string) error {
+						cfg, err := loadContexts()
+						if err != nil {
+							return fmt.Errorf("failed to load contexts: %w", err)
+						}
+						i := -1
+						for j, cc := range cfg.Contexts {
+							if cc.Name == args[0] {
+								i = j
+							}
+						}
+						if i < 0 {
+							return &exitError{code: exitNotFound, err: fmt.Errorf("unknown context %q", args[0])}
+						}
+						cfg.Contexts = append(cfg.Contexts[:i], cfg.Contexts[i+1:]...)
+						if cfg.Current == args[0] {
+							cfg.Current = ""
+						}
+						if err := cfg.save(); err != nil {
+							return fmt.Errorf("failed to save contexts: %w", err)
+						}
+						fmt.Printf("Context '%s' removed\n", args[0])
+						return nil
+					}
+				},
+			},
+		},
+	}
+}
+
+// contextClient is a connected client of one context.
+type contextClient struct {
+	name string
+	c    *client.Client
+}
+
+// dialAllContexts connects to every configured context. Contexts that
+// cannot be reached are reported and skipped.
+func dialAllContexts() ([]contextClient, error) {
+	cfg, err := loadContexts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load contexts: %w", err)
+	}
+	if len(cfg.Contexts) == 0 {
+		return nil, fmt.Errorf("no contexts configured (see controlman context add)")
+	}
+	var clients []contextClient
+	for i := range cfg.Contexts {
+		cc := &cfg.Contexts[i]
+		c, err := cc.dial()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", cc.Name, err)
+			continue
+		}
+		clients = append(clients, contextClient{name: cc.Name, c: c})
+	}
+	return clients, nil
+}
+
+// listAllContexts prints the services of every context that match the
+// label selector in one table.
+func listAllContexts(ctx context.Context, out *printer, selector string) error {
+	clients, err := dialAllContexts()
+	if err != nil {
+		return err
+	}
+	results := make([][]client.ServiceInfo, len(clients))
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for i, cc := range clients {
+		wg.Add(1)
+		go func(i int, cc contextClient) {
+			defer wg.Done()
+			results[i], errs[i] = cc.c.SelectServices(ctx, selector)
+		}(i, cc)
+	}
+	wg.Wait()
+
+	type row struct {
+		Context string `json:"context"`
+		client.ServiceInfo
+	}
+	rows := []row{}
+	for i, cc := range clients {
+		if errs[i] != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", cc.name, errs[i])
+			continue
+		}
+		for _, s := range results[i] {
+			rows = append(rows, row{cc.name, s})
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Context != rows[j].Context {
+			return rows[i].Context < rows[j].Context
+		}
+		return rows[i].Name < rows[j].Name
+	})
+
+	return out.print(rows, func(wide bool) {
+		if len(rows) == 0 {
+			fmt.Println("No services found")
+			return
+		}
+		fmt.Printf("%-16s %-20s %-8s %-10s %-6s %-8s %-10s %-12s %-19s", "CONTEXT", "NAME", "TYPE", "STATUS", "READY", "PID", "CPU", "MEMORY", "LAST START")
+		if wide {
+			fmt.Printf(" %s", "COMMAND")
+		}
+		fmt.Println()
+		for _, r := range rows {
+			fmt.Printf("%-16s %-20s %-8s %-10s %-6s %-8d %-10s %-12s %-19s",
+				r.Context,
+				r.Name,
+				r.Type,
+				r.Status,
+				fmt.Sprintf("%d/%d", r.Ready, r.Replicas),
+				r.PID,
+				fmt.Sprintf("%.1f%%", r.CPU),
+				formatMemory(r.Memory),
+				formatTime(r.LastStart))
+			if wide {
+				fmt.Printf(" %s", r.Command)
+			}
+			fmt.Println()
+		}
+	}, func() []string {
+		names := make([]string, len(rows))
+		for i, r := range rows {
+			names[i] = r.Context + ":" + r.Name
+		}
+		return names
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveContextsRestrictsPermissions(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := filepath.Join(home, ".controlman", "contexts.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Written by hand, readable by everyone
+	if err := os.WriteFile(path, []byte(`{"contexts": [{"name": "old", "url": "http://old"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadContexts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Contexts = append(cfg.Contexts, cliContext{Name: "prod", URL: "https://prod:1984", Token: "cm_0123abcd_secret"})
+	if err := cfg.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("contexts.json has mode %o, want 600", info.Mode().Perm())
+	}
+	saved, err := loadContexts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Contexts) != 2 || saved.find("old") == nil || saved.find("prod").Token != "cm_0123abcd_secret" {
+		t.Errorf("saved contexts %+v", saved.Contexts)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("saving left %d files behind", len(entries)-1)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/tangthinker/controlman/pkg/client"
+)
+
+// eventsCommand is "controlman events".
+func eventsCommand() *command {
+	return &command{
+		name:      "events",
+		summary:   "Print service events as they happen (-service, -type)",
+		flagTypes: map[string]completer{"service": completeServices, "type": eventTypes},
+		setup: func(fs *flag.FlagSet) runFunc {
+			services := fs.String("service", "", "Comma separated service name patterns to show events of, e.g. \"web-*\"")
+			types := fs.String("type", "", "Comma separated event types to show, e.g. \"crash,restart\"")
+			return func(e *env, args []string) error {
+				if err := e.out.requireNames("events", false); err != nil {
+					return err
+				}
+				filter := &client.WatchRequest{Services: splitList(*services), Events: splitList(*types)}
+				if e.global.allContexts {
+					return eventsAllContexts(e.ctx, e.out, filter)
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+
+				ctx, stop := signal.NotifyContext(e.ctx, os.Interrupt, syscall.SIGTERM)
+				defer stop()
+
+				if table, wide := e.out.table(); table {
+					printEventHeader(wide)
+				}
+				err = c.Events(ctx, filter, func(ev client.Event) error {
+					return e.out.printItem(ev, func(wide bool) { printEvent(ev, wide) }, nil)
+				})
+				if err != nil {
+					return fmt.Errorf("failed to watch events: %w", err)
+				}
+				return nil
+			}
+		},
+	}
+}
+
+// contextEvent is an event of --all-contexts with the context it comes
+// from.
+type contextEvent struct {
+	Context string `json:"context"`
+	client.Event
+}
+
+// eventsAllContexts prints the events of every context as they happen,
+// with the context each one comes from.
+func eventsAllContexts(ctx context.Context, out *printer, filter *client.WatchRequest) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	clients, err := dialAllContexts()
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	if table, wide := out.table(); table {
+		fmt.Printf("%-16s ", "CONTEXT")
+		printEventHeader(wide)
+	}
+	for _, cc := range clients {
+		wg.Add(1)
+		go func(cc contextClient) {
+			defer wg.Done()
+			err := cc.c.Events(ctx, filter, func(e client.Event) error {
+				mu.Lock()
+				defer mu.Unlock()
+				return out.printItem(contextEvent{cc.name, e}, func(wide bool) {
+					fmt.Printf("%-16s ", cc.name)
+					printEvent(e, wide)
+				}, nil)
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", cc.name, err)
+			}
+		}(cc)
+	}
+	wg.Wait()
+	return nil
+}
+
+func printEventHeader(wide bool) {
+	fmt.Printf("%-19s ", "TIME")
+	if wide {
+		fmt.Printf("%-16s ", "HOST")
+	}
+	fmt.Printf("%-10s %-20s %-8s %-10s %s\n", "TYPE", "SERVICE", "PID", "STATUS", "MESSAGE")
+}
+
+func printEvent(e client.Event, wide bool) {
+	pid := "-"
+	if e.PID != 0 {
+		pid = fmt.Sprint(e.PID)
+	}
+	fmt.Printf("%-19s ", e.Time.Local().Format("2006-01-02 15:04:05"))
+	if wide {
+		fmt.Printf("%-16s ", e.Host)
+	}
+	fmt.Printf("%-10s %-20s %-8s %-10s %s\n", e.Type, e.Service, pid, e.Status, e.Message)
+}
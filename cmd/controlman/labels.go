@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/tangthinker/controlman/pkg/client"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// parseLabels parses comma separated key=value pairs. An empty value
+// removes the label in edit.
+func parseLabels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q (expected key=value)", pair)
+		}
+		labels[key] = value
+	}
+	return labels, service.ValidateLabels(labels)
+}
+
+// registerSelectorFlag adds -l and its long form -selector.
+func registerSelectorFlag(fs *flag.FlagSet, usage string) *string {
+	selector := new(string)
+	fs.StringVar(selector, "l", "", usage)
+	fs.StringVar(selector, "selector", "", "Same as -l")
+	return selector
+}
+
+var selectorFlagTypes = map[string]completer{"l": completeLabels, "selector": completeLabels}
+
+// runBulk runs a lifecycle action on the services chosen by req, or with
+// req.DryRun lists them, and reports the result for each. It fails if any
+// of them failed.
+func runBulk(e *env, action string, req *client.BulkRequest) error {
+	c, err := e.client()
+	if err != nil {
+		return err
+	}
+	results, err := c.Bulk(e.ctx, action, req)
+	if err != nil {
+		return fmt.Errorf("failed to %s services: %w", action, err)
+	}
+	err = e.out.print(results, func(bool) { printBulkResults(results, req.DryRun) }, func() []string {
+		names := make([]string, len(results))
+		for i, r := range results {
+			names[i] = r.Name
+		}
+		return names
+	})
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		if !r.Success {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to %s %d of %d services", action, failed, len(results))
+	}
+	return nil
+}
+
+func printBulkResults(results []client.BulkResult, dryRun bool) {
+	fmt.Printf("%-20s %-7s %s\n", "NAME", "RESULT", "MESSAGE")
+	for _, r := range results {
+		result := "ok"
+		if dryRun {
+			result = "dry-run"
+		} else if !r.Success {
+			result = "failed"
+		}
+		fmt.Printf("%-20s %-7s %s\n", r.Name, result, r.Message)
+	}
+}
+
+// groupSummary counts the services that have the same value of a label,
+// for list -group-by.
+type groupSummary struct {
+	Label    string `json:"label"`
+	Value    string `json:"value"` // empty for the services without the label
+	Services int    `json:"services"`
+	Running  int    `json:"running"`
+	Stopped  int    `json:"stopped"`
+	Failed   int    `json:"failed"`
+	Other    int    `json:"other"`
+}
+
+// groupServices summarizes services by their value of the label key, in
+// the order of the values; the services without it come last.
+func groupServices(services []client.ServiceInfo, key string) []groupSummary {
+	byValue := make(map[string]*groupSummary)
+	for _, s := range services {
+		value := s.Labels[key]
+		g := byValue[value]
+		if g == nil {
+			g = &groupSummary{Label: key, Value: value}
+			byValue[value] = g
+		}
+		g.Services++
+		switch s.Status {
+		case service.StatusRunning:
+			g.Running++
+		case service.StatusStopped:
+			g.Stopped++
+		case service.StatusFailed:
+			g.Failed++
+		default:
+			g.Other++
+		}
+	}
+
+	groups := make([]groupSummary, 0, len(byValue))
+	for _, value := range slices.Sorted(maps.Keys(byValue)) {
+		if value != "" {
+			groups = append(groups, *byValue[value])
+		}
+	}
+	if g, ok := byValue[""]; ok {
+		groups = append(groups, *g)
+	}
+	return groups
+}
+
+func printGroups(key string, groups []groupSummary) {
+	if len(groups) == 0 {
+		fmt.Println("No services found")
+		return
+	}
+	fmt.Printf("%-24s %-9s %-8s %-8s %-7s %s\n", strings.ToUpper(key), "SERVICES", "RUNNING", "STOPPED", "FAILED", "OTHER")
+	for _, g := range groups {
+		value := g.Value
+		if value == "" {
+			value = "<none>"
+		}
+		fmt.Printf("%-24s %-9d %-8d %-8d %-7d %d\n", value, g.Services, g.Running, g.Stopped, g.Failed, g.Other)
+	}
+}
+
+// formatLabelsColumn shows the labels of a service in a table.
+func formatLabelsColumn(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	return service.FormatLabels(labels)
+}
+
+// completeLabels completes the last key=value pair of a selector or label
+// list with the labels of the services.
+func completeLabels(e *env, word string) []string {
+	pairs := make(map[string]bool)
+	labelsOfServices(e, func(key, value string) { pairs[key+"="+value] = true })
+	return listValues(slices.Sorted(maps.Keys(pairs))...)(e, word)
+}
+
+func completeLabelKeys(e *env, word string) []string {
+	keys := make(map[string]bool)
+	labelsOfServices(e, func(key, _ string) { keys[key] = true })
+	return slices.Sorted(maps.Keys(keys))
+}
+
+func labelsOfServices(e *env, fn func(key, value string)) {
+	c, err := e.client()
+	if err != nil {
+		return
+	}
+	services, err := c.ListServices(e.ctx)
+	if err != nil {
+		return
+	}
+	for _, s := range services {
+		for key, value := range s.Labels {
+			fn(key, value)
+		}
+	}
+}
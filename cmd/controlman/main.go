@@ -1,62 +1,187 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/tangthinker/controlman/internal/client"
 	"github.com/tangthinker/controlman/internal/daemon"
 	api "github.com/tangthinker/controlman/internal/daemon/gin"
+	"github.com/tangthinker/controlman/pkg/client"
+	"github.com/tangthinker/controlman/pkg/service"
 )
 
 func main() {
-	daemonMode := flag.Bool("daemon", false, "Run in daemon mode")
-	enableApi := flag.Bool("api", false, "Enable API")
-	username := flag.String("username", "", "Username for authentication")
-	password := flag.String("password", "", "Password for authentication")
-	flag.Parse()
-
-	if *daemonMode {
-		runDaemon(*enableApi, *username, *password)
-	} else {
-		runClient()
+	args := os.Args[1:]
+	// 兼容旧的 "controlman -daemon -api ..." 写法
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "-daemon" || arg == "--daemon" {
+			args = append([]string{"daemon"}, append(args[:i:i], args[i+1:]...)...)
+			break
+		}
+	}
+
+	err := execute(context.Background(), newRootCommand(), args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		var ee *exitError
+		if errors.As(err, &ee) && ee.cmd != "" {
+			fmt.Fprintf(os.Stderr, "Run \"%s --help\" for usage.\n", ee.cmd)
+		}
+	}
+	os.Exit(exitCode(err))
+}
+
+func newRootCommand() *command {
+	return &command{
+		name: "controlman",
+		commands: []*command{
+			addCommand(),
+			editCommand(),
+			scaleCommand(),
+			runCommand(),
+			runsCommand(),
+			serviceCommand("stop", "Stop a service", (*client.Client).StopService, "Service '%s' stopped successfully"),
+			serviceCommand("start", "Start a service", (*client.Client).StartService, "Service '%s' started successfully"),
+			serviceCommand("restart", "Restart a service (replicas one at a time)", (*client.Client).RestartService, "Service '%s' restarted successfully"),
+			reloadCommand(),
+			logsCommand(),
+			infoCommand(),
+			listCommand(),
+			topCommand(),
+			eventsCommand(),
+			serviceCommand("delete", "Delete a service and its logs", (*client.Client).DeleteService, "Service '%s' deleted successfully"),
+			notifyTestCommand(),
+			userCommand(),
+			apikeyCommand(),
+			auditCommand(),
+			contextCommand(),
+			hostsCommand(),
+			daemonCommand(),
+			completionCommand(),
+			helpCommand(),
+			completeCommand(),
+		},
 	}
 }
 
-func runDaemon(enableApi bool, username, password string) {
-	d, err := daemon.NewDaemon()
+func daemonCommand() *command {
+	return &command{
+		name:    "daemon",
+		summary: "Run the daemon in the foreground",
+		help:    `"controlman -daemon" is still accepted for "controlman daemon".`,
+		local:   true,
+		setup: func(fs *flag.FlagSet) runFunc {
+			enableApi := fs.Bool("api", false, "Enable API")
+			username := fs.String("username", "", "Username for authentication")
+			password := fs.String("password", "", "Password for authentication")
+			allowDefault := fs.Bool("allow-default-credentials", false, "Allow the API to run with the admin/admin account")
+			sessionTTL := fs.Duration("session-ttl", api.DefaultSessionTTL, "Lifetime of API session tokens")
+			configPath := fs.String("config", "", "Path to the daemon config file (default ~/.controlman/config.json)")
+			enableTLS := fs.Bool("tls", false, "Serve the API over HTTPS (self-signed certificate unless -tls-cert is given)")
+			tlsCert := fs.String("tls-cert", "", "TLS certificate file for the API (implies -tls)")
+			tlsKey := fs.String("tls-key", "", "TLS private key file for the API")
+			tlsClientCA := fs.String("tls-client-ca", "", "CA file for client certificates; the certificate CN is used as the user name (implies -tls)")
+			return func(e *env, args []string) error {
+				runDaemon(*configPath, apiOptions{
+					enabled:      *enableApi,
+					username:     *username,
+					password:     *password,
+					allowDefault: *allowDefault,
+					sessionTTL:   *sessionTTL,
+					tls: api.TLSOptions{
+						Enabled:      *enableTLS || *tlsCert != "" || *tlsClientCA != "",
+						CertFile:     *tlsCert,
+						KeyFile:      *tlsKey,
+						ClientCAFile: *tlsClientCA,
+					},
+				})
+				return nil
+			}
+		},
+	}
+}
+
+type apiOptions struct {
+	enabled            bool
+	username, password string
+	allowDefault       bool
+	sessionTTL         time.Duration
+	tls                api.TLSOptions
+}
+
+func runDaemon(configPath string, apiOpts apiOptions) {
+	if configPath == "" {
+		var err error
+		configPath, err = daemon.DefaultConfigPath()
+		if err != nil {
+			log.Fatalf("Failed to locate config file: %v", err)
+		}
+	}
+	cfg, err := daemon.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	d, err := daemon.NewDaemon(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create daemon: %v", err)
 	}
 
-	if enableApi {
-		var authParams *api.AuthParams
-		// controlman -daemon -api -username admin -password admin
-		if username != "" && password != "" {
-			authParams = &api.AuthParams{
-				Username: username,
-				Password: password,
-			}
+	var server *api.Server
+	if apiOpts.enabled {
+		// controlman daemon -api -username admin -password <password>
+		// 凭据以 bcrypt 哈希保存，之后启动时可以省略
+		if err := d.InitCredentials(apiOpts.username, apiOpts.password, apiOpts.allowDefault); err != nil {
+			log.Fatalf("Failed to start API: %v", err)
+		}
+		server, err = api.StartServer(d, api.ServerOptions{
+			SessionTTL: apiOpts.sessionTTL,
+			TLS:        apiOpts.tls,
+			Config:     cfg.API,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start API: %v", err)
 		}
-		api.StartServer(d, authParams)
 	}
 
-	// 处理信号
+	// 处理信号；SIGHUP 重新加载 TLS 证书，不影响正在运行的服务
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		<-sigChan
-		log.Println("Shutting down daemon...")
-		if err := d.Close(); err != nil {
-			log.Printf("Error closing daemon: %v", err)
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				if server != nil {
+					if err := server.ReloadTLS(); err != nil {
+						log.Printf("Failed to reload TLS certificate, keeping the old one: %v", err)
+					}
+				}
+				continue
+			}
+			log.Println("Shutting down daemon...")
+			if server != nil {
+				if err := server.Shutdown(); err != nil {
+					log.Printf("Error shutting down API server: %v", err)
+				}
+			}
+			if err := d.Close(); err != nil {
+				log.Printf("Error closing daemon: %v", err)
+			}
+			os.Exit(0)
 		}
-		os.Exit(0)
 	}()
 
 	if err := d.Run(); err != nil {
@@ -64,148 +189,518 @@ func runDaemon(enableApi bool, username, password string) {
 	}
 }
 
-func runClient() {
-	if len(os.Args) < 2 {
-		printUsage()
-		return
+var serviceTypes = fixedValues(service.TypeService, service.TypeCron, service.TypeOneshot)
+
+func addCommand() *command {
+	return &command{
+		name:      "add",
+		args:      "<name> <executable> [<arg>...]",
+		summary:   "Add a new service",
+		help:      "The executable is run with the arguments as given, without a shell; put them after --\nif they start with -, e.g. controlman add web -- python3 -m http.server 8000.\nWith -shell the command is a single argument run by sh -c, e.g.\ncontrolman add web -shell \"./web >> access.log\".\nCron and oneshot jobs are added with -type, or -schedule for cron jobs.",
+		minArgs:   2,
+		maxArgs:   -1,
+		flagTypes: map[string]completer{"type": serviceTypes},
+		setup: func(fs *flag.FlagSet) runFunc {
+			serviceType := fs.String("type", "", "Service type: service (default), cron or oneshot")
+			schedule := fs.String("schedule", "", "Cron expression of a cron job, e.g. \"*/5 * * * *\" (implies -type cron)")
+			replicas := fs.Int("replicas", 1, "Number of instances to run")
+			port := fs.String("port", "", "Template of the PORT variable of each instance, e.g. \"{{add 8000 .Instance}}\"")
+			reloadSignal := fs.String("reload-signal", "", "Signal sent by reload (default "+service.DefaultReloadSignal+")")
+			labelList := fs.String("labels", "", "Comma separated key=value labels, e.g. \"stack=payments,tier=api\"")
+			shell := fs.Bool("shell", false, "Run the command with sh -c")
+			hf := registerHookFlags(fs)
+			return func(e *env, args []string) error {
+				hooks, err := hf.hooks()
+				if err != nil {
+					return usageErrorf("invalid hook flags: %v", err)
+				}
+				labels, err := parseLabels(*labelList)
+				if err != nil {
+					return usageErrorf("%v", err)
+				}
+				command, argv, err := commandArgs(args[1:], *shell)
+				if err != nil {
+					return err
+				}
+				if *schedule != "" && *serviceType == "" {
+					*serviceType = service.TypeCron
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				err = c.AddService(e.ctx, args[0], command, &client.ServiceOptions{
+					Exec:     argv,
+					Shell:    *shell,
+					Hooks:    hooks,
+					Type:     *serviceType,
+					Schedule: *schedule,
+
+					Replicas:     *replicas,
+					PortTemplate: *port,
+					ReloadSignal: *reloadSignal,
+					Labels:       labels,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to add service: %w", err)
+				}
+				fmt.Printf("Service '%s' added successfully\n", args[0])
+				return nil
+			}
+		},
 	}
+}
 
-	c, err := client.NewClient()
-	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+func editCommand() *command {
+	return &command{
+		name:     "edit",
+		args:     "<name> [<executable> [<arg>...]]",
+		summary:  "Change the command, schedule, hooks or labels of a service",
+		help:     "Only what is given is changed. A new executable and its arguments follow the name,\nas in add; -shell or -command replace them with a command run by sh -c.",
+		minArgs:  1,
+		maxArgs:  -1,
+		argTypes: []completer{completeServices},
+		setup: func(fs *flag.FlagSet) runFunc {
+			command := fs.String("command", "", "New command line of the service, run by sh -c")
+			shell := fs.Bool("shell", false, "Run the new command with sh -c")
+			schedule := fs.String("schedule", "", "New cron expression of a cron job")
+			port := fs.String("port", "", "New template of the PORT variable of each instance")
+			reloadSignal := fs.String("reload-signal", "", "New signal sent by reload, e.g. SIGUSR2")
+			labelList := fs.String("labels", "", "Comma separated key=value labels to set; \"key=\" removes a label")
+			hf := registerHookFlags(fs)
+			return func(e *env, args []string) error {
+				hooks, err := hf.hooks()
+				if err != nil {
+					return usageErrorf("invalid hook flags: %v", err)
+				}
+				labels, err := parseLabels(*labelList)
+				if err != nil {
+					return usageErrorf("%v", err)
+				}
+				var argv []string
+				switch {
+				case *command != "" && len(args) > 1:
+					return usageErrorf("-command cannot be combined with an executable")
+				case *command != "":
+					*shell = true
+				case len(args) > 1:
+					if *command, argv, err = commandArgs(args[1:], *shell); err != nil {
+						return err
+					}
+				case *shell:
+					return usageErrorf("-shell requires a command")
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				err = c.EditService(e.ctx, args[0], *command, &client.ServiceOptions{
+					Exec:         argv,
+					Shell:        *shell,
+					Hooks:        hooks,
+					Schedule:     *schedule,
+					PortTemplate: *port,
+					ReloadSignal: *reloadSignal,
+					Labels:       labels,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to edit service: %w", err)
+				}
+				fmt.Printf("Service '%s' updated successfully\n", args[0])
+				return nil
+			}
+		},
 	}
+}
 
-	command := os.Args[1]
-	switch command {
-	case "add":
-		if len(os.Args) < 4 {
-			fmt.Println("Usage: controlman add <name> <command>")
-			return
-		}
-		err = c.AddService(os.Args[2], os.Args[3])
-		if err != nil {
-			log.Fatalf("Failed to add service: %v", err)
+// commandArgs returns the shell command of add or edit, or without shell
+// the executable and its arguments. A single argument with spaces is
+// refused without shell, as it was most likely meant for a shell.
+func commandArgs(args []string, shell bool) (string, []string, error) {
+	if shell {
+		if len(args) != 1 {
+			return "", nil, usageErrorf("-shell takes the command as a single argument")
 		}
-		fmt.Printf("Service '%s' added successfully\n", os.Args[2])
+		return args[0], nil, nil
+	}
+	if len(args) == 1 && strings.ContainsAny(args[0], " \t\n") {
+		return "", nil, usageErrorf("%q is not an executable: give the executable and its arguments separately, e.g. -- python3 -m http.server, or use -shell to run it with sh -c", args[0])
+	}
+	return "", args, nil
+}
 
-	case "stop":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: controlman stop <name>")
-			return
-		}
-		err = c.StopService(os.Args[2])
-		if err != nil {
-			log.Fatalf("Failed to stop service: %v", err)
-		}
-		fmt.Printf("Service '%s' stopped successfully\n", os.Args[2])
+// serviceCommand is a command that only names a service, such as stop.
+// done is printed with the name when it succeeds.
+func serviceCommand(name, summary string, do func(*client.Client, context.Context, string) error, done string) *command {
+	return &command{
+		name:    name,
+		args:    "<name> | all | <pattern> | -l <selector>",
+		summary: summary,
+		help: "Given \"all\", a glob such as 'worker-*' or -l, the daemon acts on every matching\n" +
+			"service and the result for each is reported, e.g. controlman " + name + " -l stack=payments.\n" +
+			"A pattern and -l together choose the services matching both. A service named like a\n" +
+			"pattern, added by an earlier version, is chosen alone by its exact name; use '*' for all.",
+		maxArgs:   1,
+		argTypes:  []completer{completeTargets},
+		flagTypes: selectorFlagTypes,
+		setup: func(fs *flag.FlagSet) runFunc {
+			selector := registerSelectorFlag(fs, "Act on the services whose labels match `selector`, e.g. \"stack=payments,tier!=db\"")
+			parallel := fs.Int("parallel", 0, "Act on up to `n` services at once (default one at a time)")
+			dryRun := fs.Bool("dry-run", false, "Only list the services that would be affected")
+			return func(e *env, args []string) error {
+				if *selector == "" && len(args) == 0 {
+					return usageErrorf("usage: controlman %s <name> | all | <pattern> | -l <selector>", name)
+				}
+				if *parallel < 0 {
+					return usageErrorf("-parallel must not be negative")
+				}
+				target := ""
+				if len(args) > 0 {
+					target = args[0]
+				}
+				if *selector != "" || *dryRun || *parallel > 0 || service.IsPattern(target) {
+					return runBulk(e, name, &client.BulkRequest{Pattern: target, Selector: *selector, Parallel: *parallel, DryRun: *dryRun})
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				if err := do(c, e.ctx, target); err != nil {
+					return fmt.Errorf("failed to %s service: %w", name, err)
+				}
+				fmt.Printf(done+"\n", target)
+				return nil
+			}
+		},
+	}
+}
 
-	case "start":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: controlman start <name>")
-			return
-		}
-		err = c.StartService(os.Args[2])
-		if err != nil {
-			log.Fatalf("Failed to start service: %v", err)
-		}
-		fmt.Printf("Service '%s' started successfully\n", os.Args[2])
+func reloadCommand() *command {
+	return &command{
+		name:     "reload",
+		args:     "<name>",
+		summary:  "Send the reload signal to a service",
+		minArgs:  1,
+		maxArgs:  1,
+		argTypes: []completer{completeServices},
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				msg, err := c.ReloadService(e.ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to reload service: %w", err)
+				}
+				fmt.Printf("Service '%s' reloaded: %s\n", args[0], msg)
+				return nil
+			}
+		},
+	}
+}
 
-	case "restart":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: controlman restart <name>")
-			return
-		}
-		err = c.RestartService(os.Args[2])
-		if err != nil {
-			log.Fatalf("Failed to restart service: %v", err)
-		}
-		fmt.Printf("Service '%s' restarted successfully\n", os.Args[2])
+func scaleCommand() *command {
+	return &command{
+		name:     "scale",
+		args:     "<name> <replicas>",
+		summary:  "Run n instances of a service",
+		minArgs:  2,
+		maxArgs:  2,
+		argTypes: []completer{completeServices},
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				replicas, err := strconv.Atoi(args[1])
+				if err != nil {
+					return usageErrorf("invalid number of replicas: %s", args[1])
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				if err := c.ScaleService(e.ctx, args[0], replicas); err != nil {
+					return fmt.Errorf("failed to scale service: %w", err)
+				}
+				fmt.Printf("Service '%s' scaled to %d replicas\n", args[0], replicas)
+				return nil
+			}
+		},
+	}
+}
 
-	case "logs":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: controlman logs <name>")
-			return
-		}
-		logs, err := c.GetLogs(os.Args[2])
-		if err != nil {
-			log.Fatalf("Failed to get logs: %v", err)
-		}
-		fmt.Printf("Logs for service '%s':\n%s\n", os.Args[2], logs)
-		return
+func runCommand() *command {
+	return &command{
+		name:     "run",
+		args:     "<name>",
+		summary:  "Run a cron or oneshot job now",
+		minArgs:  1,
+		maxArgs:  1,
+		argTypes: []completer{completeJobs},
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				if err := c.RunJob(e.ctx, args[0]); err != nil {
+					return fmt.Errorf("failed to run job: %w", err)
+				}
+				fmt.Printf("Job '%s' started\n", args[0])
+				return nil
+			}
+		},
+	}
+}
 
-	case "info":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: controlman info <name>")
-			return
-		}
-		info, err := c.InfoService(os.Args[2])
-		if err != nil {
-			log.Fatalf("Failed to get service info: %v", err)
-		}
+func runsCommand() *command {
+	return &command{
+		name:     "runs",
+		args:     "<name>",
+		summary:  "Show the recent runs of a job",
+		minArgs:  1,
+		maxArgs:  1,
+		argTypes: []completer{completeJobs},
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				if err := e.out.requireNames("runs", false); err != nil {
+					return err
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				runs, err := c.ListRuns(e.ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to list runs: %w", err)
+				}
+				return e.out.print(runs, func(wide bool) { printRuns(runs, wide) }, nil)
+			}
+		},
+	}
+}
 
-		fmt.Printf("Service Information:\n")
-		fmt.Printf("  Name:        %s\n", info["name"])
-		fmt.Printf("  Status:      %s\n", info["status"])
-		fmt.Printf("  PID:         %d\n", int(info["pid"].(float64)))
-		fmt.Printf("  Command:     %s\n", info["command"])
-		fmt.Printf("  Created:     %s\n", formatTime(info["created_at"].(string)))
-		fmt.Printf("  Last Start:  %s\n", formatTime(info["last_start"].(string)))
-		fmt.Printf("  Log File:    %s\n", info["log_file"])
+func logsCommand() *command {
+	return &command{
+		name:     "logs",
+		args:     "<name>",
+		summary:  "View service logs (-f to follow)",
+		minArgs:  1,
+		maxArgs:  1,
+		argTypes: []completer{completeServices},
+		setup: func(fs *flag.FlagSet) runFunc {
+			follow := fs.Bool("f", false, "Keep printing new log lines until interrupted")
+			return func(e *env, args []string) error {
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				if *follow {
+					ctx, stop := signal.NotifyContext(e.ctx, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					if err := c.FollowLogs(ctx, args[0], os.Stdout); err != nil {
+						return fmt.Errorf("failed to follow logs: %w", err)
+					}
+					return nil
+				}
+				logs, err := c.Logs(e.ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to get logs: %w", err)
+				}
+				fmt.Printf("Logs for service '%s':\n%s\n", args[0], logs)
+				return nil
+			}
+		},
+	}
+}
 
-		cpu := info["cpu"].(float64)
-		mem := info["memory"].(float64)
-		fmt.Printf("  CPU Usage:   %.1f%%\n", cpu)
-		fmt.Printf("  Memory:      %s\n", formatMemory(mem))
+func infoCommand() *command {
+	return &command{
+		name:     "info",
+		args:     "<name>",
+		summary:  "View service info",
+		minArgs:  1,
+		maxArgs:  1,
+		argTypes: []completer{completeServices},
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				info, err := c.Service(e.ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to get service info: %w", err)
+				}
+				return e.out.print(info, func(bool) { printInfo(os.Stdout, *info) }, func() []string {
+					return serviceNames([]client.ServiceInfo{*info})
+				})
+			}
+		},
+	}
+}
 
-		return
+func listCommand() *command {
+	return &command{
+		name:      "list",
+		summary:   "List all services",
+		flagTypes: mergeCompleters(selectorFlagTypes, map[string]completer{"group-by": completeLabelKeys}),
+		setup: func(fs *flag.FlagSet) runFunc {
+			selector := registerSelectorFlag(fs, "Only list the services whose labels match `selector`, e.g. \"stack=payments\"")
+			groupBy := fs.String("group-by", "", "Summarize the status of the services by their value of the label `key`")
+			return func(e *env, args []string) error {
+				if e.global.allContexts {
+					if *groupBy != "" {
+						return usageErrorf("-group-by cannot be combined with --all-contexts")
+					}
+					return listAllContexts(e.ctx, e.out, *selector)
+				}
+				if *groupBy != "" {
+					if err := service.ValidateLabelKey(*groupBy); err != nil {
+						return usageErrorf("%v", err)
+					}
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				services, err := c.SelectServices(e.ctx, *selector)
+				if err != nil {
+					return fmt.Errorf("failed to list services: %w", err)
+				}
+				if *groupBy != "" {
+					groups := groupServices(services, *groupBy)
+					return e.out.print(groups, func(bool) { printGroups(*groupBy, groups) }, func() []string {
+						values := make([]string, len(groups))
+						for i, g := range groups {
+							values[i] = g.Value
+						}
+						return values
+					})
+				}
+				return e.out.print(services, func(wide bool) { printServices(services, wide) }, func() []string {
+					return serviceNames(services)
+				})
+			}
+		},
+	}
+}
 
-	case "list":
-		services, err := c.ListServices()
-		if err != nil {
-			log.Fatalf("Failed to list services: %v", err)
-		}
-		printServices(services)
-		return
+func notifyTestCommand() *command {
+	return &command{
+		name:     "notify-test",
+		args:     "[name]",
+		summary:  "Publish a test event to notification sinks",
+		maxArgs:  1,
+		argTypes: []completer{completeServices},
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				name := ""
+				if len(args) > 0 {
+					name = args[0]
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				if err := c.NotifyTest(e.ctx, name); err != nil {
+					return fmt.Errorf("failed to send test notification: %w", err)
+				}
+				fmt.Println("Test event published to all notification sinks")
+				return nil
+			}
+		},
+	}
+}
 
-	case "top":
-		// Initial clear screen
-		fmt.Print("\033[2J")
-
-		for {
-			services, err := c.ListServices()
-			if err != nil {
-				// Clear screen to show error clearly
-				fmt.Print("\033[2J\033[H")
-				log.Printf("Failed to list services: %v", err)
-				time.Sleep(1 * time.Second)
-				continue
+func hostsCommand() *command {
+	return &command{
+		name:    "hosts",
+		summary: "List the hosts of the fleet the daemon is the hub of",
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				hosts, err := c.Hosts(e.ctx)
+				if err != nil {
+					return fmt.Errorf("failed to list hosts: %w", err)
+				}
+				return e.out.print(hosts, func(bool) { printHosts(hosts) }, func() []string {
+					names := make([]string, len(hosts))
+					for i, h := range hosts {
+						names[i] = h.Name
+					}
+					return names
+				})
 			}
+		},
+	}
+}
 
-			// Move cursor to top-left (1,1)
-			fmt.Print("\033[H")
-			fmt.Printf("Controlman Top - %s\n\n", time.Now().Format("15:04:05"))
-			printServices(services)
-			// Clear from cursor to end of screen
-			fmt.Print("\033[J")
+var hookNames = []string{service.HookPreStart, service.HookPostStart, service.HookPreStop, service.HookPostStop}
 
-			time.Sleep(500 * time.Millisecond)
-		}
+// hookFlags registers -pre-start, -pre-start-timeout, ... on a FlagSet.
+type hookFlags struct {
+	commands map[string]*optionalString
+	timeouts map[string]*optionalString
+}
+
+// optionalString is the value of a string flag that remembers whether it
+// was given. The flags are parsed from a copy of the command's flag set,
+// so the one they were registered on cannot tell.
+type optionalString struct {
+	value string
+	set   bool
+}
+
+func (s *optionalString) String() string { return s.value }
+
+func (s *optionalString) Set(value string) error {
+	s.value, s.set = value, true
+	return nil
+}
+
+func registerHookFlags(fs *flag.FlagSet) *hookFlags {
+	hf := &hookFlags{
+		commands: make(map[string]*optionalString),
+		timeouts: make(map[string]*optionalString),
+	}
+	for _, name := range hookNames {
+		hf.commands[name] = &optionalString{}
+		hf.timeouts[name] = &optionalString{}
+		fs.Var(hf.commands[name], name, "Run `command` as the "+name+" hook (empty to remove it)")
+		fs.Var(hf.timeouts[name], name+"-timeout", "Wait at most `duration` for the "+name+" hook (default "+service.DefaultHookTimeout.String()+")")
+	}
+	return hf
+}
 
-	case "delete":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: controlman delete <name>")
-			return
+// hooks returns the hooks explicitly set on the command line, or nil if none were.
+func (hf *hookFlags) hooks() (*service.Hooks, error) {
+	var hooks *service.Hooks
+	for _, name := range hookNames {
+		if !hf.commands[name].set {
+			if hf.timeouts[name].set {
+				return nil, fmt.Errorf("-%s-timeout requires -%s", name, name)
+			}
+			continue
 		}
-		err = c.DeleteService(os.Args[2])
-		if err != nil {
-			log.Fatalf("Failed to delete service: %v", err)
+		if hooks == nil {
+			hooks = &service.Hooks{}
+		}
+		hook := &service.Hook{Command: hf.commands[name].value, Timeout: hf.timeouts[name].value}
+		switch name {
+		case service.HookPreStart:
+			hooks.PreStart = hook
+		case service.HookPostStart:
+			hooks.PostStart = hook
+		case service.HookPreStop:
+			hooks.PreStop = hook
+		case service.HookPostStop:
+			hooks.PostStop = hook
 		}
-		fmt.Printf("Service '%s' deleted successfully\n", os.Args[2])
-
-	default:
-		printUsage()
-		return
 	}
+	return hooks, hooks.Validate()
 }
 
 func formatTime(timeStr string) string {
@@ -229,40 +724,237 @@ func formatMemory(bytes float64) string {
 	return fmt.Sprintf("%.1fGB", bytes/1024/1024/1024)
 }
 
-func printServices(services []map[string]interface{}) {
-	if len(services) == 0 {
+func printServices(all []client.ServiceInfo, wide bool) {
+	if len(all) == 0 {
 		fmt.Println("No services found")
 		return
 	}
+
+	var services, jobs []client.ServiceInfo
+	for _, s := range all {
+		if s.Type == service.TypeCron || s.Type == service.TypeOneshot {
+			jobs = append(jobs, s)
+		} else {
+			services = append(services, s)
+		}
+	}
+
+	if len(services) > 0 {
+		printServiceTable(services, wide)
+	}
+	if len(jobs) > 0 {
+		if len(services) > 0 {
+			fmt.Println()
+		}
+		printJobTable(jobs, wide)
+	}
+}
+
+func printJobTable(jobs []client.ServiceInfo, wide bool) {
+	withHost := hasHosts(jobs)
+	if withHost {
+		fmt.Printf("%-16s ", "HOST")
+	}
+	fmt.Printf("%-20s %-8s %-10s %-16s %-19s ", "JOB", "TYPE", "STATUS", "SCHEDULE", "NEXT RUN")
+	if wide {
+		fmt.Printf("%-24s %-24s %s\n", "LAST RESULT", "LABELS", "COMMAND")
+	} else {
+		fmt.Println("LAST RESULT")
+	}
+	for _, j := range jobs {
+		schedule := j.Schedule
+		if schedule == "" {
+			schedule = "-"
+		}
+		if withHost {
+			fmt.Printf("%-16s ", j.Host)
+		}
+		fmt.Printf("%-20s %-8s %-10s %-16s %-19s ",
+			j.Name,
+			j.Type,
+			j.Status,
+			schedule,
+			formatNextRun(j))
+		if wide {
+			fmt.Printf("%-24s %-24s %s\n", formatLastRun(j), formatLabelsColumn(j.Labels), j.Command)
+		} else {
+			fmt.Println(formatLastRun(j))
+		}
+	}
+}
+
+func formatNextRun(s client.ServiceInfo) string {
+	if s.NextRun == "" {
+		return "-"
+	}
+	return formatTime(s.NextRun)
+}
+
+func formatLastRun(s client.ServiceInfo) string {
+	if s.LastRun == nil {
+		return "never"
+	}
+	return formatRunResult(*s.LastRun)
+}
+
+func formatRunResult(run client.Run) string {
+	result := "ok"
+	if run.ExitCode != 0 {
+		result = fmt.Sprintf("exit %d", run.ExitCode)
+	}
+	return fmt.Sprintf("%s (%.1fs, %s)", result, run.Duration, run.FinishedAt.Format("2006-01-02 15:04:05"))
+}
+
+func printRuns(runs []client.Run, wide bool) {
+	if len(runs) == 0 {
+		fmt.Println("No runs recorded")
+		return
+	}
+	if wide {
+		fmt.Printf("%-19s %-19s %-9s %-6s %-10s %s\n", "STARTED", "FINISHED", "TRIGGER", "EXIT", "DURATION", "ERROR")
+	} else {
+		fmt.Printf("%-19s %-9s %-6s %-10s %s\n", "STARTED", "TRIGGER", "EXIT", "DURATION", "ERROR")
+	}
+	for _, r := range runs {
+		fmt.Printf("%-19s ", r.StartedAt.Format("2006-01-02 15:04:05"))
+		if wide {
+			fmt.Printf("%-19s ", r.FinishedAt.Format("2006-01-02 15:04:05"))
+		}
+		fmt.Printf("%-9s %-6d %-10s %s\n",
+			r.Trigger,
+			r.ExitCode,
+			fmt.Sprintf("%.1fs", r.Duration),
+			r.Error)
+	}
+}
+
+// hasHosts reports whether the services come from several fleet hosts and
+// need a HOST column.
+func hasHosts(services []client.ServiceInfo) bool {
+	for _, s := range services {
+		if s.Host != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func printServiceTable(services []client.ServiceInfo, wide bool) {
+	withHost := hasHosts(services)
 	// 打印表头
-	fmt.Printf("%-20s %-10s %-8s %-10s %-12s %-19s\n", "NAME", "STATUS", "PID", "CPU", "MEMORY", "LAST START")
+	if withHost {
+		fmt.Printf("%-16s ", "HOST")
+	}
+	fmt.Printf("%-20s %-10s %-6s %-8s %-10s %-12s %-19s", "NAME", "STATUS", "READY", "PID", "CPU", "MEMORY", "LAST START")
+	if wide {
+		fmt.Printf(" %-19s %-24s %s", "CREATED", "LABELS", "COMMAND")
+	}
+	fmt.Println()
 	// 打印服务信息
 	for _, s := range services {
-		pid := int(s["pid"].(float64))
-		cpu := s["cpu"].(float64)
-		mem := s["memory"].(float64)
-		fmt.Printf("%-20s %-10s %-8d %-10s %-12s %-19s\n",
-			s["name"],
-			s["status"],
-			pid,
-			fmt.Sprintf("%.1f%%", cpu),
-			formatMemory(mem),
-			formatTime(s["last_start"].(string)))
-	}
-}
-
-func printUsage() {
-	fmt.Println(`Usage: controlman <command> [arguments]
-
-Commands:
-    add <name> <command>    Add a new service
-    stop <name>            Stop a service
-    start <name>           Start a service
-    restart <name>         Restart a service
-    logs <name>            View service logs
-    info <name>            View service info
-    list                   List all services
-    top                    Monitor services in real-time
-    delete <name>          Delete a service
-    -daemon               Run in daemon mode`)
+		if withHost {
+			fmt.Printf("%-16s ", s.Host)
+		}
+		fmt.Printf("%-20s %-10s %-6s %-8d %-10s %-12s %-19s",
+			s.Name,
+			s.Status,
+			fmt.Sprintf("%d/%d", s.Ready, s.Replicas),
+			s.PID,
+			fmt.Sprintf("%.1f%%", s.CPU),
+			formatMemory(s.Memory),
+			formatTime(s.LastStart))
+		if wide {
+			fmt.Printf(" %-19s %-24s %s", formatTime(s.CreatedAt), formatLabelsColumn(s.Labels), s.Command)
+		}
+		fmt.Println()
+	}
+}
+
+func printInfo(w io.Writer, info client.ServiceInfo) {
+	fmt.Fprintf(w, "Service Information:\n")
+	fmt.Fprintf(w, "  Name:        %s\n", info.Name)
+	fmt.Fprintf(w, "  Status:      %s\n", info.Status)
+	fmt.Fprintf(w, "  PID:         %d\n", info.PID)
+	if info.Exec != nil {
+		fmt.Fprintf(w, "  Command:     %s\n", info.Command)
+	} else {
+		fmt.Fprintf(w, "  Command:     %s (sh -c)\n", info.Command)
+	}
+	fmt.Fprintf(w, "  Created:     %s\n", formatTime(info.CreatedAt))
+	fmt.Fprintf(w, "  Last Start:  %s\n", formatTime(info.LastStart))
+	fmt.Fprintf(w, "  Restarts:    %d\n", info.Restarts)
+	fmt.Fprintf(w, "  Log File:    %s\n", info.LogFile)
+	if len(info.Labels) > 0 {
+		fmt.Fprintf(w, "  Labels:      %s\n", service.FormatLabels(info.Labels))
+	}
+	if info.Type == "" || info.Type == service.TypeService {
+		fmt.Fprintf(w, "  Reload:      %s\n", info.ReloadSignal)
+	} else {
+		fmt.Fprintf(w, "  Type:        %s\n", info.Type)
+		if info.Schedule != "" {
+			fmt.Fprintf(w, "  Schedule:    %s\n", info.Schedule)
+		}
+		fmt.Fprintf(w, "  Next Run:    %s\n", formatNextRun(info))
+		fmt.Fprintf(w, "  Last Result: %s\n", formatLastRun(info))
+	}
+
+	fmt.Fprintf(w, "  CPU Usage:   %.1f%%\n", info.CPU)
+	fmt.Fprintf(w, "  Memory:      %s\n", formatMemory(info.Memory))
+
+	if len(info.Instances) > 0 {
+		fmt.Fprintf(w, "  Replicas:    %d/%d running\n", info.Ready, info.Replicas)
+		if info.PortTemplate != "" {
+			fmt.Fprintf(w, "  Port:        %s\n", info.PortTemplate)
+		}
+		fmt.Fprintf(w, "  Instances:\n")
+		fmt.Fprintf(w, "    %-4s %-8s %-6s %-19s %s\n", "#", "PID", "PORT", "LAST START", "LOG FILE")
+		for _, inst := range info.Instances {
+			port := inst.Port
+			if port == "" {
+				port = "-"
+			}
+			fmt.Fprintf(w, "    %-4d %-8d %-6s %-19s %s\n", inst.Index, inst.PID, port, formatTime(inst.LastStart), inst.LogFile)
+		}
+	}
+
+	if !info.Hooks.IsEmpty() {
+		fmt.Fprintf(w, "  Hooks:\n")
+		for _, name := range hookNames {
+			hook := info.Hooks.Get(name)
+			if hook == nil {
+				continue
+			}
+			timeout := hook.Timeout
+			if timeout == "" {
+				timeout = service.DefaultHookTimeout.String()
+			}
+			fmt.Fprintf(w, "    %-11s %s (timeout %s)\n", name+":", hook.Command, timeout)
+		}
+	}
+}
+
+// serviceNames lists the names of services for -o name, prefixed with the
+// host in fleet listings like in the audit log.
+func serviceNames(services []client.ServiceInfo) []string {
+	names := make([]string, len(services))
+	for i, s := range services {
+		names[i] = s.Name
+		if s.Host != "" {
+			names[i] = s.Host + ":" + s.Name
+		}
+	}
+	return names
+}
+
+func printHosts(hosts []client.HostInfo) {
+	fmt.Printf("%-20s %-22s %s\n", "HOST", "ADDRESS", "CONNECTED")
+	for _, h := range hosts {
+		address, connected := h.Address, "-"
+		if h.Local {
+			address = "(this daemon)"
+		} else {
+			connected = h.ConnectedAt.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-20s %-22s %s\n", h.Name, address, connected)
+	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+// fakeAPI records the requests the CLI sends to the /command endpoint and
+// answers each with success.
+type fakeAPI struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []protocol.Request
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	t.Helper()
+	api := &fakeAPI{}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		api.mu.Lock()
+		api.requests = append(api.requests, req)
+		api.mu.Unlock()
+		json.NewEncoder(w).Encode(protocol.Response{Success: true})
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+// run runs the CLI against the fake API and returns the request it sent.
+func (api *fakeAPI) run(t *testing.T, args ...string) protocol.Request {
+	t.Helper()
+	api.mu.Lock()
+	api.requests = nil
+	api.mu.Unlock()
+	if err := execute(context.Background(), newRootCommand(), append([]string{"--host", api.URL}, args...)); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.requests) != 1 {
+		t.Fatalf("%v: sent %d requests, want 1", args, len(api.requests))
+	}
+	return api.requests[0]
+}
+
+func TestHookFlags(t *testing.T) {
+	api := newFakeAPI(t)
+	for _, args := range [][]string{
+		{"add", "hk", "-pre-start", "exit 1", "-pre-start-timeout", "5s", "/bin/sleep", "100"},
+		{"edit", "hk", "-pre-start", "exit 1", "-pre-start-timeout", "5s"},
+		{"edit", "-pre-start=exit 1", "hk", "-pre-start-timeout=5s"},
+	} {
+		req := api.run(t, args...)
+		var opts protocol.ServiceOptions
+		if err := json.Unmarshal(req.Data, &opts); err != nil {
+			t.Fatalf("%v: decoding options: %v", args, err)
+		}
+		if req.Action != args[0] || req.Name != "hk" {
+			t.Errorf("%v: sent %s %s", args, req.Action, req.Name)
+		}
+		if opts.Hooks == nil || opts.Hooks.PreStart == nil {
+			t.Fatalf("%v: sent no pre-start hook in %s", args, req.Data)
+		}
+		if hook := opts.Hooks.PreStart; hook.Command != "exit 1" || hook.Timeout != "5s" {
+			t.Errorf("%v: sent pre-start hook %+v", args, hook)
+		}
+		if opts.Hooks.PostStart != nil || opts.Hooks.PreStop != nil || opts.Hooks.PostStop != nil {
+			t.Errorf("%v: sent hooks that were not given: %s", args, req.Data)
+		}
+	}
+}
+
+func TestHookFlagsRemoveAndKeep(t *testing.T) {
+	api := newFakeAPI(t)
+
+	req := api.run(t, "edit", "hk", "-post-stop", "")
+	var opts protocol.ServiceOptions
+	json.Unmarshal(req.Data, &opts)
+	if opts.Hooks == nil || opts.Hooks.PostStop == nil || opts.Hooks.PostStop.Command != "" {
+		t.Errorf("-post-stop \"\" sent %s, want an empty post-stop hook to remove it", req.Data)
+	}
+
+	req = api.run(t, "edit", "hk", "-labels", "tier=web")
+	opts = protocol.ServiceOptions{}
+	json.Unmarshal(req.Data, &opts)
+	if opts.Hooks != nil {
+		t.Errorf("edit without hook flags sent hooks: %s", req.Data)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Output formats of the read commands, chosen with -o
+const (
+	outputTable    = ""
+	outputWide     = "wide"
+	outputName     = "name"
+	outputJSON     = "json"
+	outputYAML     = "yaml"
+	outputTemplate = "template"
+)
+
+// printer writes the results of read commands in the format chosen with -o
+// and --template. JSON, YAML and templates use the field names of the API
+// (the JSON tags of pkg/protocol), so scripts see the same names whichever
+// way they talk to the daemon.
+type printer struct {
+	format string
+	tmpl   *template.Template
+}
+
+func newPrinter(opts globalOptions) (*printer, error) {
+	p := &printer{format: opts.output}
+	if opts.template != "" {
+		if p.format == outputTable {
+			p.format = outputTemplate
+		}
+		if p.format != outputTemplate {
+			return nil, fmt.Errorf("--template cannot be combined with -o %s", p.format)
+		}
+		tmpl, err := template.New("output").Funcs(templateFuncs).Parse(opts.template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --template: %v", err)
+		}
+		p.tmpl = tmpl
+	}
+	switch p.format {
+	case outputTable, outputWide, outputName, outputJSON, outputYAML:
+	case outputTemplate:
+		if p.tmpl == nil {
+			return nil, fmt.Errorf("-o template needs --template")
+		}
+	default:
+		return nil, fmt.Errorf("unknown output format %q (expected json, yaml, wide, name or template)", p.format)
+	}
+	return p, nil
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := marshalJSON(v, false)
+		return strings.TrimSuffix(string(data), "\n"), err
+	},
+	"join": func(sep string, list []any) string {
+		s := make([]string, len(list))
+		for i, v := range list {
+			s[i] = fmt.Sprint(v)
+		}
+		return strings.Join(s, sep)
+	},
+}
+
+// table reports whether a human-readable table is printed, and wide whether
+// it has the extra columns of -o wide.
+func (p *printer) table() (ok, wide bool) {
+	return p.format == outputTable || p.format == outputWide, p.format == outputWide
+}
+
+// print writes the result v of a command. table prints it for people;
+// names lists what -o name prints and is nil for results without names.
+func (p *printer) print(v any, table func(wide bool), names func() []string) error {
+	return p.write(v, false, table, names)
+}
+
+// printItem writes one item of a stream such as events: JSON one object per
+// line and YAML one document per item.
+func (p *printer) printItem(v any, table func(wide bool), names func() []string) error {
+	return p.write(v, true, table, names)
+}
+
+// requireNames stops early when -o name is used with a command whose
+// results have no names, before it starts printing.
+func (p *printer) requireNames(command string, names bool) error {
+	if p.format == outputName && !names {
+		return usageErrorf("-o name is not supported by %s", command)
+	}
+	return nil
+}
+
+func (p *printer) write(v any, stream bool, table func(wide bool), names func() []string) error {
+	var out []byte
+	var err error
+	switch p.format {
+	case outputTable, outputWide:
+		table(p.format == outputWide)
+		return nil
+	case outputName:
+		if names == nil {
+			return usageErrorf("-o name is not supported by this command")
+		}
+		for _, name := range names() {
+			fmt.Println(name)
+		}
+		return nil
+	case outputJSON:
+		out, err = marshalJSON(v, !stream)
+	case outputYAML:
+		out, err = toYAML(v)
+		if err == nil && stream {
+			out = append([]byte("---\n"), out...)
+		}
+	case outputTemplate:
+		out, err = p.execute(v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to format output: %w", err)
+	}
+	if len(out) == 0 || out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// marshalJSON is json.Marshal without escaping <, > and &, which only
+// matters in HTML, e.g. in "running -> stopped".
+func marshalJSON(v any, indent bool) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// toYAML converts through JSON so that the keys are the JSON field names.
+func toYAML(v any) ([]byte, error) {
+	data, err := marshalJSON(v, false)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(data)
+}
+
+// execute runs the template on v as the API would send it, so that fields
+// are named like in the JSON output: {{.name}}, not {{.Name}}.
+func (p *printer) execute(v any) ([]byte, error) {
+	data, err := marshalJSON(v, false)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as they were sent rather than as float64, e.g. PIDs
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
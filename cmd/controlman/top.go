@@ -0,0 +1,944 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tangthinker/controlman/pkg/client"
+	"github.com/tangthinker/controlman/pkg/protocol"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// How often top lists the services
+const topInterval = 500 * time.Millisecond
+
+// Lines of log kept for the log pane
+const topLogLines = 500
+
+// Columns top can sort by, in the order < and > go through them
+var topSortKeys = []string{"name", "cpu", "memory", "restarts", "uptime"}
+
+const topHelp = `On a terminal top takes the whole screen and is driven by keys:
+    up/down, k/j   Select a service
+    < >            Sort by the previous or next column: name, cpu, memory,
+                   restarts or uptime (largest first); o reverses the order
+    /              Filter by name, or by status, e.g. "failed"; Esc clears it
+    s x r          Start, stop or restart the selected service
+    d              Delete the selected service, after asking
+    l              Show the log of the selected service below
+    Enter, i       Show the details of the selected service, like info
+    q              Quit, or go back from the details
+When stdout is not a terminal, or with -o, it prints the services at every
+refresh instead.`
+
+func topCommand() *command {
+	return &command{
+		name:      "top",
+		summary:   "Monitor services in real-time",
+		help:      topHelp,
+		flagTypes: map[string]completer{"sort": fixedValues(topSortKeys...)},
+		setup: func(fs *flag.FlagSet) runFunc {
+			sortKey := fs.String("sort", "name", "Column to sort by: name, cpu, memory, restarts or uptime")
+			filter := fs.String("filter", "", "Only show the services whose name contains `text` or whose status is text")
+			return func(e *env, args []string) error {
+				if !slices.Contains(topSortKeys, *sortKey) {
+					return usageErrorf("unknown sort column %q (expected %s)", *sortKey, strings.Join(topSortKeys, ", "))
+				}
+				if err := e.out.requireNames("top", false); err != nil {
+					return err
+				}
+				c, err := e.client()
+				if err != nil {
+					return err
+				}
+				if ok, _ := e.out.table(); !ok {
+					// 机器可读格式：每次刷新输出一条记录，不清屏
+					for {
+						services, err := c.ListServices(e.ctx)
+						if err != nil {
+							return fmt.Errorf("failed to list services: %w", err)
+						}
+						if err := e.out.printItem(filterServices(services, *filter), nil, nil); err != nil {
+							return err
+						}
+						time.Sleep(topInterval)
+					}
+				}
+				_, wide := e.out.table()
+
+				ctx, stop := signal.NotifyContext(e.ctx, os.Interrupt, syscall.SIGTERM)
+				defer stop()
+				term, err := openTerminal()
+				if err != nil {
+					// 不是终端：退回到定时重绘整张表
+					return topPlain(ctx, c, *sortKey, *filter, wide)
+				}
+				ui := &topUI{
+					ctx:     ctx,
+					e:       e,
+					c:       c,
+					term:    term,
+					sortKey: *sortKey,
+					filter:  *filter,
+					listed:  make(chan topList),
+					results: make(chan string),
+					logs:    make(chan logChunk),
+					clients: make(map[string]*client.Client),
+				}
+				return ui.run()
+			}
+		},
+	}
+}
+
+// topPlain redraws the table of services until ctx is done.
+func topPlain(ctx context.Context, c *client.Client, sortKey, filter string, wide bool) error {
+	// Initial clear screen
+	fmt.Print("\033[2J")
+
+	for ctx.Err() == nil {
+		services, err := c.ListServices(ctx)
+		if err != nil {
+			// Clear screen to show error clearly
+			fmt.Print("\033[2J\033[H")
+			log.Printf("Failed to list services: %v", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		services = filterServices(services, filter)
+		sortServices(services, sortKey, false)
+
+		// Move cursor to top-left (1,1)
+		fmt.Print("\033[H")
+		fmt.Printf("Controlman Top - %s\n\n", time.Now().Format("15:04:05"))
+		printServices(services, wide)
+		// Clear from cursor to end of screen
+		fmt.Print("\033[J")
+
+		time.Sleep(topInterval)
+	}
+	return nil
+}
+
+// filterServices keeps the services whose name contains filter or whose
+// status is filter, ignoring case.
+func filterServices(services []client.ServiceInfo, filter string) []client.ServiceInfo {
+	if filter == "" {
+		return services
+	}
+	filter = strings.ToLower(filter)
+	var kept []client.ServiceInfo
+	for _, s := range services {
+		if strings.Contains(strings.ToLower(s.Name), filter) || strings.ToLower(s.Status) == filter {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// sortServices sorts by name, or by the largest value of the column first.
+// Services with the same value stay in the order of their names.
+func sortServices(services []client.ServiceInfo, key string, reverse bool) {
+	now := time.Now()
+	value := func(s client.ServiceInfo) float64 {
+		switch key {
+		case "cpu":
+			return s.CPU
+		case "memory":
+			return s.Memory
+		case "restarts":
+			return float64(s.Restarts)
+		case "uptime":
+			return uptime(s, now).Seconds()
+		}
+		return 0
+	}
+	sort.SliceStable(services, func(i, j int) bool {
+		a, b := services[i], services[j]
+		if va, vb := value(a), value(b); va != vb {
+			return (va > vb) != reverse
+		}
+		if a.Name != b.Name {
+			return (a.Name < b.Name) != (reverse && key == "name")
+		}
+		return a.Host < b.Host
+	})
+}
+
+// uptime is how long a running service has been up, 0 otherwise.
+func uptime(s client.ServiceInfo, now time.Time) time.Duration {
+	if s.Status != service.StatusRunning {
+		return 0
+	}
+	started, err := time.Parse(time.RFC3339, s.LastStart)
+	if err != nil || started.IsZero() || started.After(now) {
+		return 0
+	}
+	return now.Sub(started)
+}
+
+func formatUptime(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return "-"
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd%02dh", int(d.Hours())/24, int(d.Hours())%24)
+}
+
+// terminal switches the terminal to reading keys as they are typed, without
+// echoing them, and to its alternate screen. Like readPassword it uses stty.
+type terminal struct {
+	saved string // settings to restore, from stty -g
+}
+
+func openTerminal() (*terminal, error) {
+	if fi, err := os.Stdout.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil, errors.New("stdout is not a terminal")
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1", "time", "0"); err != nil {
+		return nil, err
+	}
+	// Alternate screen, hidden cursor
+	fmt.Print("\033[?1049h\033[?25l")
+	return &terminal{saved: strings.TrimSpace(saved)}, nil
+}
+
+func (t *terminal) restore() {
+	fmt.Print("\033[?25h\033[?1049l")
+	stty(t.saved)
+}
+
+// size returns the width and height of the terminal.
+func (t *terminal) size() (width, height int) {
+	out, err := stty("size")
+	if err != nil {
+		return 80, 24
+	}
+	if _, err := fmt.Sscan(out, &height, &width); err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// Keys that are not a single character
+const (
+	keyUp        = "up"
+	keyDown      = "down"
+	keyPageUp    = "pgup"
+	keyPageDown  = "pgdown"
+	keyEnter     = "enter"
+	keyEsc       = "esc"
+	keyBackspace = "backspace"
+)
+
+// readKeys sends the keys typed on stdin until it is closed.
+func readKeys(keys chan<- string) {
+	buf := make([]byte, 64)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			keys <- k
+		}
+	}
+}
+
+func parseKeys(b []byte) []string {
+	sequences := map[string]string{
+		"\x1b[A": keyUp, "\x1bOA": keyUp,
+		"\x1b[B": keyDown, "\x1bOB": keyDown,
+		"\x1b[5~": keyPageUp, "\x1b[6~": keyPageDown,
+	}
+	var keys []string
+next:
+	for len(b) > 0 {
+		for seq, key := range sequences {
+			if bytes.HasPrefix(b, []byte(seq)) {
+				keys = append(keys, key)
+				b = b[len(seq):]
+				continue next
+			}
+		}
+		switch {
+		case len(b) > 1 && b[0] == 0x1b && (b[1] == '[' || b[1] == 'O'):
+			// Another sequence, such as a function key: skip it
+			i := 2
+			for i < len(b) && (b[i] < 0x40 || b[i] > 0x7e) {
+				i++
+			}
+			b = b[min(i+1, len(b)):]
+		case b[0] == 0x1b:
+			keys = append(keys, keyEsc)
+			b = b[1:]
+		case b[0] == '\r' || b[0] == '\n':
+			keys = append(keys, keyEnter)
+			b = b[1:]
+		case b[0] == 0x7f || b[0] == 0x08:
+			keys = append(keys, keyBackspace)
+			b = b[1:]
+		default:
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, string(r))
+			b = b[size:]
+		}
+	}
+	return keys
+}
+
+// Prompts on the bottom line of top
+const (
+	promptNone = iota
+	promptFilter
+	promptDelete
+)
+
+// topList is the result of listing the services, and of getting the details
+// of the one shown, if any.
+type topList struct {
+	services []client.ServiceInfo
+	err      error
+	detail   *client.ServiceInfo
+	key      string // of detail
+}
+
+// logChunk is text appended to the log of a service.
+type logChunk struct {
+	key  string
+	text string
+	err  error
+}
+
+// logWriter sends what FollowLogs writes to the log pane.
+type logWriter struct {
+	ctx  context.Context
+	key  string
+	logs chan<- logChunk
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	select {
+	case w.logs <- logChunk{key: w.key, text: string(p)}:
+		return len(p), nil
+	case <-w.ctx.Done():
+		return 0, w.ctx.Err()
+	}
+}
+
+// topUI is the interactive screen of top. Its state is only touched by the
+// goroutine of run; requests to the daemon run in their own goroutines and
+// send their results back over the channels.
+type topUI struct {
+	ctx  context.Context
+	e    *env
+	c    *client.Client
+	term *terminal
+
+	width, height int
+
+	services []client.ServiceInfo // as last listed
+	listErr  error
+	updated  time.Time
+	fetching bool
+
+	sortKey string
+	reverse bool
+	filter  string
+	prompt  int
+
+	selected string // key of the selected service
+	detail   string // key of the service whose details are shown
+	info     *client.ServiceInfo
+	message  string
+
+	showLogs   bool
+	logKey     string
+	logLines   []string // the last one may not be complete yet
+	stopFollow context.CancelFunc
+
+	listed  chan topList
+	results chan string
+	logs    chan logChunk
+	clients map[string]*client.Client // of fleet hosts, with --agent all
+}
+
+// serviceKey identifies a service among those of several fleet hosts.
+func serviceKey(s client.ServiceInfo) string {
+	if s.Host != "" {
+		return s.Host + ":" + s.Name
+	}
+	return s.Name
+}
+
+func (ui *topUI) run() error {
+	defer ui.term.restore()
+	defer ui.stopLogs()
+	defer func() {
+		for _, c := range ui.clients {
+			c.Close()
+		}
+	}()
+
+	keys := make(chan string)
+	go readKeys(keys)
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	defer signal.Stop(resized)
+	ticker := time.NewTicker(topInterval)
+	defer ticker.Stop()
+
+	ui.width, ui.height = ui.term.size()
+	ui.refresh()
+	for {
+		// Keep the selection on a listed service as the list changes
+		ui.move(0)
+		ui.followSelected()
+		ui.draw()
+		select {
+		case <-ui.ctx.Done():
+			return nil
+		case k, ok := <-keys:
+			if !ok || ui.handleKey(k) {
+				return nil
+			}
+		case <-resized:
+			ui.width, ui.height = ui.term.size()
+		case <-ticker.C:
+			ui.refresh()
+		case l := <-ui.listed:
+			ui.fetching = false
+			ui.services, ui.listErr, ui.updated = l.services, l.err, time.Now()
+			if l.key == ui.detail {
+				ui.info = l.detail
+			}
+		case msg := <-ui.results:
+			ui.message = msg
+			ui.refresh()
+		case chunk := <-ui.logs:
+			if chunk.key == ui.logKey {
+				ui.appendLog(chunk)
+			}
+		}
+	}
+}
+
+// send delivers a result to run unless top is quitting.
+func send[T any](ctx context.Context, ch chan<- T, v T) {
+	select {
+	case ch <- v:
+	case <-ctx.Done():
+	}
+}
+
+// refresh lists the services, and gets the details of the one shown, in
+// the background.
+func (ui *topUI) refresh() {
+	if ui.fetching {
+		return
+	}
+	ui.fetching = true
+	key := ui.detail
+	var dc *client.Client
+	var name string
+	if s, ok := ui.find(key); ok {
+		dc, name = ui.clientFor(s), s.Name
+	}
+	go func() {
+		l := topList{key: key}
+		l.services, l.err = ui.c.ListServices(ui.ctx)
+		if dc != nil && l.err == nil {
+			l.detail, _ = dc.Service(ui.ctx, name)
+		}
+		send(ui.ctx, ui.listed, l)
+	}()
+}
+
+// clientFor returns the client that reaches the host of s. With --agent all
+// the hub only answers list for all hosts, so the other commands are sent
+// to the host of the service.
+func (ui *topUI) clientFor(s client.ServiceInfo) *client.Client {
+	if ui.e.global.agent != protocol.AllHosts || s.Host == "" {
+		return ui.c
+	}
+	if c, ok := ui.clients[s.Host]; ok {
+		return c
+	}
+	opts := *ui.e.global
+	opts.agent = s.Host
+	c, err := connect(opts)
+	if err != nil {
+		ui.message = fmt.Sprintf("Error: failed to create client for host %s: %v", s.Host, err)
+		return nil
+	}
+	ui.clients[s.Host] = c
+	return c
+}
+
+func (ui *topUI) find(key string) (client.ServiceInfo, bool) {
+	for _, s := range ui.services {
+		if serviceKey(s) == key {
+			return s, true
+		}
+	}
+	return client.ServiceInfo{}, false
+}
+
+// visible returns the services shown in the list, filtered and sorted.
+func (ui *topUI) visible() []client.ServiceInfo {
+	services := filterServices(slices.Clone(ui.services), ui.filter)
+	sortServices(services, ui.sortKey, ui.reverse)
+	return services
+}
+
+// current returns the service the keys act on: the one whose details are
+// shown, or the one selected in the list.
+func (ui *topUI) current() (client.ServiceInfo, bool) {
+	if ui.detail != "" {
+		return ui.find(ui.detail)
+	}
+	services := ui.visible()
+	if len(services) == 0 {
+		return client.ServiceInfo{}, false
+	}
+	return services[ui.cursor(services)], true
+}
+
+// cursor returns the index of the selected service, the first one if it is
+// no longer listed.
+func (ui *topUI) cursor(services []client.ServiceInfo) int {
+	for i, s := range services {
+		if serviceKey(s) == ui.selected {
+			return i
+		}
+	}
+	return 0
+}
+
+func (ui *topUI) move(delta int) {
+	services := ui.visible()
+	if len(services) == 0 {
+		return
+	}
+	i := max(0, min(len(services)-1, ui.cursor(services)+delta))
+	ui.selected = serviceKey(services[i])
+}
+
+// handleKey acts on a key and reports whether top should quit.
+func (ui *topUI) handleKey(k string) bool {
+	switch ui.prompt {
+	case promptFilter:
+		switch k {
+		case keyEnter:
+			ui.prompt = promptNone
+		case keyEsc:
+			ui.filter, ui.prompt = "", promptNone
+		case keyBackspace:
+			if _, size := utf8.DecodeLastRuneInString(ui.filter); size > 0 {
+				ui.filter = ui.filter[:len(ui.filter)-size]
+			}
+		default:
+			if r, _ := utf8.DecodeRuneInString(k); utf8.RuneCountInString(k) == 1 && unicode.IsPrint(r) {
+				ui.filter += k
+			}
+		}
+		return false
+	case promptDelete:
+		ui.prompt = promptNone
+		if k == "y" || k == "Y" {
+			ui.act("delete")
+		} else {
+			ui.message = ""
+		}
+		return false
+	}
+
+	ui.message = ""
+	switch k {
+	case "q":
+		if ui.detail == "" {
+			return true
+		}
+		ui.detail, ui.info = "", nil
+	case keyEsc:
+		if ui.detail != "" {
+			ui.detail, ui.info = "", nil
+		} else {
+			ui.filter = ""
+		}
+	case keyUp, "k":
+		ui.move(-1)
+	case keyDown, "j":
+		ui.move(1)
+	case keyPageUp:
+		ui.move(-ui.listHeight())
+	case keyPageDown:
+		ui.move(ui.listHeight())
+	case "<", ">":
+		i := slices.Index(topSortKeys, ui.sortKey)
+		if k == "<" {
+			i += len(topSortKeys) - 1
+		} else {
+			i++
+		}
+		ui.sortKey = topSortKeys[i%len(topSortKeys)]
+	case "o":
+		ui.reverse = !ui.reverse
+	case "/":
+		ui.prompt = promptFilter
+	case "s":
+		ui.act("start")
+	case "x":
+		ui.act("stop")
+	case "r":
+		ui.act("restart")
+	case "d":
+		if _, ok := ui.current(); ok {
+			ui.prompt = promptDelete
+		}
+	case "l":
+		ui.showLogs = !ui.showLogs
+	case keyEnter, "i":
+		if s, ok := ui.current(); ok {
+			ui.detail, ui.info = serviceKey(s), nil
+			ui.refresh()
+		}
+	}
+	return false
+}
+
+// topActions are what the keys do to the current service.
+var topActions = map[string]struct {
+	do   func(*client.Client, context.Context, string) error
+	done string
+}{
+	"start":   {(*client.Client).StartService, "Service '%s' started successfully"},
+	"stop":    {(*client.Client).StopService, "Service '%s' stopped successfully"},
+	"restart": {(*client.Client).RestartService, "Service '%s' restarted successfully"},
+	"delete":  {(*client.Client).DeleteService, "Service '%s' deleted successfully"},
+}
+
+// act runs an action on the current service in the background; its result
+// is shown on the status line.
+func (ui *topUI) act(action string) {
+	s, ok := ui.current()
+	if !ok {
+		return
+	}
+	c := ui.clientFor(s)
+	if c == nil {
+		return
+	}
+	if action == "delete" && ui.detail != "" {
+		ui.detail, ui.info = "", nil
+	}
+	a := topActions[action]
+	ui.message = fmt.Sprintf("Running %s on %s...", action, s.Name)
+	go func() {
+		msg := fmt.Sprintf(a.done, s.Name)
+		if err := a.do(c, ui.ctx, s.Name); err != nil {
+			msg = fmt.Sprintf("Error: failed to %s service: %v", action, err)
+		}
+		send(ui.ctx, ui.results, msg)
+	}()
+}
+
+// followSelected keeps the log pane on the current service.
+func (ui *topUI) followSelected() {
+	s, ok := ui.current()
+	if !ui.showLogs || !ok {
+		ui.stopLogs()
+		return
+	}
+	key := serviceKey(s)
+	if key == ui.logKey {
+		return
+	}
+	ui.stopLogs()
+	c := ui.clientFor(s)
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ui.ctx)
+	ui.logKey, ui.logLines, ui.stopFollow = key, nil, cancel
+	go func() {
+		if err := c.FollowLogs(ctx, s.Name, logWriter{ctx: ctx, key: key, logs: ui.logs}); err != nil {
+			send(ctx, ui.logs, logChunk{key: key, err: err})
+		}
+	}()
+}
+
+func (ui *topUI) stopLogs() {
+	if ui.stopFollow != nil {
+		ui.stopFollow()
+	}
+	ui.logKey, ui.logLines, ui.stopFollow = "", nil, nil
+}
+
+func (ui *topUI) appendLog(chunk logChunk) {
+	text := chunk.text
+	if chunk.err != nil {
+		text = fmt.Sprintf("\n[failed to follow logs: %v]\n", chunk.err)
+	}
+	lines := strings.Split(text, "\n")
+	if n := len(ui.logLines); n > 0 {
+		ui.logLines[n-1] += lines[0]
+		lines = lines[1:]
+	}
+	ui.logLines = append(ui.logLines, lines...)
+	if n := len(ui.logLines); n > topLogLines {
+		ui.logLines = slices.Clone(ui.logLines[n-topLogLines:])
+	}
+}
+
+// Lines of the screen around the list or the details: the title and status
+// line above, the key line below
+const topChrome = 3
+
+func (ui *topUI) logHeight() int {
+	if !ui.showLogs {
+		return 0
+	}
+	return max(3, (ui.height-topChrome)/2)
+}
+
+// listHeight is the number of services that fit on the screen.
+func (ui *topUI) listHeight() int {
+	return max(1, ui.height-topChrome-ui.logHeight()-1)
+}
+
+func (ui *topUI) draw() {
+	var lines []string
+	title := fmt.Sprintf("Controlman Top - %s", ui.updated.Format("15:04:05"))
+	if ui.filter != "" || ui.prompt == promptFilter {
+		title += fmt.Sprintf("   filter: %s", ui.filter)
+	}
+	lines = append(lines, title)
+
+	status := ui.message
+	if ui.listErr != nil {
+		status = fmt.Sprintf("Error: failed to list services: %v", ui.listErr)
+	}
+	lines = append(lines, status)
+
+	body := ui.height - topChrome - ui.logHeight()
+	if ui.detail != "" {
+		lines = append(lines, ui.detailLines(body)...)
+	} else {
+		lines = append(lines, ui.listLines(body)...)
+	}
+	if ui.showLogs {
+		lines = append(lines, ui.logPaneLines()...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\033[H")
+	for i, line := range lines {
+		if i >= ui.height-1 {
+			break
+		}
+		buf.WriteString(line)
+		buf.WriteString("\033[0m\033[K\n")
+	}
+	buf.WriteString("\033[J")
+	fmt.Fprintf(&buf, "\033[%d;1H\033[7m%s\033[0m", ui.height, fit(ui.keyLine(), ui.width))
+	os.Stdout.Write(buf.Bytes())
+}
+
+// listLines draws the table of services in height lines.
+func (ui *topUI) listLines(height int) []string {
+	services := ui.visible()
+	withHost := hasHosts(services)
+
+	var lines []string
+	header := ""
+	if withHost {
+		header += cell("HOST", 16)
+	}
+	columns := []struct {
+		title, key string
+		width      int
+	}{
+		{"NAME", "name", 20}, {"STATUS", "", 10}, {"READY", "", 6}, {"PID", "", 8},
+		{"CPU", "cpu", 8}, {"MEMORY", "memory", 10}, {"RESTARTS", "restarts", 9}, {"UPTIME", "uptime", 0},
+	}
+	for _, col := range columns {
+		title := col.title
+		if col.key == ui.sortKey {
+			if ui.reverse {
+				title += "▲"
+			} else {
+				title += "▼"
+			}
+		}
+		header += cell(title, col.width)
+	}
+	lines = append(lines, "\033[1m"+fit(header, ui.width))
+
+	if len(services) == 0 {
+		if ui.filter != "" {
+			return append(lines, "No services match the filter")
+		}
+		return append(lines, "No services found")
+	}
+	rows := max(1, height-1)
+	selected := ui.cursor(services)
+	start := max(0, selected-rows+1)
+	now := time.Now()
+	for i := start; i < len(services) && i < start+rows; i++ {
+		s := services[i]
+		row := ""
+		if withHost {
+			row += cell(s.Host, 16)
+		}
+		row += cell(s.Name, 20) + cell(s.Status, 10) + cell(fmt.Sprintf("%d/%d", s.Ready, s.Replicas), 6) +
+			cell(fmt.Sprint(s.PID), 8) + cell(fmt.Sprintf("%.1f%%", s.CPU), 8) + cell(formatMemory(s.Memory), 10) +
+			cell(fmt.Sprint(s.Restarts), 9) + formatUptime(uptime(s, now))
+		if i == selected {
+			row = "\033[7m" + pad(fit(row, ui.width), ui.width)
+		} else {
+			row = fit(row, ui.width)
+		}
+		lines = append(lines, row)
+	}
+	return lines
+}
+
+// detailLines draws the details of the shown service in height lines.
+func (ui *topUI) detailLines(height int) []string {
+	if ui.info == nil {
+		if _, ok := ui.find(ui.detail); !ok && !ui.fetching {
+			return []string{fmt.Sprintf("Service %s not found", ui.detail)}
+		}
+		return []string{"Loading..."}
+	}
+	var buf bytes.Buffer
+	printInfo(&buf, *ui.info)
+	text := strings.TrimRight(buf.String(), "\n")
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if len(lines) == height {
+			break
+		}
+		lines = append(lines, fit(line, ui.width))
+	}
+	for len(lines) < height {
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+func (ui *topUI) logPaneLines() []string {
+	height := ui.logHeight()
+	title := "── logs "
+	if s, ok := ui.current(); ok {
+		title += "of " + s.Name + " "
+	}
+	lines := []string{"\033[1m" + fit(title+strings.Repeat("─", max(0, ui.width-utf8.RuneCountInString(title))), ui.width)}
+
+	logs := ui.logLines
+	if n := len(logs); n > 0 && logs[n-1] == "" {
+		logs = logs[:n-1]
+	}
+	if len(logs) > height-1 {
+		logs = logs[len(logs)-(height-1):]
+	}
+	for _, line := range logs {
+		lines = append(lines, fit(printable(line), ui.width))
+	}
+	return lines
+}
+
+func (ui *topUI) keyLine() string {
+	switch ui.prompt {
+	case promptFilter:
+		return "Filter by name or status: " + ui.filter + "_   (Enter apply, Esc clear)"
+	case promptDelete:
+		s, _ := ui.current()
+		return fmt.Sprintf("Delete service %s and its logs? (y/N)", s.Name)
+	}
+	if ui.detail != "" {
+		return "s start  x stop  r restart  d delete  l logs  q/Esc back"
+	}
+	return "↑↓ select  < > sort  o order  / filter  s start  x stop  r restart  d delete  l logs  Enter info  q quit"
+}
+
+// cell pads s to width characters, leaving at least one space after it.
+// Width 0 is the last column, which is not padded.
+func cell(s string, width int) string {
+	if width == 0 {
+		return s
+	}
+	if utf8.RuneCountInString(s) >= width {
+		s = string([]rune(s)[:width-1])
+	}
+	return pad(s, width)
+}
+
+func pad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// fit cuts s to width characters. Escape sequences at its start do not
+// count.
+func fit(s string, width int) string {
+	prefix := ""
+	for strings.HasPrefix(s, "\033[") {
+		end := strings.IndexByte(s, 'm')
+		if end < 0 {
+			break
+		}
+		prefix, s = prefix+s[:end+1], s[end+1:]
+	}
+	if utf8.RuneCountInString(s) > width {
+		s = string([]rune(s)[:width])
+	}
+	return prefix + s
+}
+
+// printable expands tabs and drops the control characters of a log line,
+// which would move the cursor.
+func printable(line string) string {
+	line = strings.ReplaceAll(line, "\t", "    ")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, line)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/tangthinker/controlman/pkg/client"
+)
+
+const userHelp = `-services limits a viewer or operator to a comma separated list of service
+name patterns, e.g. "web-*,api". Without -password the password is prompted for.`
+
+var roles = fixedValues("viewer", "operator", "admin")
+
+// userCommand is "controlman user ...".
+func userCommand() *command {
+	return &command{
+		name:    "user",
+		summary: "Manage web console and API users (add, list, remove, passwd)",
+		help:    userHelp,
+		commands: []*command{
+			{
+				name:      "add",
+				args:      "<name>",
+				summary:   "Add a user",
+				minArgs:   1,
+				maxArgs:   1,
+				flagTypes: map[string]completer{"role": roles},
+				setup: func(fs *flag.FlagSet) runFunc {
+					role := fs.String("role", "viewer", "Role of the user: viewer, operator or admin")
+					services := fs.String("services", "", "Comma separated service name patterns the user is limited to")
+					password := fs.String("password", "", "Password of the user (prompted for if omitted)")
+					return func(e *env, args []string) error {
+						c, err := e.client()
+						if err != nil {
+							return err
+						}
+						pw, err := passwordOrPrompt(*password)
+						if err != nil {
+							return err
+						}
+						opts := &client.UserOptions{
+							Password: pw,
+							Role:     *role,
+							Services: splitList(*services),
+						}
+						if err := c.AddUser(e.ctx, args[0], opts); err != nil {
+							return fmt.Errorf("failed to add user: %w", err)
+						}
+						fmt.Printf("User '%s' added with role %s\n", args[0], *role)
+						return nil
+					}
+				},
+			},
+			{
+				name:    "list",
+				summary: "List the users",
+				setup: func(fs *flag.FlagSet) runFunc {
+					return func(e *env, args []string) error {
+						c, err := e.client()
+						if err != nil {
+							return err
+						}
+						users, err := c.ListUsers(e.ctx)
+						if err != nil {
+							return fmt.Errorf("failed to list users: %w", err)
+						}
+						return e.out.print(users, func(bool) {
+							fmt.Printf("%-20s %-10s %-19s %s\n", "NAME", "ROLE", "CREATED", "SERVICES")
+							for _, u := range users {
+								fmt.Printf("%-20s %-10s %-19s %s\n", u.Name, u.Role, formatTime(u.CreatedAt), joinList(u.Services, "*"))
+							}
+						}, func() []string {
+							names := make([]string, len(users))
+							for i, u := range users {
+								names[i] = u.Name
+							}
+							return names
+						})
+					}
+				},
+			},
+			{
+				name:     "remove",
+				args:     "<name>",
+				summary:  "Remove a user",
+				minArgs:  1,
+				maxArgs:  1,
+				argTypes: []completer{completeUsers},
+				setup: func(fs *flag.FlagSet) runFunc {
+					return func(e *env, args []string) error {
+						c, err := e.client()
+						if err != nil {
+							return err
+						}
+						if err := c.RemoveUser(e.ctx, args[0]); err != nil {
+							return fmt.Errorf("failed to remove user: %w", err)
+						}
+						fmt.Printf("User '%s' removed successfully\n", args[0])
+						return nil
+					}
+				},
+			},
+			{
+				name:     "passwd",
+				args:     "<name>",
+				summary:  "Change the password of a user",
+				minArgs:  1,
+				maxArgs:  1,
+				argTypes: []completer{completeUsers},
+				setup: func(fs *flag.FlagSet) runFunc {
+					password := fs.String("password", "", "New password (prompted for if omitted)")
+					return func(e *env, args []string) error {
+						c, err := e.client()
+						if err != nil {
+							return err
+						}
+						pw, err := passwordOrPrompt(*password)
+						if err != nil {
+							return err
+						}
+						if err := c.SetUserPassword(e.ctx, args[0], pw); err != nil {
+							return fmt.Errorf("failed to change password: %w", err)
+						}
+						fmt.Printf("Password of user '%s' changed successfully\n", args[0])
+						return nil
+					}
+				},
+			},
+		},
+	}
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func passwordOrPrompt(password string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	first, err := readPassword("Password: ")
+	if err != nil {
+		return "", err
+	}
+	second, err := readPassword("Confirm password: ")
+	if err != nil {
+		return "", err
+	}
+	if first != second {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	if first == "" {
+		return "", fmt.Errorf("password must not be empty")
+	}
+	return first, nil
+}
+
+// Shared so that input buffered by one prompt is seen by the next
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassword reads a line from the terminal with echo turned off.
+func readPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}
+	stty("-echo")
+	defer func() {
+		stty("echo")
+		fmt.Println()
+	}()
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,239 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+const (
+	prefixAPIKey = "apikeys:"
+	apiKeyPrefix = "cm_"
+
+	// How often the last-used time of a key is written back
+	apiKeyTouchInterval = time.Minute
+)
+
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// scopableActions are the actions an API key may be granted. Keys cannot
+// manage users or other keys.
+var scopableActions = map[string]bool{
+	"list": true, "info": true, "logs": true, "runs": true,
+	"start": true, "stop": true, "restart": true, "reload": true,
+	"run": true, "scale": true,
+	"add": true, "edit": true, "delete": true, "notify-test": true,
+}
+
+// Actions granted to a key created without -actions
+var defaultKeyActions = []string{"list", "info", "logs", "runs"}
+
+// APIKey is a long-lived credential for automation. The secret part of the
+// token is only shown when the key is created; the store keeps its SHA-256.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Actions   []string  `json:"actions"`
+	Services  []string  `json:"services,omitempty"` // service name patterns; empty means all
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+type (
+	APIKeyRequest = protocol.APIKeyRequest
+	APIKeyInfo    = protocol.APIKeyInfo
+)
+
+func (k *APIKey) info() APIKeyInfo {
+	info := APIKeyInfo{
+		ID:        k.ID,
+		Name:      k.Name,
+		Actions:   k.Actions,
+		Services:  k.Services,
+		CreatedBy: k.CreatedBy,
+		CreatedAt: k.CreatedAt.Format(time.RFC3339),
+	}
+	if !k.LastUsed.IsZero() {
+		info.LastUsed = k.LastUsed.Format(time.RFC3339)
+	}
+	return info
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (d *Daemon) loadAPIKey(id string) (*APIKey, error) {
+	val, closer, err := d.serviceManager.DB().Get([]byte(prefixAPIKey + id))
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var k APIKey
+	if err := json.Unmarshal(val, &k); err != nil {
+		return nil, fmt.Errorf("corrupt API key record %s: %v", id, err)
+	}
+	return &k, nil
+}
+
+func (d *Daemon) saveAPIKey(k *APIKey) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	return d.serviceManager.DB().Set([]byte(prefixAPIKey+k.ID), data, pebble.Sync)
+}
+
+// IsAPIKey reports whether a bearer token looks like an API key rather
+// than a session token.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// AuthenticateAPIKey checks a token of the form cm_<id>_<secret> and returns
+// the caller it acts as.
+func (d *Daemon) AuthenticateAPIKey(token, source string) (*Caller, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	if !ok || !IsAPIKey(token) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	k, err := d.loadAPIKey(id)
+	if err == pebble.ErrNotFound {
+		return nil, ErrInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.Hash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if time.Since(k.LastUsed) > apiKeyTouchInterval {
+		k.LastUsed = time.Now()
+		if err := d.saveAPIKey(k); err != nil {
+			log.Printf("Failed to update last use of API key %s: %v", k.ID, err)
+		}
+	}
+
+	// The key's actions are the real limit; the role only has to be high
+	// enough for all of them.
+	return &Caller{
+		Name:     "apikey:" + k.Name,
+		Role:     RoleAdmin,
+		Services: k.Services,
+		Actions:  k.Actions,
+		Source:   source + " key " + k.ID,
+	}, nil
+}
+
+func (d *Daemon) handleAPIKeyCreate(caller *Caller, cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "key name is required"}
+	}
+
+	req := &APIKeyRequest{}
+	if len(cmd.Data) > 0 {
+		if err := json.Unmarshal(cmd.Data, req); err != nil {
+			return Response{Success: false, Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid API key request: %v", err)}
+		}
+	}
+	if len(req.Actions) == 0 {
+		req.Actions = defaultKeyActions
+	}
+	for _, action := range req.Actions {
+		if !scopableActions[action] {
+			return Response{Success: false, Code: CodeInvalidArgument, Message: fmt.Sprintf("action %q cannot be granted to an API key", action)}
+		}
+	}
+	if err := validateGrants(RoleOperator, req.Services); err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+
+	id, err := randomHex(4)
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to generate key: %v", err)}
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to generate key: %v", err)}
+	}
+
+	k := &APIKey{
+		ID:        id,
+		Name:      cmd.Name,
+		Hash:      hashSecret(secret),
+		Actions:   req.Actions,
+		Services:  req.Services,
+		CreatedBy: caller.Name,
+		CreatedAt: time.Now(),
+	}
+	if err := d.saveAPIKey(k); err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to save key: %v", err)}
+	}
+
+	log.Printf("API key %s (%s) created by %s", k.ID, k.Name, caller.Name)
+	info := k.info()
+	info.Token = apiKeyPrefix + k.ID + "_" + secret
+	return Response{Success: true, Message: "API key created; the token is only shown once", Data: info}
+}
+
+func (d *Daemon) handleAPIKeyList() Response {
+	iter, err := d.serviceManager.DB().NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefixAPIKey),
+		UpperBound: []byte("apikeys;"),
+	})
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to list API keys: %v", err)}
+	}
+	defer iter.Close()
+
+	keys := make([]APIKeyInfo, 0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		var k APIKey
+		if err := json.Unmarshal(iter.Value(), &k); err != nil {
+			continue
+		}
+		keys = append(keys, k.info())
+	}
+	if err := iter.Error(); err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to list API keys: %v", err)}
+	}
+	return Response{Success: true, Data: keys}
+}
+
+func (d *Daemon) handleAPIKeyRevoke(cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "key id is required"}
+	}
+	if _, err := d.loadAPIKey(cmd.Name); err != nil {
+		return Response{Success: false, Code: CodeNotFound, Message: "API key not found"}
+	}
+	if err := d.serviceManager.DB().Delete([]byte(prefixAPIKey+cmd.Name), pebble.Sync); err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to revoke key: %v", err)}
+	}
+
+	log.Printf("API key %s revoked", cmd.Name)
+	return Response{Success: true, Message: "API key revoked"}
+}
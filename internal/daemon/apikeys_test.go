@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// createTestKey creates an API key and returns its token.
+func createTestKey(t *testing.T, d *Daemon, name string, req APIKeyRequest) string {
+	t.Helper()
+	resp := d.HandleCommand(testAdmin, testCommand(t, "apikey-create", name, "", req))
+	if !resp.Success {
+		t.Fatalf("apikey-create: %s", resp.Message)
+	}
+	return resp.Data.(APIKeyInfo).Token
+}
+
+func TestAPIKeyToken(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	token := createTestKey(t, d, "deploy", APIKeyRequest{})
+
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, "cm_"), "_")
+	if !IsAPIKey(token) || !ok || len(id) != 8 || len(secret) != 48 {
+		t.Fatalf("token %q is not cm_<id>_<secret>", token)
+	}
+	k, err := d.loadAPIKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Hash != hashSecret(secret) || strings.Contains(k.Hash, secret) {
+		t.Errorf("stored hash %q does not hash the secret", k.Hash)
+	}
+	if strings.Join(k.Actions, ",") != "list,info,logs,runs" {
+		t.Errorf("a key created without actions got %v", k.Actions)
+	}
+
+	resp := d.HandleCommand(testAdmin, Command{Action: "apikey-list"})
+	data, _ := json.Marshal(resp.Data)
+	if !resp.Success || strings.Contains(string(data), secret) || strings.Contains(string(data), k.Hash) {
+		t.Errorf("apikey-list shows the secret or its hash: %s", data)
+	}
+
+	caller, err := d.AuthenticateAPIKey(token, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.Name != "apikey:deploy" || caller.Source != "test key "+id {
+		t.Errorf("key acts as %s from %s", caller.Name, caller.Source)
+	}
+
+	other := createTestKey(t, d, "other", APIKeyRequest{})
+	otherID, _, _ := strings.Cut(strings.TrimPrefix(other, "cm_"), "_")
+	for _, bad := range []string{
+		"",
+		"cm_",
+		"cm_" + id,
+		"cm_" + id + "_",
+		"cm_" + id + "_wrong",
+		"cm_" + id + "_" + secret + "0",
+		"cm_" + otherID + "_" + secret,
+		"cm__" + secret,
+		"xx_" + id + "_" + secret,
+		"cm_" + id + "x_" + secret,
+	} {
+		if _, err := d.AuthenticateAPIKey(bad, "test"); err != ErrInvalidAPIKey {
+			t.Errorf("token %q: %v, want %v", bad, err, ErrInvalidAPIKey)
+		}
+	}
+
+	if resp := d.HandleCommand(testAdmin, Command{Action: "apikey-revoke", Name: id}); !resp.Success {
+		t.Fatalf("apikey-revoke: %s", resp.Message)
+	}
+	if _, err := d.AuthenticateAPIKey(token, "test"); err != ErrInvalidAPIKey {
+		t.Errorf("revoked key: %v, want %v", err, ErrInvalidAPIKey)
+	}
+	if _, err := d.AuthenticateAPIKey(other, "test"); err != nil {
+		t.Errorf("revoking a key revoked another: %v", err)
+	}
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	addTestService(t, d, "web-1")
+	token := createTestKey(t, d, "deploy", APIKeyRequest{Actions: []string{"start", "stop"}, Services: []string{"web-*"}})
+	caller, err := d.AuthenticateAPIKey(token, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := d.HandleCommand(caller, testCommand(t, "stop", "web-1", "", nil)); !resp.Success {
+		t.Errorf("stop: %s", resp.Message)
+	}
+	if err := caller.Authorize(Command{Action: "start", Name: "web-1"}); err != nil {
+		t.Errorf("start: %v", err)
+	}
+	if err := caller.Authorize(Command{Action: "start", Name: "api"}); err == nil {
+		t.Error("the key started a service outside its services")
+	}
+
+	denied := []Command{
+		{Action: "list"},
+		{Action: "restart", Name: "web-1"},
+		{Action: "add", Name: "web-2", Command: "sleep 300"},
+		{Action: "edit", Name: "web-1", Command: "sleep 300"},
+		{Action: "delete", Name: "web-1"},
+		{Action: "apikey-create", Name: "escalate"},
+		{Action: "apikey-list"},
+		{Action: "apikey-revoke", Name: "deploy"},
+		{Action: "user-add", Name: "mallory"},
+		{Action: "user-passwd", Name: "apikey:deploy"},
+		{Action: "audit"},
+	}
+	for _, cmd := range denied {
+		if resp := d.HandleCommand(caller, cmd); resp.Success || resp.Code != CodeForbidden {
+			t.Errorf("%s %s with a key scoped to start and stop: %v %s %s", cmd.Action, cmd.Name, resp.Success, resp.Code, resp.Message)
+		}
+	}
+
+	// Keys cannot be given the actions that manage users and keys
+	for _, action := range []string{"apikey-create", "apikey-revoke", "user-add", "user-passwd", "audit"} {
+		resp := d.HandleCommand(testAdmin, testCommand(t, "apikey-create", "escalate", "", APIKeyRequest{Actions: []string{action}}))
+		if resp.Success || resp.Code != CodeInvalidArgument {
+			t.Errorf("creating a key with %s: %v %s", action, resp.Success, resp.Message)
+		}
+	}
+}
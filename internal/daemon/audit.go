@@ -0,0 +1,288 @@
+package daemon
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+const prefixAudit = "audit:"
+
+// readOnlyActions are not recorded in the audit log unless they are denied;
+// the web console polls them every second.
+var readOnlyActions = map[string]bool{
+	"list": true, "info": true, "logs": true, "runs": true,
+	"user-list": true, "apikey-list": true, "audit": true, "audit-verify": true,
+	"watch": true, "hosts": true,
+}
+
+type (
+	AuditEntry = protocol.AuditEntry
+	AuditQuery = protocol.AuditQuery
+)
+
+// auditLog appends entries to the store and remembers the head of the chain.
+// The entries are signed with a key kept in a file outside the store, so
+// that rewriting the store alone cannot produce a chain that verifies.
+type auditLog struct {
+	mu       sync.Mutex
+	db       *pebble.DB
+	key      auditKeyFile
+	lastSeq  uint64
+	lastHash string
+}
+
+// auditKeyFile is the content of the audit key file. Entries written before
+// the key existed, by earlier versions, carry plain SHA-256 hashes; they
+// are covered by the signature of the first signed entry, which links to
+// the last of them.
+type auditKeyFile struct {
+	Key   []byte `json:"key"`
+	Since uint64 `json:"since"` // first signed entry
+}
+
+func auditKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", prefixAudit, seq))
+}
+
+// openAuditLog opens the audit log in db, signed with the key in keyPath.
+// The key is generated when the file does not exist.
+func openAuditLog(db *pebble.DB, keyPath string) (*auditLog, error) {
+	a := &auditLog{db: db}
+
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefixAudit),
+		UpperBound: []byte("audit;"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	if iter.Last() {
+		var last AuditEntry
+		if err := json.Unmarshal(iter.Value(), &last); err != nil {
+			return nil, fmt.Errorf("corrupt audit entry %s: %v", iter.Key(), err)
+		}
+		a.lastSeq = last.Seq
+		a.lastHash = last.Hash
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if err := a.loadKey(keyPath); err != nil {
+		return nil, fmt.Errorf("audit key %s: %v", keyPath, err)
+	}
+	return a, nil
+}
+
+func (a *auditLog) loadKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &a.key); err != nil || len(a.key.Key) == 0 {
+			return fmt.Errorf("corrupt key file")
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	a.key = auditKeyFile{Key: make([]byte, 32), Since: a.lastSeq + 1}
+	if _, err := rand.Read(a.key.Key); err != nil {
+		return err
+	}
+	if a.lastSeq > 0 {
+		log.Printf("Created audit key %s; signing audit entries from %d on", path, a.key.Since)
+	}
+	data, _ = json.Marshal(a.key)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hash returns the hash of the entry with its Hash field cleared: an
+// HMAC-SHA256 with the audit key, or a plain SHA-256 for entries written
+// before the key existed.
+func (a *auditLog) hash(e AuditEntry) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	if e.Seq < a.key.Since {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, a.key.Key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *auditLog) append(e *AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e.Seq = a.lastSeq + 1
+	e.Prev = a.lastHash
+	e.Hash = a.hash(*e)
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := a.db.Set(auditKey(e.Seq), data, pebble.Sync); err != nil {
+		return err
+	}
+	a.lastSeq = e.Seq
+	a.lastHash = e.Hash
+	return nil
+}
+
+// redact replaces the values of secret fields such as passwords.
+func redact(data json.RawMessage) json.RawMessage {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	for key := range fields {
+		lower := strings.ToLower(key)
+		if strings.Contains(lower, "password") || strings.Contains(lower, "secret") || strings.Contains(lower, "token") {
+			fields[key] = "[redacted]"
+		}
+	}
+	out, _ := json.Marshal(fields)
+	return out
+}
+
+// audit records a command and its result.
+func (d *Daemon) audit(caller *Caller, cmd Command, resp Response) {
+	if readOnlyActions[cmd.Action] && resp.Code != CodeForbidden {
+		return
+	}
+	e := &AuditEntry{
+		Time:    time.Now(),
+		Actor:   caller.Name,
+		Role:    caller.Role,
+		Source:  caller.Source,
+		Action:  cmd.Action,
+		Target:  cmd.Name,
+		Host:    cmd.Host,
+		Command: cmd.Command,
+		Params:  redact(cmd.Data),
+		Success: resp.Success,
+		Code:    resp.Code,
+		Message: resp.Message,
+	}
+	if err := d.auditLog.append(e); err != nil {
+		log.Printf("Failed to write audit entry for %s %s: %v", cmd.Action, cmd.Name, err)
+	}
+}
+
+func (d *Daemon) handleAudit(cmd Command) Response {
+	q := AuditQuery{}
+	if len(cmd.Data) > 0 {
+		if err := json.Unmarshal(cmd.Data, &q); err != nil {
+			return Response{Success: false, Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid audit query: %v", err)}
+		}
+	}
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+
+	iter, err := d.serviceManager.DB().NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefixAudit),
+		UpperBound: []byte("audit;"),
+	})
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to read audit log: %v", err)}
+	}
+	defer iter.Close()
+
+	// Walk backwards so that the limit keeps the newest entries
+	var entries []AuditEntry
+	for iter.Last(); iter.Valid() && len(entries) < q.Limit; iter.Prev() {
+		var e AuditEntry
+		if err := json.Unmarshal(iter.Value(), &e); err != nil {
+			continue
+		}
+		if q.Since != nil && e.Time.Before(*q.Since) {
+			break
+		}
+		if q.Service != "" && e.Target != q.Service {
+			continue
+		}
+		if q.Actor != "" && e.Actor != q.Actor {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	// Oldest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	return Response{Success: true, Data: entries}
+}
+
+// handleAuditVerify recomputes the hash chain and reports the first entry
+// that does not match. Verifying needs the audit key, so only a log
+// rewritten without it is caught.
+func (d *Daemon) handleAuditVerify() Response {
+	iter, err := d.serviceManager.DB().NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefixAudit),
+		UpperBound: []byte("audit;"),
+	})
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to read audit log: %v", err)}
+	}
+	defer iter.Close()
+
+	var count, expectSeq uint64 = 0, 1
+	prev := ""
+	for iter.First(); iter.Valid(); iter.Next() {
+		var e AuditEntry
+		if err := json.Unmarshal(iter.Value(), &e); err != nil {
+			return Response{Success: false, Code: CodeConflict, Message: fmt.Sprintf("audit entry %s is corrupt", iter.Key())}
+		}
+		switch {
+		case e.Seq != expectSeq:
+			return Response{Success: false, Code: CodeConflict, Message: fmt.Sprintf("audit entry %d is missing", expectSeq)}
+		case e.Prev != prev:
+			return Response{Success: false, Code: CodeConflict, Message: fmt.Sprintf("audit entry %d does not follow entry %d", e.Seq, e.Seq-1)}
+		case e.Hash != d.auditLog.hash(e):
+			return Response{Success: false, Code: CodeConflict, Message: fmt.Sprintf("audit entry %d has been modified", e.Seq)}
+		}
+		prev = e.Hash
+		expectSeq++
+		count++
+	}
+	if err := iter.Error(); err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to read audit log: %v", err)}
+	}
+	if since := d.auditLog.key.Since; since > 1 {
+		return Response{Success: true, Message: fmt.Sprintf("audit log intact (%d entries, signed from entry %d on)", count, since)}
+	}
+	return Response{Success: true, Message: fmt.Sprintf("audit log intact (%d entries)", count)}
+}
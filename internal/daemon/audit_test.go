@@ -0,0 +1,141 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// newAuditedDaemon returns a daemon whose audit log holds n entries.
+func newAuditedDaemon(t *testing.T, n int) *Daemon {
+	t.Helper()
+	d := newTestDaemon(t, FleetConfig{})
+	for i := 0; i < n; i++ {
+		// Failed commands are recorded too
+		d.HandleCommand(testAdmin, testCommand(t, "stop", "missing", "", nil))
+	}
+	return d
+}
+
+func loadAuditEntry(t *testing.T, d *Daemon, seq uint64) AuditEntry {
+	t.Helper()
+	val, closer, err := d.serviceManager.DB().Get(auditKey(seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	var e AuditEntry
+	if err := json.Unmarshal(val, &e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func saveAuditEntry(t *testing.T, d *Daemon, e AuditEntry) {
+	t.Helper()
+	data, _ := json.Marshal(e)
+	if err := d.serviceManager.DB().Set(auditKey(e.Seq), data, pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rehash recomputes the chain from entry from to entry to with plain SHA-256, as
+// someone who can write the store but lacks the audit key would.
+func rehash(t *testing.T, d *Daemon, from, to uint64) {
+	t.Helper()
+	prev := ""
+	if from > 1 {
+		prev = loadAuditEntry(t, d, from-1).Hash
+	}
+	for seq := from; seq <= to; seq++ {
+		e := loadAuditEntry(t, d, seq)
+		e.Prev, e.Hash = prev, ""
+		data, _ := json.Marshal(e)
+		sum := sha256.Sum256(data)
+		e.Hash = hex.EncodeToString(sum[:])
+		saveAuditEntry(t, d, e)
+		prev = e.Hash
+	}
+}
+
+func TestAuditVerify(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		tamper func(t *testing.T, d *Daemon)
+		want   string
+	}{
+		{"intact", func(t *testing.T, d *Daemon) {}, "audit log intact (5 entries)"},
+		{"edited", func(t *testing.T, d *Daemon) {
+			e := loadAuditEntry(t, d, 3)
+			e.Actor = "someone-else"
+			saveAuditEntry(t, d, e)
+		}, "audit entry 3 has been modified"},
+		{"edited and rehashed", func(t *testing.T, d *Daemon) {
+			e := loadAuditEntry(t, d, 3)
+			e.Actor = "someone-else"
+			saveAuditEntry(t, d, e)
+			rehash(t, d, 3, 5)
+		}, "audit entry 3 has been modified"},
+		{"removed", func(t *testing.T, d *Daemon) {
+			if err := d.serviceManager.DB().Delete(auditKey(2), pebble.Sync); err != nil {
+				t.Fatal(err)
+			}
+		}, "audit entry 2 is missing"},
+		{"removed and renumbered", func(t *testing.T, d *Daemon) {
+			for seq := uint64(2); seq < 5; seq++ {
+				e := loadAuditEntry(t, d, seq+1)
+				e.Seq = seq
+				saveAuditEntry(t, d, e)
+			}
+			if err := d.serviceManager.DB().Delete(auditKey(5), pebble.Sync); err != nil {
+				t.Fatal(err)
+			}
+		}, "audit entry 2 does not follow entry 1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newAuditedDaemon(t, 5)
+			tt.tamper(t, d)
+			resp := d.HandleCommand(testAdmin, testCommand(t, "audit-verify", "", "", nil))
+			if resp.Message != tt.want || resp.Success != strings.HasPrefix(tt.want, "audit log intact") {
+				t.Errorf("verify: %v %q, want %q", resp.Success, resp.Message, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditKeyKeepsEarlierEntries(t *testing.T) {
+	// Entries written by earlier versions carry plain hashes
+	d := newAuditedDaemon(t, 3)
+	rehash(t, d, 1, 3)
+	keyPath := filepath.Join(t.TempDir(), "audit.key")
+	a, err := openAuditLog(d.serviceManager.DB(), keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.auditLog = a
+	if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("audit key: %v, %v; want mode 0600", info, err)
+	}
+	d.HandleCommand(testAdmin, testCommand(t, "stop", "missing", "", nil))
+
+	resp := d.HandleCommand(testAdmin, testCommand(t, "audit-verify", "", "", nil))
+	if want := "audit log intact (4 entries, signed from entry 4 on)"; !resp.Success || resp.Message != want {
+		t.Fatalf("verify: %v %q, want %q", resp.Success, resp.Message, want)
+	}
+
+	// The signed entry links to the last plain one
+	e := loadAuditEntry(t, d, 2)
+	e.Actor = "someone-else"
+	saveAuditEntry(t, d, e)
+	rehash(t, d, 2, 3)
+	resp = d.HandleCommand(testAdmin, testCommand(t, "audit-verify", "", "", nil))
+	if want := "audit entry 4 does not follow entry 3"; resp.Success || resp.Message != want {
+		t.Errorf("verify: %v %q, want %q", resp.Success, resp.Message, want)
+	}
+}
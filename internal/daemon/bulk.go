@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// bulkActions can be sent without a name to act on several services.
+var bulkActions = map[string]bool{
+	"start":   true,
+	"stop":    true,
+	"restart": true,
+	"delete":  true,
+}
+
+// isBulk reports whether cmd acts on the services chosen by its
+// BulkRequest rather than on the one it names.
+func isBulk(cmd Command) bool {
+	return bulkActions[cmd.Action] && cmd.Name == "" && len(cmd.Data) > 0
+}
+
+// limitBulk sends the service grants of caller with a bulk request for a
+// fleet agent, which only checks those of the hub.
+func limitBulk(caller *Caller, cmd Command) (Command, error) {
+	var req BulkRequest
+	if err := json.Unmarshal(cmd.Data, &req); err != nil {
+		return cmd, fmt.Errorf("invalid %s request: %v", cmd.Action, err)
+	}
+	req.Services = caller.Services
+	data, err := json.Marshal(req)
+	if err != nil {
+		return cmd, err
+	}
+	cmd.Data = data
+	return cmd, nil
+}
+
+// handleBulk runs an action on every service chosen by the pattern,
+// selector and services of the request that the caller has access to, up
+// to Parallel at a time. The response succeeds once services were chosen;
+// the result of each is in its data. Each service is recorded in the audit log as if
+// acted on alone. A dry run only reports the chosen services.
+func (d *Daemon) handleBulk(caller *Caller, cmd Command) Response {
+	var req BulkRequest
+	if err := json.Unmarshal(cmd.Data, &req); err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid %s request: %v", cmd.Action, err)}
+	}
+	selector, err := service.ParseSelector(req.Selector)
+	if err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	if req.Pattern == "" && selector.Empty() {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name, pattern or label selector is required"}
+	}
+	if req.Parallel < 0 {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "parallel must not be negative"}
+	}
+
+	services, err := d.serviceManager.ListServices()
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to list services: %v", err)}
+	}
+	// Services stored before names were checked may be named like a
+	// pattern; they are chosen by their exact name first
+	exact := slices.ContainsFunc(services, func(s *service.Service) bool { return s.Name == req.Pattern })
+	var chosen []*service.Service
+	for _, s := range services {
+		switch {
+		case exact:
+			if s.Name != req.Pattern {
+				continue
+			}
+		case req.Pattern != "":
+			ok, err := service.MatchName(req.Pattern, s.Name)
+			if err != nil {
+				return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+			}
+			if !ok {
+				continue
+			}
+		}
+		if len(req.Services) > 0 && !matchAny(req.Services, s.Name) {
+			continue
+		}
+		if selector.Matches(s.Labels) && caller.CanAccess(s.Name) {
+			chosen = append(chosen, s)
+		}
+	}
+	slices.SortFunc(chosen, func(a, b *service.Service) int { return strings.Compare(a.Name, b.Name) })
+	target := bulkTarget(req.Pattern, selector)
+	if len(chosen) == 0 {
+		return Response{Success: false, Code: CodeNotFound, Message: fmt.Sprintf("no services match %s", target)}
+	}
+
+	results := make([]BulkResult, len(chosen))
+	if req.DryRun {
+		for i, s := range chosen {
+			results[i] = BulkResult{Name: s.Name, Success: true, Message: fmt.Sprintf("would %s (%s)", cmd.Action, s.Status)}
+		}
+		return Response{Success: true, Message: fmt.Sprintf("%s: %d services would be affected (dry run)", cmd.Action, len(chosen)), Data: results}
+	}
+
+	parallel := max(req.Parallel, 1)
+	log.Printf("Running %s on %d services matching %s, %d at a time", cmd.Action, len(chosen), target, parallel)
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallel)
+	for i, s := range chosen {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			one := Command{Action: cmd.Action, Name: s.Name, Host: cmd.Host}
+			resp := d.dispatch(caller, one)
+			d.audit(caller, one, resp)
+			results[i] = BulkResult{Name: s.Name, Success: resp.Success, Code: resp.Code, Message: resp.Message}
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if !r.Success {
+			failed++
+		}
+	}
+	message := fmt.Sprintf("%s: %d services succeeded", cmd.Action, len(chosen))
+	if failed > 0 {
+		message = fmt.Sprintf("%s: %d of %d services failed", cmd.Action, failed, len(chosen))
+	}
+	return Response{Success: true, Message: message, Data: results}
+}
+
+// bulkTarget describes the services chosen by a bulk request in messages.
+func bulkTarget(pattern string, selector service.Selector) string {
+	switch {
+	case selector.Empty():
+		return pattern
+	case pattern == "":
+		return selector.String()
+	default:
+		return pattern + " with " + selector.String()
+	}
+}
@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+func TestBulkPrefersExactNames(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	// Names that add rejects now, as stored by earlier versions
+	for _, name := range []string{"all", "web[1]", "web1", "web2"} {
+		s := &service.Service{Name: name, Command: "sleep 300", Status: service.StatusStopped, Type: service.TypeService, CreatedAt: time.Now()}
+		if err := d.serviceManager.SaveService(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		pattern string
+		want    string
+	}{
+		{"all", "all"},
+		{"web[1]", "web[1]"},
+		{"web[12]", "web1,web2"},
+		{"*", "all,web1,web2,web[1]"},
+	} {
+		resp := d.HandleCommand(testAdmin, testCommand(t, "stop", "", "", BulkRequest{Pattern: tt.pattern, DryRun: true}))
+		if !resp.Success {
+			t.Errorf("stop %s: %s", tt.pattern, resp.Message)
+			continue
+		}
+		var chosen []string
+		for _, r := range resp.Data.([]BulkResult) {
+			chosen = append(chosen, r.Name)
+		}
+		if got := strings.Join(chosen, ","); got != tt.want {
+			t.Errorf("stop %s chose %s, want %s", tt.pattern, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the daemon configuration read from ~/.controlman/config.json.
+// A missing file is not an error; every section has usable defaults.
+type Config struct {
+	Notifications NotificationConfig `json:"notifications"`
+	API           APIConfig          `json:"api"`
+	Socket        SocketConfig       `json:"socket"`
+	Fleet         FleetConfig        `json:"fleet"`
+}
+
+// FleetConfig makes the daemon the hub of a fleet of daemons, or an agent
+// of one. Agents connect to the hub's HTTP API (so the hub needs -api) and
+// the hub sends the commands of its users for them over that connection.
+type FleetConfig struct {
+	// Name of this host in the fleet, default the hostname
+	Name string `json:"name"`
+
+	// JoinToken lets agents presenting it connect; it enables the hub.
+	JoinToken string `json:"join_token"`
+
+	// Hub is the URL of the hub's HTTP API, including its base path; it
+	// makes the daemon an agent.
+	Hub   string `json:"hub"`
+	Token string `json:"token"` // the hub's join token
+	// Role of the hub on this host, default operator
+	Role     string `json:"role"`
+	CAFile   string `json:"ca_file"`
+	CertFile string `json:"cert_file"` // client certificate, for hubs that require one
+	KeyFile  string `json:"key_file"`
+	Insecure bool   `json:"insecure"` // skip verifying the hub's certificate
+}
+
+func (c FleetConfig) validate() error {
+	if c.Hub == "" {
+		return nil
+	}
+	if !strings.HasPrefix(c.Hub, "http://") && !strings.HasPrefix(c.Hub, "https://") {
+		return fmt.Errorf("invalid fleet hub %q: expected http:// or https://", c.Hub)
+	}
+	if c.Role != "" && !validRole(c.Role) {
+		return fmt.Errorf("unknown fleet role %q (expected viewer, operator or admin)", c.Role)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("fleet cert_file and key_file must be given together")
+	}
+	return nil
+}
+
+// SocketConfig controls who may use the command socket (controlman.sock).
+// The daemon's own user and root are always admins.
+type SocketConfig struct {
+	Mode  string `json:"mode"`  // octal file mode, default "0600" ("0660" with Group)
+	Group string `json:"group"` // group name or gid owning the socket
+	// Access lists the other local users and groups allowed to connect
+	Access []SocketAccess `json:"access"`
+}
+
+// SocketAccess grants a local user or group a role on the command socket.
+type SocketAccess struct {
+	User     string   `json:"user,omitempty"`  // user name or uid
+	Group    string   `json:"group,omitempty"` // group name or gid
+	Role     string   `json:"role"`            // default viewer
+	Services []string `json:"services,omitempty"`
+}
+
+// DefaultAPIPort is the port of the HTTP API when none is configured.
+const DefaultAPIPort = 1984
+
+// APIConfig controls where the HTTP API (enabled with -api) listens.
+type APIConfig struct {
+	// Addresses to bind, e.g. ["127.0.0.1", "::1"]; empty means all interfaces
+	Addresses []string `json:"addresses"`
+	Port      int      `json:"port"`
+	// Socket is the path of a unix socket that also serves the API.
+	// With SocketOnly no TCP port is opened.
+	Socket     string `json:"socket"`
+	SocketOnly bool   `json:"socket_only"`
+	// BasePath serves everything below a prefix such as "/controlman",
+	// for running behind a reverse proxy.
+	BasePath string `json:"base_path"`
+	// StaticDir overrides files of the web console embedded in the binary;
+	// files missing from it are still served from the binary.
+	StaticDir string `json:"static_dir"`
+	// TrustedProxies are the addresses or CIDR ranges of the reverse
+	// proxies whose X-Forwarded-For header names the client. The header is
+	// ignored when it comes from any other peer.
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// ListenAddrs returns the host:port pairs the API listens on.
+func (c APIConfig) ListenAddrs() []string {
+	if c.SocketOnly {
+		return nil
+	}
+	port := c.Port
+	if port == 0 {
+		port = DefaultAPIPort
+	}
+	if len(c.Addresses) == 0 {
+		return []string{fmt.Sprintf(":%d", port)}
+	}
+	addrs := make([]string, len(c.Addresses))
+	for i, host := range c.Addresses {
+		addrs[i] = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+	}
+	return addrs
+}
+
+// NormalizedBasePath returns BasePath with a leading and without a trailing
+// slash, or "" when the API is served at the root.
+func (c APIConfig) NormalizedBasePath() string {
+	p := strings.Trim(c.BasePath, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+func (c APIConfig) validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid api port %d", c.Port)
+	}
+	if c.SocketOnly && c.Socket == "" {
+		return fmt.Errorf("api socket_only requires api socket")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("invalid api trusted proxy %q", proxy)
+		}
+	}
+	return nil
+}
+
+// NotificationConfig lists the sinks that receive lifecycle events.
+type NotificationConfig struct {
+	Webhooks []WebhookSinkConfig `json:"webhooks"`
+	Exec     []ExecSinkConfig    `json:"exec"`
+	Email    []EmailSinkConfig   `json:"email"`
+}
+
+// SinkFilter restricts a sink to some event types and/or services.
+// Empty lists match everything.
+type SinkFilter struct {
+	Events   []string `json:"events"`
+	Services []string `json:"services"`
+}
+
+type WebhookSinkConfig struct {
+	SinkFilter
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Timeout Duration          `json:"timeout"`
+	Retries *int              `json:"retries"` // default 3; 0 turns retries off
+}
+
+// Default number of retries of a failed webhook delivery
+const defaultWebhookRetries = 3
+
+type ExecSinkConfig struct {
+	SinkFilter
+	Command string   `json:"command"`
+	Timeout Duration `json:"timeout"`
+}
+
+type EmailSinkConfig struct {
+	SinkFilter
+	Addr     string   `json:"addr"` // host:port of the SMTP server, e.g. localhost:25
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+}
+
+// Duration is a time.Duration that is written as a string ("10s") in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		// Allow plain numbers as seconds
+		var secs float64
+		if err := json.Unmarshal(b, &secs); err != nil {
+			return fmt.Errorf("invalid duration %s", string(b))
+		}
+		*d = Duration(secs * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Or returns d, or def when d is zero.
+func (d Duration) Or(def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// DefaultConfigPath returns ~/.controlman/config.json.
+func DefaultConfigPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".controlman", "config.json"), nil
+}
+
+// LoadConfig reads the config file at path. A missing file yields an empty config.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+	if err := cfg.API.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	if err := cfg.Socket.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	if err := cfg.Fleet.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	return cfg, nil
+}
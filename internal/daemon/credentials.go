@@ -0,0 +1,252 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	prefixUser       = "users:"
+	keySessionSecret = "auth:session_secret"
+
+	DefaultUsername = "admin"
+	DefaultPassword = "admin"
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// User is an account of the web console and HTTP API. Only the bcrypt hash
+// of the password is stored.
+type User struct {
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"password_hash"`
+	Role         string    `json:"role"`
+	Services     []string  `json:"services,omitempty"` // service name patterns; empty means all
+	SessionKey   string    `json:"session_key,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Caller returns the identity used to authorize the user's commands.
+func (u *User) Caller(source string) *Caller {
+	return &Caller{Name: u.Name, Role: u.Role, Services: u.Services, Source: source}
+}
+
+var (
+	// Compared against when the user does not exist, so that unknown and
+	// known users take the same time to reject.
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+func (d *Daemon) loadUser(name string) (*User, error) {
+	val, closer, err := d.serviceManager.DB().Get([]byte(prefixUser + name))
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var u User
+	if err := json.Unmarshal(val, &u); err != nil {
+		return nil, fmt.Errorf("corrupt user record %s: %v", name, err)
+	}
+	// Accounts created before roles existed were the single admin account
+	if u.Role == "" {
+		u.Role = RoleAdmin
+	}
+	return &u, nil
+}
+
+// LookupUser returns the account with the given name.
+func (d *Daemon) LookupUser(name string) (*User, error) {
+	u, err := d.loadUser(name)
+	if err == pebble.ErrNotFound {
+		return nil, fmt.Errorf("user %s does not exist", name)
+	}
+	return u, err
+}
+
+// LookupSession returns the account a session was issued to with the
+// session key of the account at that time. Changing the password or
+// ending the sessions of the account replaces its key, which invalidates
+// the sessions issued before.
+func (d *Daemon) LookupSession(name, key string) (*User, error) {
+	u, err := d.LookupUser(name)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(u.SessionKey), []byte(key)) != 1 {
+		return nil, fmt.Errorf("session of user %s has ended", name)
+	}
+	return u, nil
+}
+
+// EndSessions invalidates every session issued to a user.
+func (d *Daemon) EndSessions(name string) error {
+	u, err := d.loadUser(name)
+	if err != nil {
+		return err
+	}
+	if u.SessionKey, err = newSessionKey(); err != nil {
+		return err
+	}
+	return d.saveUser(u)
+}
+
+func newSessionKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func (d *Daemon) listUsers() ([]*User, error) {
+	iter, err := d.serviceManager.DB().NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefixUser),
+		UpperBound: []byte("users;"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var users []*User
+	for iter.First(); iter.Valid(); iter.Next() {
+		var u User
+		if err := json.Unmarshal(iter.Value(), &u); err != nil {
+			continue
+		}
+		if u.Role == "" {
+			u.Role = RoleAdmin
+		}
+		users = append(users, &u)
+	}
+	return users, iter.Error()
+}
+
+func (d *Daemon) saveUser(u *User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return d.serviceManager.DB().Set([]byte(prefixUser+u.Name), data, pebble.Sync)
+}
+
+// SetPassword sets the password of a user, creating it as an admin if it
+// does not exist yet. The sessions issued with the old password end.
+func (d *Daemon) SetPassword(name, password string) error {
+	if name == "" || password == "" {
+		return fmt.Errorf("username and password are required")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	u, err := d.loadUser(name)
+	if err == pebble.ErrNotFound {
+		u = &User{Name: name, Role: RoleAdmin, CreatedAt: time.Now()}
+	} else if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	if u.SessionKey, err = newSessionKey(); err != nil {
+		return err
+	}
+	return d.saveUser(u)
+}
+
+// Authenticate checks a username and password against the stored hash.
+func (d *Daemon) Authenticate(name, password string) error {
+	u, err := d.loadUser(name)
+	if err != nil {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("controlman"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		if err == pebble.ErrNotFound {
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// HasUsers reports whether any account has been created.
+func (d *Daemon) HasUsers() (bool, error) {
+	iter, err := d.serviceManager.DB().NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefixUser),
+		UpperBound: []byte("users;"),
+	})
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+	return iter.First(), iter.Error()
+}
+
+// SessionSecret returns the key used to sign session tokens, generating
+// it on first use. It is kept in the store so that sessions survive a
+// daemon restart.
+func (d *Daemon) SessionSecret() ([]byte, error) {
+	db := d.serviceManager.DB()
+	val, closer, err := db.Get([]byte(keySessionSecret))
+	if err == nil {
+		secret := append([]byte(nil), val...)
+		closer.Close()
+		return secret, nil
+	}
+	if err != pebble.ErrNotFound {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := db.Set([]byte(keySessionSecret), secret, pebble.Sync); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// InitCredentials prepares the API account before the HTTP server starts.
+// Credentials given on the command line are stored (hashed) and replace the
+// previous password of that user. The API refuses to start without any
+// account or with the well-known admin/admin account unless allowDefault is set.
+func (d *Daemon) InitCredentials(username, password string, allowDefault bool) error {
+	if username != "" || password != "" {
+		if username == DefaultUsername && password == DefaultPassword && !allowDefault {
+			return fmt.Errorf("refusing to use the default credentials %s/%s; choose another password or pass -allow-default-credentials", DefaultUsername, DefaultPassword)
+		}
+		return d.SetPassword(username, password)
+	}
+
+	exists, err := d.HasUsers()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if !allowDefault {
+			return fmt.Errorf("no API credentials configured; pass -username and -password (or -allow-default-credentials to use %s/%s)", DefaultUsername, DefaultPassword)
+		}
+		return d.SetPassword(DefaultUsername, DefaultPassword)
+	}
+
+	if !allowDefault && d.Authenticate(DefaultUsername, DefaultPassword) == nil {
+		return fmt.Errorf("the %s account still uses the default password; set a new one with -username and -password or pass -allow-default-credentials", DefaultUsername)
+	}
+	return nil
+}
@@ -3,13 +3,17 @@ package daemon
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/tangthinker/controlman/pkg/protocol"
 	"github.com/tangthinker/controlman/pkg/service"
 )
 
@@ -17,23 +21,129 @@ type Daemon struct {
 	serviceManager *service.ServiceManager
 	socketPath     string
 	monitors       map[string]chan struct{} // 用于停止监控协程
-	mu             sync.Mutex               // Protects monitors map
+	crashes        map[string][]time.Time   // Recent crash times, for flap detection
+	restarts       map[string]int           // Restarts since the daemon started
+	nextRuns       map[string]time.Time     // Next activation of scheduled cron jobs
+	runningJobs    map[string]int           // PIDs of the active job runs, 0 until started
+	serviceLocks   map[string]*sync.Mutex   // see lockService
+	mu             sync.Mutex               // Protects the maps above
+	events         *eventBus
+	auditLog       *auditLog
+	socketPolicy   *socketPolicy
+	fleet          *fleet
+
+	closed     chan struct{}  // closed by Close to stop background routines
+	background sync.WaitGroup // routines that use the store, see Close
 }
 
-type Command struct {
-	Action  string          `json:"action"`
-	Name    string          `json:"name"`
-	Command string          `json:"command"`
-	Data    json.RawMessage `json:"data"`
-}
+// Command is a request received on the socket or over HTTP.
+type Command = protocol.Request
 
+// Response is the result of a command. Data holds a typed payload (see
+// protocol/payloads.go) until the response is written to a client.
 type Response struct {
 	Success bool   `json:"success"`
+	Code    string `json:"code,omitempty"` // set when Success is false
 	Message string `json:"message"`
 	Data    any    `json:"data,omitempty"`
 }
 
-func NewDaemon() (*Daemon, error) {
+// wire encodes the response for the socket protocol.
+func (r Response) wire(id uint64) protocol.Response {
+	resp := protocol.Response{ID: id, Success: r.Success, Code: r.Code, Message: r.Message}
+	if r.Data != nil {
+		data, err := json.Marshal(r.Data)
+		if err != nil {
+			return protocol.Response{ID: id, Code: CodeInternal, Message: fmt.Sprintf("failed to encode response: %v", err)}
+		}
+		resp.Data = data
+	}
+	return resp
+}
+
+// lockedActions change the service they name; see lockService.
+var lockedActions = map[string]bool{
+	"edit":    true,
+	"start":   true,
+	"stop":    true,
+	"restart": true,
+	"delete":  true,
+	"scale":   true,
+	"reload":  true,
+}
+
+// Error codes of failed responses
+const (
+	CodeInvalidArgument    = protocol.CodeInvalidArgument
+	CodeNotFound           = protocol.CodeNotFound
+	CodeAlreadyExists      = protocol.CodeAlreadyExists
+	CodeConflict           = protocol.CodeConflict
+	CodeForbidden          = protocol.CodeForbidden
+	CodeInternal           = protocol.CodeInternal
+	CodeUnsupportedVersion = protocol.CodeUnsupportedVersion
+)
+
+// Payloads of Command.Data, see package protocol
+type (
+	ServiceOptions = protocol.ServiceOptions
+	ListRequest    = protocol.ListRequest
+	BulkRequest    = protocol.BulkRequest
+	BulkResult     = protocol.BulkResult
+)
+
+func parseServiceOptions(cmd Command) (*ServiceOptions, error) {
+	opts := &ServiceOptions{}
+	if len(cmd.Data) == 0 || string(cmd.Data) == "null" {
+		return opts, nil
+	}
+	if err := json.Unmarshal(cmd.Data, opts); err != nil {
+		return nil, fmt.Errorf("invalid service options: %v", err)
+	}
+	if err := opts.Hooks.Validate(); err != nil {
+		return nil, err
+	}
+	if err := service.ValidateLabels(opts.Labels); err != nil {
+		return nil, err
+	}
+	if opts.ReloadSignal != "" {
+		if _, err := service.ParseSignal(opts.ReloadSignal); err != nil {
+			return nil, err
+		}
+		opts.ReloadSignal = "SIG" + strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(opts.ReloadSignal)), "SIG")
+	}
+	return opts, nil
+}
+
+// requestCommand returns what the service of an add or edit request runs:
+// the program given by opts.Exec, or cmd.Command run by sh -c. Clients
+// written before exec existed send a command alone, so opts.Shell is
+// implied by a command. Both are empty if the request gives neither.
+func requestCommand(cmd Command, opts *ServiceOptions) (string, *service.Exec, error) {
+	switch {
+	case len(opts.Exec) > 0 && cmd.Command != "":
+		return "", nil, fmt.Errorf("command and exec cannot be given together")
+	case len(opts.Exec) > 0:
+		exec, err := service.ResolveExec(opts.Exec)
+		return "", exec, err
+	case cmd.Command == "" && opts.Shell:
+		return "", nil, fmt.Errorf("shell requires a command")
+	}
+	return cmd.Command, nil, nil
+}
+
+func NewDaemon(cfg *Config) (*Daemon, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	sinks, err := NewSinks(cfg.Notifications)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification config: %v", err)
+	}
+	policy, err := cfg.Socket.policy()
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket config: %v", err)
+	}
+
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return nil, err
@@ -50,10 +160,31 @@ func NewDaemon() (*Daemon, error) {
 		return nil, err
 	}
 
+	auditLog, err := openAuditLog(serviceManager.DB(), filepath.Join(baseDir, "audit.key"))
+	if err != nil {
+		serviceManager.Close()
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+
 	d := &Daemon{
 		serviceManager: serviceManager,
+		auditLog:       auditLog,
+		socketPolicy:   policy,
 		socketPath:     socketPath,
 		monitors:       make(map[string]chan struct{}),
+		crashes:        make(map[string][]time.Time),
+		restarts:       make(map[string]int),
+		nextRuns:       make(map[string]time.Time),
+		runningJobs:    make(map[string]int),
+		serviceLocks:   make(map[string]*sync.Mutex),
+		events:         newEventBus(),
+		fleet:          newFleet(cfg.Fleet),
+		closed:         make(chan struct{}),
+	}
+
+	d.startNotifier(sinks)
+	if err := serviceManager.Watch(d.serviceChanged); err != nil {
+		log.Printf("Warning: failed to watch services: %v", err)
 	}
 
 	// Start log rotation
@@ -64,17 +195,30 @@ func NewDaemon() (*Daemon, error) {
 		log.Printf("Warning: failed to load services: %v", err)
 	}
 
+	if cfg.Fleet.Hub != "" {
+		go d.runAgent(cfg.Fleet)
+	}
+
 	return d, nil
 }
 
 func (d *Daemon) Close() error {
 	d.mu.Lock()
-	// Stop all monitors
+	close(d.closed)
+	// Stop all monitors and schedulers
 	for name, ch := range d.monitors {
 		close(ch)
 		delete(d.monitors, name)
 	}
+	// and the job runs, which run in process groups of their own
+	for _, pid := range d.runningJobs {
+		if pid != 0 {
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+	}
 	d.mu.Unlock()
+	// and wait for all of them to stop using the store
+	d.background.Wait()
 
 	services, err := d.serviceManager.ListServices()
 	if err != nil {
@@ -97,6 +241,11 @@ func (d *Daemon) loadServices() error {
 	}
 
 	for _, s := range services {
+		if s.IsJob() {
+			d.loadJob(s)
+			continue
+		}
+
 		// 启动服务
 		if err := s.Start(); err != nil {
 			// 如果 Start() 失败，process.go 内部会设置为 Failed，我们需要保存这个状态
@@ -105,6 +254,7 @@ func (d *Daemon) loadServices() error {
 				log.Printf("Warning: failed to update service status %s: %v", s.Name, err)
 			}
 			log.Printf("Warning: failed to start service %s: %v", s.Name, err)
+			d.emit(EventFailed, s, err.Error())
 			continue
 		}
 		// 更新服务状态
@@ -112,71 +262,191 @@ func (d *Daemon) loadServices() error {
 		if err := d.serviceManager.SaveService(s); err != nil {
 			log.Printf("Warning: failed to update service status %s: %v", s.Name, err)
 		}
+		d.emit(EventStart, s, "")
 		go d.monitorService(s.Name)
 	}
 
 	return nil
 }
 
+// loadJob restores a job after a daemon restart. Cron jobs are scheduled
+// again unless they were stopped; one-shot jobs are never re-run, but a run
+// interrupted by the restart is marked as failed.
+func (d *Daemon) loadJob(s *service.Service) {
+	switch {
+	case s.Type == service.TypeCron && s.Status != service.StatusStopped:
+		d.startJob(s)
+	case s.Status == service.StatusRunning:
+		s.Status = service.StatusFailed
+		s.PID = 0
+		if err := d.serviceManager.SaveService(s); err != nil {
+			log.Printf("Warning: failed to update service status %s: %v", s.Name, err)
+		}
+	}
+}
+
+// track registers a background routine using the store, which calls
+// d.background.Done when it returns, so that Close waits for it. It
+// returns false once the daemon is closed. d.mu must be held.
+func (d *Daemon) track() bool {
+	select {
+	case <-d.closed:
+		return false
+	default:
+	}
+	d.background.Add(1)
+	return true
+}
+
 func (d *Daemon) monitorService(name string) {
 	stopChan := make(chan struct{})
 	d.mu.Lock()
+	if !d.track() {
+		d.mu.Unlock()
+		return
+	}
 	d.monitors[name] = stopChan
 	d.mu.Unlock()
+	defer d.background.Done()
 
 	for {
 		select {
 		case <-stopChan:
 			return
 		default:
-			s, err := d.serviceManager.LoadService(name)
-			if err != nil {
-				if err == os.ErrNotExist {
-					log.Printf("Service %s no longer exists, stopping monitor", name)
-					d.mu.Lock()
-					if ch, ok := d.monitors[name]; ok && ch == stopChan {
-						delete(d.monitors, name)
-					}
-					d.mu.Unlock()
-					return
-				}
-				log.Printf("Failed to load service %s for monitoring: %v", name, err)
-				time.Sleep(5 * time.Second)
-				continue
+		}
+		wait, ok := d.checkService(name, stopChan)
+		if !ok {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// checkService restarts the service, or its dead instances, if it is
+// expected to be running but is not. It returns how long to wait before
+// checking again, or false when there is nothing left to monitor.
+func (d *Daemon) checkService(name string, stopChan chan struct{}) (time.Duration, bool) {
+	defer d.lockService(name)()
+
+	s, err := d.serviceManager.LoadService(name)
+	if err != nil {
+		if err == os.ErrNotExist {
+			log.Printf("Service %s no longer exists, stopping monitor", name)
+			d.mu.Lock()
+			if ch, ok := d.monitors[name]; ok && ch == stopChan {
+				delete(d.monitors, name)
 			}
+			d.mu.Unlock()
+			return 0, false
+		}
+		log.Printf("Failed to load service %s for monitoring: %v", name, err)
+		return 5 * time.Second, true
+	}
+
+	if s.IsJob() {
+		// 任务由调度器管理，不需要保活
+		d.mu.Lock()
+		if ch, ok := d.monitors[name]; ok && ch == stopChan {
+			delete(d.monitors, name)
+		}
+		d.mu.Unlock()
+		return 0, false
+	}
 
-			if !s.IsRunning() {
-				// 如果期望是运行中，但实际没运行，才需要重启
-				// 注意：LoadService 得到的是最新状态，如果用户执行了 Stop，状态会变成 Stopped
-				if s.Status == service.StatusRunning {
-					log.Printf("Service %s is not running (expected Running), attempting to restart...", s.Name)
-
-					// 设置为重启中
-					s.Status = service.StatusRestarting
-					d.serviceManager.SetServiceStatus(s.Name, service.StatusRestarting)
-
-					if err := s.Restart(); err != nil {
-						s.Status = service.StatusFailed
-						d.serviceManager.SetServiceStatus(s.Name, service.StatusFailed)
-						log.Printf("Failed to restart service %s: %v", s.Name, err)
-					} else {
-						// 重启成功，更新为 Running 并保存 PID 等信息
-						s.Status = service.StatusRunning
-						if err := d.serviceManager.SaveService(s); err != nil {
-							log.Printf("Failed to save restarted service state %s: %v", s.Name, err)
-						}
-					}
+	if s.IsReplicated() {
+		if s.Status == service.StatusRunning {
+			d.reviveInstances(s)
+		}
+		return time.Second, true
+	}
+
+	if !s.IsRunning() {
+		// 如果期望是运行中，但实际没运行，才需要重启
+		// 注意：LoadService 得到的是最新状态，如果用户执行了 Stop，状态会变成 Stopped
+		if s.Status == service.StatusRunning {
+			log.Printf("Service %s is not running (expected Running), attempting to restart...", s.Name)
+			d.emit(EventCrash, s, "process exited unexpectedly")
+			if d.recordCrash(s.Name) {
+				d.emit(EventUnhealthy, s, fmt.Sprintf("crashed %d times within %s", flapThreshold, flapWindow))
+			}
+
+			// 设置为重启中
+			s.Status = service.StatusRestarting
+			d.serviceManager.SetServiceStatus(s.Name, service.StatusRestarting)
+
+			if err := s.Restart(); err != nil {
+				s.Status = service.StatusFailed
+				d.serviceManager.SetServiceStatus(s.Name, service.StatusFailed)
+				log.Printf("Failed to restart service %s: %v", s.Name, err)
+				d.emit(EventFailed, s, err.Error())
+			} else {
+				// 重启成功，更新为 Running 并保存 PID 等信息
+				s.Status = service.StatusRunning
+				if err := d.serviceManager.SaveService(s); err != nil {
+					log.Printf("Failed to save restarted service state %s: %v", s.Name, err)
 				}
+				d.emit(EventRestart, s, "restarted after crash")
+			}
+		}
+	}
+	return time.Second, true
+}
+
+// lockService serializes the changes made to a service by commands and by
+// its monitor, which each work on their own copy loaded from the store. It
+// returns the function unlocking the service.
+func (d *Daemon) lockService(name string) func() {
+	d.mu.Lock()
+	l, ok := d.serviceLocks[name]
+	if !ok {
+		l = new(sync.Mutex)
+		d.serviceLocks[name] = l
+	}
+	d.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// HandleCommand authorizes and runs a command on behalf of caller, on the
+// fleet host it names, and records it in the audit log.
+func (d *Daemon) HandleCommand(caller *Caller, cmd Command) Response {
+	if err := caller.Authorize(cmd); err != nil {
+		log.Printf("Denied %s %s for %s (%s): %v", cmd.Action, cmd.Name, caller.Name, caller.Source, err)
+		resp := Response{Success: false, Code: CodeForbidden, Message: err.Error()}
+		d.audit(caller, cmd, resp)
+		return resp
+	}
+
+	resp := d.routeCommand(caller, cmd)
+	d.audit(caller, cmd, resp)
+
+	// Only show the services the caller has been granted
+	if list, ok := resp.Data.([]ServiceInfo); ok && len(caller.Services) > 0 {
+		visible := make([]ServiceInfo, 0, len(list))
+		for _, info := range list {
+			if caller.CanAccess(info.Name) {
+				visible = append(visible, info)
 			}
-			time.Sleep(1 * time.Second)
 		}
+		resp.Data = visible
 	}
+	return resp
 }
 
-func (d *Daemon) HandleCommand(cmd Command) Response {
+func (d *Daemon) dispatch(caller *Caller, cmd Command) Response {
+	if isBulk(cmd) {
+		return d.handleBulk(caller, cmd)
+	}
+	if lockedActions[cmd.Action] && cmd.Name != "" {
+		defer d.lockService(cmd.Name)()
+	}
+
 	switch cmd.Action {
 	case "add":
 		return d.handleAdd(cmd)
+	case "edit":
+		return d.handleEdit(cmd)
 	case "stop":
 		return d.handleStop(cmd)
 	case "start":
@@ -185,37 +455,113 @@ func (d *Daemon) HandleCommand(cmd Command) Response {
 		return d.handleRestart(cmd)
 	case "logs":
 		return d.handleLogs(cmd)
+	case "watch":
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "watch needs a streaming connection: use the socket or GET /api/v1/events"}
 	case "info":
 		return d.handleInfo(cmd)
 	case "list":
-		return d.handleList()
+		return d.handleList(cmd)
 	case "delete":
 		return d.handleDelete(cmd)
+	case "reload":
+		return d.handleReload(cmd)
+	case "scale":
+		return d.handleScale(cmd)
+	case "run":
+		return d.handleRun(cmd)
+	case "runs":
+		return d.handleRuns(cmd)
+	case "notify-test":
+		return d.handleNotifyTest(cmd)
+	case "hosts":
+		return d.handleHosts()
+	case "user-add":
+		return d.handleUserAdd(cmd)
+	case "user-list":
+		return d.handleUserList()
+	case "user-remove":
+		return d.handleUserRemove(cmd)
+	case "user-passwd":
+		return d.handleUserPasswd(cmd)
+	case "apikey-create":
+		return d.handleAPIKeyCreate(caller, cmd)
+	case "apikey-list":
+		return d.handleAPIKeyList()
+	case "apikey-revoke":
+		return d.handleAPIKeyRevoke(cmd)
+	case "audit":
+		return d.handleAudit(cmd)
+	case "audit-verify":
+		return d.handleAuditVerify()
 	default:
-		return Response{Success: false, Message: "unknown command"}
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "unknown command"}
 	}
 }
 
 func (d *Daemon) handleAdd(cmd Command) Response {
-	if cmd.Name == "" || cmd.Command == "" {
-		return Response{Success: false, Message: "name and command are required"}
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
+	}
+	if err := service.ValidateName(cmd.Name); err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
 	}
 
 	if _, err := d.serviceManager.LoadService(cmd.Name); err == nil {
-		return Response{Success: false, Message: "service already exists"}
+		return Response{Success: false, Code: CodeAlreadyExists, Message: "service already exists"}
+	}
+
+	opts, err := parseServiceOptions(cmd)
+	if err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	command, exec, err := requestCommand(cmd, opts)
+	if err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	if command == "" && exec == nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "command or exec is required"}
 	}
 
 	log.Printf("Adding new service: %s", cmd.Name)
 	s := &service.Service{
 		Name:      cmd.Name,
-		Command:   cmd.Command,
+		Command:   command,
+		Exec:      exec,
 		Status:    service.StatusStopped,
 		CreatedAt: time.Now(),
+		Type:      opts.Type,
+		Schedule:  opts.Schedule,
+
+		Replicas:     opts.Replicas,
+		PortTemplate: opts.PortTemplate,
+		ReloadSignal: opts.ReloadSignal,
+	}
+	if s.Type == "" {
+		s.Type = service.TypeService
+	}
+	if err := validateJob(s); err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	if err := validateReplicas(s); err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	if !opts.Hooks.IsEmpty() {
+		s.Hooks = &service.Hooks{}
+		s.Hooks.Merge(opts.Hooks)
 	}
+	s.MergeLabels(opts.Labels)
 
 	if err := d.serviceManager.SaveService(s); err != nil {
 		log.Printf("Failed to save service %s: %v", cmd.Name, err)
-		return Response{Success: false, Message: fmt.Sprintf("failed to save service: %v", err)}
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to save service: %v", err)}
+	}
+
+	if s.IsJob() {
+		resp := d.startJob(s)
+		if resp.Success {
+			resp.Message = "job added: " + resp.Message
+		}
+		return resp
 	}
 
 	// 启动服务
@@ -223,7 +569,8 @@ func (d *Daemon) handleAdd(cmd Command) Response {
 		s.Status = service.StatusFailed
 		d.serviceManager.SaveService(s) // 保存 Failed 状态
 		log.Printf("Failed to start service %s: %v", cmd.Name, err)
-		return Response{Success: false, Message: fmt.Sprintf("failed to start service: %v", err)}
+		d.emit(EventFailed, s, err.Error())
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to start service: %v", err)}
 	}
 
 	// 保存启动后的状态
@@ -233,19 +580,93 @@ func (d *Daemon) handleAdd(cmd Command) Response {
 	}
 
 	log.Printf("Service %s started successfully with PID %d", cmd.Name, s.PID)
+	d.emit(EventStart, s, "")
 	go d.monitorService(s.Name)
 
 	return Response{Success: true, Message: "service added and started successfully"}
 }
 
+// handleEdit updates the definition of an existing service. Changes take
+// effect the next time the service is started.
+func (d *Daemon) handleEdit(cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
+	}
+
+	s, err := d.serviceManager.LoadService(cmd.Name)
+	if err != nil {
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
+	}
+
+	opts, err := parseServiceOptions(cmd)
+	if err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	command, exec, err := requestCommand(cmd, opts)
+	if err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	commandChanged := command != "" || exec != nil
+
+	if opts.Type != "" && opts.Type != s.Type && !(s.Type == "" && opts.Type == service.TypeService) {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "the type of a service cannot be changed"}
+	}
+	scheduleChanged := opts.Schedule != "" && opts.Schedule != s.Schedule
+	if scheduleChanged {
+		s.Schedule = opts.Schedule
+		if err := validateJob(s); err != nil {
+			return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+		}
+	}
+
+	if opts.Replicas != 0 {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "use scale to change the number of replicas"}
+	}
+	if opts.PortTemplate != "" {
+		s.PortTemplate = opts.PortTemplate
+		if err := validateReplicas(s); err != nil {
+			return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+		}
+	}
+
+	if opts.ReloadSignal != "" {
+		s.ReloadSignal = opts.ReloadSignal
+	}
+
+	if commandChanged {
+		s.Command, s.Exec = command, exec
+	}
+	if opts.Hooks != nil {
+		if s.Hooks == nil {
+			s.Hooks = &service.Hooks{}
+		}
+		s.Hooks.Merge(opts.Hooks)
+	}
+	s.MergeLabels(opts.Labels)
+
+	if err := d.serviceManager.SaveService(s); err != nil {
+		log.Printf("Failed to save service %s: %v", cmd.Name, err)
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to save service: %v", err)}
+	}
+
+	log.Printf("Service %s updated", cmd.Name)
+	if scheduleChanged && s.Status != service.StatusStopped {
+		d.rescheduleJob(s.Name)
+	}
+	if s.IsRunning() && (commandChanged || opts.PortTemplate != "") {
+		return Response{Success: true, Message: "service updated, restart it to apply the changes"}
+	}
+	return Response{Success: true, Message: "service updated successfully"}
+}
+
 func (d *Daemon) handleStop(cmd Command) Response {
 	if cmd.Name == "" {
-		return Response{Success: false, Message: "service name is required"}
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
 	}
 
 	s, err := d.serviceManager.LoadService(cmd.Name)
 	if err != nil {
-		return Response{Success: false, Message: "service not found"}
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
 	}
 
 	log.Printf("Stopping service: %s (PID: %d)", cmd.Name, s.PID)
@@ -262,7 +683,7 @@ func (d *Daemon) handleStop(cmd Command) Response {
 		s.Status = service.StatusRunning
 		d.serviceManager.SetServiceStatus(s.Name, service.StatusRunning)
 		log.Printf("Failed to stop service %s: %v", cmd.Name, err)
-		return Response{Success: false, Message: fmt.Sprintf("failed to stop service: %v", err)}
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to stop service: %v", err)}
 	}
 
 	// 保存停止后的状态
@@ -280,32 +701,38 @@ func (d *Daemon) handleStop(cmd Command) Response {
 	d.mu.Unlock()
 
 	log.Printf("Service %s stopped successfully", cmd.Name)
+	d.emit(EventStop, s, "")
 	return Response{Success: true, Message: "service stopped successfully"}
 }
 
 func (d *Daemon) handleStart(cmd Command) Response {
 	if cmd.Name == "" {
-		return Response{Success: false, Message: "service name is required"}
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
 	}
 
 	s, err := d.serviceManager.LoadService(cmd.Name)
 	if err != nil {
-		return Response{Success: false, Message: "service not found"}
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
 	}
 
-	// 如果服务已经在运行，直接返回成功
-	if s.IsRunning() {
+	// 如果服务的所有实例都已经在运行，直接返回成功
+	if s.RunningInstances() == s.DesiredInstances() {
 		log.Printf("Service %s is already running (PID: %d)", cmd.Name, s.PID)
 		return Response{Success: true, Message: "service is already running"}
 	}
 
+	if s.IsJob() {
+		return d.startJob(s)
+	}
+
 	log.Printf("Starting service: %s", cmd.Name)
 	// 启动服务
 	if err := s.Start(); err != nil {
 		s.Status = service.StatusFailed
 		d.serviceManager.SaveService(s) // 保存 Failed 状态
 		log.Printf("Failed to start service %s: %v", cmd.Name, err)
-		return Response{Success: false, Message: fmt.Sprintf("failed to start service: %v", err)}
+		d.emit(EventFailed, s, err.Error())
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to start service: %v", err)}
 	}
 
 	// 保存启动后的状态
@@ -315,6 +742,7 @@ func (d *Daemon) handleStart(cmd Command) Response {
 	}
 
 	log.Printf("Service %s started successfully with PID %d", cmd.Name, s.PID)
+	d.emit(EventStart, s, "")
 	// 启动监控协程
 	go d.monitorService(s.Name)
 
@@ -323,12 +751,23 @@ func (d *Daemon) handleStart(cmd Command) Response {
 
 func (d *Daemon) handleRestart(cmd Command) Response {
 	if cmd.Name == "" {
-		return Response{Success: false, Message: "service name is required"}
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
 	}
 
 	s, err := d.serviceManager.LoadService(cmd.Name)
 	if err != nil {
-		return Response{Success: false, Message: "service not found"}
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
+	}
+
+	if s.IsJob() {
+		if err := s.Stop(); err != nil {
+			return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to stop job: %v", err)}
+		}
+		return d.startJob(s)
+	}
+
+	if s.IsReplicated() && s.RunningInstances() > 0 {
+		return d.rollingRestart(s)
 	}
 
 	log.Printf("Restarting service: %s", cmd.Name)
@@ -343,7 +782,8 @@ func (d *Daemon) handleRestart(cmd Command) Response {
 		s.Status = service.StatusFailed
 		d.serviceManager.SaveService(s)
 		log.Printf("Failed to restart service %s: %v", cmd.Name, err)
-		return Response{Success: false, Message: fmt.Sprintf("failed to restart service: %v", err)}
+		d.emit(EventFailed, s, err.Error())
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to restart service: %v", err)}
 	}
 
 	s.Status = service.StatusRunning
@@ -352,6 +792,7 @@ func (d *Daemon) handleRestart(cmd Command) Response {
 	}
 
 	log.Printf("Service %s restarted successfully with PID %d", cmd.Name, s.PID)
+	d.emit(EventRestart, s, "")
 
 	// Ensure monitor is running
 	d.mu.Lock()
@@ -367,53 +808,56 @@ func (d *Daemon) handleRestart(cmd Command) Response {
 
 func (d *Daemon) handleLogs(cmd Command) Response {
 	if cmd.Name == "" {
-		return Response{Success: false, Message: "service name is required"}
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
 	}
 
 	s, err := d.serviceManager.LoadService(cmd.Name)
 	if err != nil {
-		return Response{Success: false, Message: "service not found"}
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
 	}
 
 	logs, err := s.GetLogs()
 	if err != nil {
-		return Response{Success: false, Message: fmt.Sprintf("failed to get logs: %v", err)}
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to get logs: %v", err)}
 	}
 
 	return Response{Success: true, Data: logs}
 }
 
-func (d *Daemon) handleList() Response {
+func (d *Daemon) handleList(cmd Command) Response {
+	var req ListRequest
+	if len(cmd.Data) > 0 {
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return Response{Success: false, Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid list request: %v", err)}
+		}
+	}
+	selector, err := service.ParseSelector(req.Selector)
+	if err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+
 	services, err := d.serviceManager.ListServices()
 	if err != nil {
-		return Response{Success: false, Message: fmt.Sprintf("failed to list services: %v", err)}
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to list services: %v", err)}
 	}
 
-	serviceList := make([]map[string]interface{}, 0)
+	serviceList := make([]ServiceInfo, 0, len(services))
 	for _, s := range services {
-		cpu, mem, _ := s.GetStats()
-		serviceList = append(serviceList, map[string]interface{}{
-			"name":       s.Name,
-			"status":     s.Status,
-			"pid":        s.PID,
-			"cpu":        cpu,
-			"memory":     mem,
-			"created_at": s.CreatedAt.Format(time.RFC3339),
-			"last_start": s.LastStarted.Format(time.RFC3339),
-			"command":    s.Command,
-		})
+		if selector.Matches(s.Labels) {
+			serviceList = append(serviceList, d.serviceInfo(s, false))
+		}
 	}
 	return Response{Success: true, Data: serviceList}
 }
 
 func (d *Daemon) handleDelete(cmd Command) Response {
 	if cmd.Name == "" {
-		return Response{Success: false, Message: "service name is required"}
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
 	}
 
 	s, err := d.serviceManager.LoadService(cmd.Name)
 	if err != nil {
-		return Response{Success: false, Message: "service not found"}
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
 	}
 
 	log.Printf("Deleting service: %s (PID: %d)", cmd.Name, s.PID)
@@ -427,44 +871,53 @@ func (d *Daemon) handleDelete(cmd Command) Response {
 		close(stopChan)
 		delete(d.monitors, cmd.Name)
 	}
+	delete(d.restarts, cmd.Name)
 	d.mu.Unlock()
 
 	if err := d.serviceManager.DeleteService(cmd.Name); err != nil {
 		log.Printf("Failed to delete service %s: %v", cmd.Name, err)
-		return Response{Success: false, Message: fmt.Sprintf("failed to delete service: %v", err)}
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to delete service: %v", err)}
 	}
 
 	log.Printf("Service %s deleted successfully", cmd.Name)
+	s.Status = service.StatusStopped
+	d.emit(EventStop, s, "service deleted")
 	return Response{Success: true, Message: "service deleted successfully"}
 }
 
+// handleNotifyTest publishes a test event so sink configuration can be
+// verified without disturbing any service.
+func (d *Daemon) handleNotifyTest(cmd Command) Response {
+	name := cmd.Name
+	if name == "" {
+		name = "controlman"
+	}
+	d.emit(EventTest, &service.Service{Name: name, Status: service.StatusUnknown}, "test notification")
+	return Response{Success: true, Message: "test event published"}
+}
+
 func (d *Daemon) handleInfo(cmd Command) Response {
 	if cmd.Name == "" {
-		return Response{Success: false, Message: "service name is required"}
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
 	}
 
 	s, err := d.serviceManager.LoadService(cmd.Name)
 	if err != nil {
-		return Response{Success: false, Message: "service not found"}
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
 	}
 
-	cpu, mem, _ := s.GetStats()
-
-	info := map[string]interface{}{
-		"name":       s.Name,
-		"status":     s.Status,
-		"pid":        s.PID,
-		"cpu":        cpu,
-		"memory":     mem,
-		"created_at": s.CreatedAt.Format(time.RFC3339),
-		"last_start": s.LastStarted.Format(time.RFC3339),
-		"command":    s.Command,
-		"log_file":   s.LogFile,
-	}
+	info := d.serviceInfo(s, true)
 
 	return Response{Success: true, Data: info}
 }
 
+func serviceType(s *service.Service) string {
+	if s.Type == "" {
+		return service.TypeService
+	}
+	return s.Type
+}
+
 func (d *Daemon) Run() error {
 	// 确保socket目录存在
 	if err := os.MkdirAll(filepath.Dir(d.socketPath), 0755); err != nil {
@@ -474,10 +927,11 @@ func (d *Daemon) Run() error {
 	// 删除已存在的socket文件
 	os.Remove(d.socketPath)
 
-	listener, err := net.Listen("unix", d.socketPath)
+	listener, err := d.socketPolicy.listen(d.socketPath)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(d.socketPath)
 	defer listener.Close()
 
 	log.Printf("Daemon listening on %s", d.socketPath)
@@ -494,11 +948,41 @@ func (d *Daemon) Run() error {
 }
 
 func (d *Daemon) handleConnection(conn net.Conn) {
+	d.serve(conn, d.connCaller(conn))
+}
+
+// serve answers the requests of a connection on behalf of caller until it
+// is closed.
+func (d *Daemon) serve(conn io.ReadWriteCloser, caller *Caller) {
 	defer conn.Close()
 
 	decoder := json.NewDecoder(conn)
 	encoder := json.NewEncoder(conn)
 
+	if !d.handshake(decoder, encoder) {
+		return
+	}
+
+	// Requests are handled concurrently; responses carry the request ID
+	// so the client can match them up
+	var (
+		mu       sync.Mutex
+		inFlight sync.WaitGroup
+	)
+	send := func(resp protocol.Response) error {
+		mu.Lock()
+		defer mu.Unlock()
+		err := encoder.Encode(resp)
+		if err != nil {
+			log.Printf("Failed to send response: %v", err)
+		}
+		return err
+	}
+	closed := make(chan struct{})
+	defer func() {
+		close(closed)
+		inFlight.Wait()
+	}()
 	for {
 		var cmd Command
 		if err := decoder.Decode(&cmd); err != nil {
@@ -509,10 +993,51 @@ func (d *Daemon) handleConnection(conn net.Conn) {
 			return
 		}
 
-		response := d.HandleCommand(cmd)
-		if err := encoder.Encode(response); err != nil {
-			log.Printf("Failed to send response: %v", err)
-			return
+		inFlight.Add(1)
+		go func(cmd Command) {
+			defer inFlight.Done()
+			if cmd.Action == "watch" {
+				d.serveWatch(caller, cmd, send, closed)
+				return
+			}
+			response := d.HandleCommand(caller, cmd)
+			if !readOnlyActions[cmd.Action] {
+				log.Printf("Command %s %s from %s (%s): success=%t", cmd.Action, cmd.Name, caller.Name, caller.Source, response.Success)
+			}
+			send(response.wire(cmd.ID))
+		}(cmd)
+	}
+}
+
+// handshake reads the hello request that starts a connection and checks
+// the client's protocol version.
+func (d *Daemon) handshake(decoder *json.Decoder, encoder *json.Encoder) bool {
+	var req Command
+	if err := decoder.Decode(&req); err != nil {
+		if err.Error() != "EOF" {
+			log.Printf("Connection error: %v", err)
 		}
+		return false
+	}
+
+	var hello protocol.HelloRequest
+	response := Response{Success: true, Data: protocol.HelloResponse{Version: protocol.Version, MinVersion: protocol.MinVersion}}
+	switch {
+	case req.Action != protocol.ActionHello:
+		response = Response{Success: false, Code: CodeUnsupportedVersion, Message: "the client does not speak the controlman protocol, please upgrade the controlman client"}
+	case json.Unmarshal(req.Data, &hello) != nil:
+		response = Response{Success: false, Code: CodeInvalidArgument, Message: "invalid hello request"}
+	case hello.Version < protocol.MinVersion:
+		response = Response{Success: false, Code: CodeUnsupportedVersion, Message: fmt.Sprintf("protocol version %d is no longer supported (minimum %d), please upgrade the controlman client", hello.Version, protocol.MinVersion)}
+	case hello.Version > protocol.Version:
+		response = Response{Success: false, Code: CodeUnsupportedVersion, Message: fmt.Sprintf("protocol version %d is newer than the daemon's (%d), please upgrade the controlman daemon", hello.Version, protocol.Version)}
+	}
+	if !response.Success {
+		log.Printf("Rejected client: %s", response.Message)
+	}
+	if err := encoder.Encode(response.wire(req.ID)); err != nil {
+		log.Printf("Failed to send response: %v", err)
+		return false
 	}
+	return response.Success
 }
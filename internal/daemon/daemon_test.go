@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRequestCommand(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		command string
+		opts    ServiceOptions
+		want    string // command, or exec joined by spaces
+		err     string
+	}{
+		{"neither", "", ServiceOptions{}, "", ""},
+		{"exec", "", ServiceOptions{Exec: []string{"sleep", "300"}}, "sleep 300", ""},
+		{"shell", "sleep 300 && echo done", ServiceOptions{Shell: true}, "sleep 300 && echo done", ""},
+		// Clients that predate exec send the command alone
+		{"bare command", "sleep 300 && echo done", ServiceOptions{}, "sleep 300 && echo done", ""},
+		{"both", "sleep 300", ServiceOptions{Exec: []string{"sleep", "300"}}, "", "cannot be given together"},
+		{"shell without command", "", ServiceOptions{Shell: true}, "", "shell requires a command"},
+		{"missing executable", "", ServiceOptions{Exec: []string{"no-such-program"}}, "", "no-such-program"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			command, exec, err := requestCommand(Command{Command: tt.command}, &tt.opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %q, %v, %v; want an error with %q", command, exec, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := command
+			if exec != nil {
+				if command != "" {
+					t.Errorf("got both command %q and exec %v", command, exec)
+				}
+				got = strings.Join(append([]string{filepath.Base(exec.Path)}, exec.Args...), " ")
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddBareCommand(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	cmd := Command{Action: "add", Name: "legacy", Command: "sleep 300 && echo done"}
+	if resp := d.HandleCommand(testAdmin, cmd); !resp.Success {
+		t.Fatalf("add: %s", resp.Message)
+	}
+	s, err := d.serviceManager.LoadService("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsShell() || s.Command != "sleep 300 && echo done" {
+		t.Errorf("stored command %q, shell %v", s.Command, s.IsShell())
+	}
+}
@@ -0,0 +1,145 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// Lifecycle event types
+const (
+	EventStart     = "start"
+	EventStop      = "stop"
+	EventCrash     = "crash"
+	EventRestart   = "restart"
+	EventReload    = "reload"
+	EventFailed    = "failed"
+	EventUnhealthy = "unhealthy"
+	EventTest      = "test"
+
+	// State changes, published for watchers. Notification sinks only
+	// receive them when they list them explicitly.
+	EventAdded   = "added"
+	EventRemoved = "removed"
+	EventStatus  = "status"
+	EventPID     = "pid"
+)
+
+var stateEvents = map[string]bool{EventAdded: true, EventRemoved: true, EventStatus: true, EventPID: true}
+
+const (
+	// A service that crashes this many times within flapWindow is reported unhealthy.
+	flapThreshold = 3
+	flapWindow    = 5 * time.Minute
+)
+
+type Event = protocol.Event
+
+// eventBus fans events out to subscribers. Slow subscribers lose events
+// rather than blocking the daemon.
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[int]chan Event
+	next int
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[int]chan Event)}
+}
+
+func (b *eventBus) subscribe(size int) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	ch := make(chan Event, size)
+	b.subs[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("Events: subscriber queue full, dropping %s event for %s", e.Type, e.Service)
+		}
+	}
+}
+
+// serviceChanged publishes the state change events of a saved or deleted
+// service.
+func (d *Daemon) serviceChanged(c service.Change) {
+	e := Event{Service: c.Name, PID: c.PID, Status: c.Status, Host: d.fleet.name, Time: time.Now()}
+	switch {
+	case c.Added:
+		e.Type = EventAdded
+		d.events.publish(e)
+	case c.Removed:
+		e.Type, e.PID, e.Status = EventRemoved, c.OldPID, c.OldStatus
+		d.events.publish(e)
+	default:
+		if c.Status != c.OldStatus {
+			e.Type, e.Message = EventStatus, c.OldStatus+" -> "+c.Status
+			d.events.publish(e)
+		}
+		if c.PID != c.OldPID {
+			e.Type, e.Message = EventPID, fmt.Sprintf("%d -> %d", c.OldPID, c.PID)
+			d.events.publish(e)
+		}
+	}
+}
+
+// emit publishes a lifecycle event for s and counts its restarts.
+func (d *Daemon) emit(eventType string, s *service.Service, message string) {
+	if eventType == EventRestart {
+		d.mu.Lock()
+		d.restarts[s.Name]++
+		d.mu.Unlock()
+	}
+	d.events.publish(Event{
+		Type:    eventType,
+		Service: s.Name,
+		PID:     s.PID,
+		Status:  s.Status,
+		Message: message,
+		Host:    d.fleet.name,
+		Time:    time.Now(),
+	})
+}
+
+// recordCrash remembers a crash of name and reports whether the service
+// just crossed the flapping threshold.
+func (d *Daemon) recordCrash(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	recent := d.crashes[name][:0]
+	for _, t := range d.crashes[name] {
+		if now.Sub(t) < flapWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	d.crashes[name] = recent
+
+	return len(recent) == flapThreshold
+}
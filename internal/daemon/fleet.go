@@ -0,0 +1,402 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/client"
+	"github.com/tangthinker/controlman/pkg/protocol"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+type HostInfo = protocol.HostInfo
+
+// FleetProtocol is the Upgrade header of the connection an agent opens to
+// its hub. Once upgraded, the hub speaks the socket protocol over it as the
+// client.
+const FleetProtocol = "controlman-fleet"
+
+// How long the hub waits for an agent to answer a command
+const fleetTimeout = 30 * time.Second
+
+// Errors of AuthorizeAgent
+var (
+	ErrFleetDisabled    = errors.New("this daemon is not a fleet hub")
+	ErrInvalidJoinToken = errors.New("invalid join token")
+)
+
+// fleet tracks the agents connected to a hub.
+type fleet struct {
+	name      string // of this host
+	joinToken string
+
+	mu     sync.Mutex
+	agents map[string]*fleetAgent
+}
+
+type fleetAgent struct {
+	name        string
+	address     string
+	client      *client.Client
+	conn        net.Conn
+	connectedAt time.Time
+}
+
+func newFleet(cfg FleetConfig) *fleet {
+	name := cfg.Name
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	return &fleet{name: name, joinToken: cfg.JoinToken, agents: make(map[string]*fleetAgent)}
+}
+
+func (f *fleet) agent(name string) *fleetAgent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.agents[name]
+}
+
+func (f *fleet) list() []*fleetAgent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	agents := make([]*fleetAgent, 0, len(f.agents))
+	for _, a := range f.agents {
+		agents = append(agents, a)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].name < agents[j].name })
+	return agents
+}
+
+// AuthorizeAgent checks the join token and name of an agent connecting to
+// the hub.
+func (d *Daemon) AuthorizeAgent(token, name string) error {
+	if d.fleet.joinToken == "" {
+		return ErrFleetDisabled
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(d.fleet.joinToken)) != 1 {
+		return ErrInvalidJoinToken
+	}
+	if name == "" || name == protocol.AllHosts || name == d.fleet.name || strings.ContainsAny(name, "/ ") {
+		return fmt.Errorf("invalid agent name %q", name)
+	}
+	return nil
+}
+
+// ServeAgent sends commands to an agent over the connection it opened until
+// it is closed. An agent connecting again under the same name replaces the
+// old connection.
+func (d *Daemon) ServeAgent(name, address string, conn net.Conn) {
+	dc := &doneConn{Conn: conn, done: make(chan struct{})}
+	c, err := client.NewConn(dc, client.WithClientName("controlman-hub"), client.WithTimeout(fleetTimeout))
+	if err != nil {
+		log.Printf("Fleet agent %s (%s) failed the handshake: %v", name, address, err)
+		conn.Close()
+		return
+	}
+	a := &fleetAgent{name: name, address: address, client: c, conn: dc, connectedAt: time.Now()}
+
+	d.fleet.mu.Lock()
+	old := d.fleet.agents[name]
+	d.fleet.agents[name] = a
+	d.fleet.mu.Unlock()
+	if old != nil {
+		old.conn.Close()
+	}
+	log.Printf("Fleet agent %s connected from %s", name, address)
+
+	<-dc.done
+	c.Close()
+	d.fleet.mu.Lock()
+	if d.fleet.agents[name] == a {
+		delete(d.fleet.agents, name)
+	}
+	d.fleet.mu.Unlock()
+	log.Printf("Fleet agent %s disconnected", name)
+}
+
+// doneConn closes done once the connection is closed or broken.
+type doneConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *doneConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.once.Do(func() { close(c.done) })
+	}
+	return n, err
+}
+
+func (c *doneConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// routeCommand runs an authorized command on the host it names.
+func (d *Daemon) routeCommand(caller *Caller, cmd Command) Response {
+	switch {
+	case cmd.Host == "" || cmd.Host == d.fleet.name || cmd.Action == "hosts":
+		return d.dispatch(caller, cmd)
+	case cmd.Host == protocol.AllHosts:
+		if cmd.Action != "list" {
+			return Response{Success: false, Code: CodeInvalidArgument, Message: fmt.Sprintf("%s cannot be sent to all hosts", cmd.Action)}
+		}
+		return d.handleFleetList(caller, cmd)
+	default:
+		a := d.fleet.agent(cmd.Host)
+		if a == nil {
+			return Response{Success: false, Code: CodeNotFound, Message: fmt.Sprintf("host %s is not connected", cmd.Host)}
+		}
+		if isBulk(cmd) && len(caller.Services) > 0 {
+			var err error
+			if cmd, err = limitBulk(caller, cmd); err != nil {
+				return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+			}
+		}
+		return a.forward(cmd)
+	}
+}
+
+// forward sends a command to the agent and decodes the data of the
+// response into the type the daemon itself would have answered with.
+func (a *fleetAgent) forward(cmd Command) Response {
+	ctx, cancel := context.WithTimeout(context.Background(), fleetTimeout)
+	defer cancel()
+	req := cmd
+	req.ID, req.Host = 0, ""
+	resp, err := a.client.Do(ctx, &req)
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("host %s: %v", a.name, err)}
+	}
+
+	result := Response{Success: resp.Success, Code: resp.Code, Message: resp.Message}
+	if !resp.Success {
+		// Say that the agent refused, not the hub
+		result.Message = fmt.Sprintf("host %s: %s", a.name, resp.Message)
+	}
+	if len(resp.Data) == 0 {
+		return result
+	}
+	var data any
+	switch cmd.Action {
+	case "list":
+		var list []ServiceInfo
+		err = json.Unmarshal(resp.Data, &list)
+		for i := range list {
+			list[i].Host = a.name
+		}
+		data = list
+	case "info":
+		var info ServiceInfo
+		err = json.Unmarshal(resp.Data, &info)
+		info.Host = a.name
+		data = info
+	case "logs":
+		var logs string
+		err = json.Unmarshal(resp.Data, &logs)
+		data = logs
+	case "runs":
+		var runs []service.Run
+		err = json.Unmarshal(resp.Data, &runs)
+		data = runs
+	case "start", "stop", "restart", "delete":
+		// Only bulk actions answer with data
+		var results []BulkResult
+		err = json.Unmarshal(resp.Data, &results)
+		data = results
+	default:
+		data = resp.Data
+	}
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("host %s: invalid response: %v", a.name, err)}
+	}
+	result.Data = data
+	return result
+}
+
+// handleFleetList lists the services of this host and every agent. Hosts
+// that fail to answer are named in the message.
+func (d *Daemon) handleFleetList(caller *Caller, cmd Command) Response {
+	list := Command{Action: "list", Data: cmd.Data}
+	resp := d.dispatch(caller, list)
+	if !resp.Success {
+		return resp
+	}
+	services, _ := resp.Data.([]ServiceInfo)
+	for i := range services {
+		services[i].Host = d.fleet.name
+	}
+
+	agents := d.fleet.list()
+	results := make([]Response, len(agents))
+	var wg sync.WaitGroup
+	for i, a := range agents {
+		wg.Add(1)
+		go func(i int, a *fleetAgent) {
+			defer wg.Done()
+			results[i] = a.forward(list)
+		}(i, a)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, r := range results {
+		list, ok := r.Data.([]ServiceInfo)
+		if !r.Success || !ok {
+			failed = append(failed, fmt.Sprintf("%s: %s", agents[i].name, r.Message))
+			continue
+		}
+		services = append(services, list...)
+	}
+	resp = Response{Success: true, Data: services}
+	if len(failed) > 0 {
+		resp.Message = "some hosts did not answer: " + strings.Join(failed, "; ")
+	}
+	return resp
+}
+
+func (d *Daemon) handleHosts() Response {
+	hosts := []HostInfo{{Name: d.fleet.name, Local: true}}
+	for _, a := range d.fleet.list() {
+		hosts = append(hosts, HostInfo{Name: a.name, Address: a.address, ConnectedAt: a.connectedAt})
+	}
+	return Response{Success: true, Data: hosts}
+}
+
+// runAgent keeps a connection to the hub open, reconnecting with a growing
+// delay when it breaks, and serves the hub's commands over it until the
+// daemon is closed.
+func (d *Daemon) runAgent(cfg FleetConfig) {
+	d.mu.Lock()
+	if !d.track() {
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
+	defer d.background.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	hc, err := agentHTTPClient(cfg)
+	if err != nil {
+		log.Printf("Fleet agent disabled: %v", err)
+		return
+	}
+	role := cfg.Role
+	if role == "" {
+		role = RoleOperator
+	}
+	caller := &Caller{Name: "fleet-hub", Role: role, Source: "fleet " + cfg.Hub}
+
+	delay := time.Second
+	for {
+		started := time.Now()
+		err := d.connectHub(ctx, hc, cfg, caller)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > time.Minute {
+			delay = time.Second
+		}
+		log.Printf("Fleet hub %s: %v, reconnecting in %s", cfg.Hub, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+// connectHub opens the connection to the hub and serves it until it closes
+// or ctx is done.
+func (d *Daemon) connectHub(ctx context.Context, hc *http.Client, cfg FleetConfig, caller *Caller) error {
+	u := strings.TrimSuffix(cfg.Hub, "/") + "/api/v1/fleet/connect?name=" + url.QueryEscape(d.fleet.name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", FleetProtocol)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return fmt.Errorf("rejected: %s", apiErr.Error)
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return fmt.Errorf("the connection cannot be upgraded")
+	}
+
+	log.Printf("Connected to fleet hub %s as %s", cfg.Hub, d.fleet.name)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	d.serve(conn, caller)
+	return errors.New("connection closed")
+}
+
+func agentHTTPClient(cfg FleetConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// Upgrading needs HTTP/1.1
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	transport.ResponseHeaderTimeout = fleetTimeout
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,371 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+const testJoinToken = "join-secret"
+
+var testAdmin = &Caller{Name: "admin", Role: RoleAdmin, Source: "test"}
+
+// newTestDaemon starts a daemon with its own home directory.
+func newTestDaemon(t *testing.T, fleet FleetConfig) *Daemon {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	d, err := NewDaemon(&Config{Fleet: fleet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-d.closed: // closed by the test
+		default:
+			d.Close()
+		}
+	})
+	return d
+}
+
+// closeDaemon closes d and fails if that takes long, e.g. because a
+// background routine does not stop.
+func closeDaemon(t *testing.T, d *Daemon) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- d.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close did not return")
+	}
+}
+
+// running reports whether a goroutine is running the function, given by
+// its name as it appears in stack traces, e.g. "(*Daemon).runAgent".
+func running(function string) bool {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	return bytes.Contains(buf, []byte("daemon."+function+"("))
+}
+
+// newTestHub serves the fleet endpoint of a hub the way the HTTP API does.
+func newTestHub(t *testing.T) (*Daemon, *httptest.Server) {
+	t.Helper()
+	hub := newTestDaemon(t, FleetConfig{Name: "hub", JoinToken: testJoinToken})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := hub.AuthorizeAgent(token, name); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijacking the agent connection: %v", err)
+			return
+		}
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: " + FleetProtocol + "\r\nConnection: Upgrade\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			conn.Close()
+			return
+		}
+		hub.ServeAgent(name, r.RemoteAddr, &bufferedConn{Conn: conn, r: rw.Reader})
+	}))
+	t.Cleanup(srv.Close)
+	return hub, srv
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// testAgent is an agent daemon connected to a hub.
+type testAgent struct {
+	*Daemon
+	conn net.Conn   // the agent's end of its connection to the hub
+	done chan error // receives the error connectHub returned
+}
+
+// connectAgent connects an agent to the hub served by srv with token and
+// returns once connectHub returned or the hub lists the agent.
+func connectAgent(t *testing.T, agent *Daemon, hub *Daemon, srv *httptest.Server, token string) *testAgent {
+	t.Helper()
+	a := &testAgent{Daemon: agent, done: make(chan error, 1)}
+	conns := make(chan net.Conn, 1)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err == nil {
+			conns <- conn
+		}
+		return conn, err
+	}
+	cfg := FleetConfig{Hub: srv.URL, Token: token}
+	caller := &Caller{Name: "fleet-hub", Role: RoleOperator, Source: "fleet " + srv.URL}
+	go func() {
+		a.done <- agent.connectHub(context.Background(), &http.Client{Transport: transport}, cfg, caller)
+	}()
+	a.conn = <-conns
+	t.Cleanup(func() { a.conn.Close() })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if hub.fleet.agent(agent.fleet.name) != nil {
+			return a
+		}
+		select {
+		case err := <-a.done:
+			a.done <- err
+			return a
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatalf("agent %s did not connect", agent.fleet.name)
+	return nil
+}
+
+func newTestFleet(t *testing.T) (hub *Daemon, agent *testAgent) {
+	t.Helper()
+	hub, srv := newTestHub(t)
+	agent = connectAgent(t, newTestDaemon(t, FleetConfig{Name: "agent"}), hub, srv, testJoinToken)
+	select {
+	case err := <-agent.done:
+		t.Fatalf("agent failed to connect: %v", err)
+	default:
+	}
+	return hub, agent
+}
+
+func testCommand(t *testing.T, action, name, host string, payload any) Command {
+	t.Helper()
+	req, err := protocol.NewRequest(action, name, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	return *req
+}
+
+// addTestService adds and starts a long running service on d.
+func addTestService(t *testing.T, d *Daemon, name string) {
+	t.Helper()
+	resp := d.HandleCommand(testAdmin, testCommand(t, "add", name, "", ServiceOptions{Exec: []string{"sleep", "300"}}))
+	if !resp.Success {
+		t.Fatalf("add %s: %s", name, resp.Message)
+	}
+	if resp = d.HandleCommand(testAdmin, testCommand(t, "start", name, "", nil)); !resp.Success {
+		t.Fatalf("start %s: %s", name, resp.Message)
+	}
+}
+
+func hostNames(t *testing.T, d *Daemon) []string {
+	t.Helper()
+	resp := d.HandleCommand(testAdmin, testCommand(t, "hosts", "", "", nil))
+	if !resp.Success {
+		t.Fatalf("hosts: %s", resp.Message)
+	}
+	var names []string
+	for _, h := range resp.Data.([]HostInfo) {
+		names = append(names, h.Name)
+	}
+	return names
+}
+
+func TestFleetJoin(t *testing.T) {
+	hub, srv := newTestHub(t)
+
+	rejected := connectAgent(t, newTestDaemon(t, FleetConfig{Name: "intruder"}), hub, srv, "wrong")
+	select {
+	case err := <-rejected.done:
+		if err == nil || !strings.Contains(err.Error(), ErrInvalidJoinToken.Error()) {
+			t.Errorf("connecting with a wrong token: got %v, want %q", err, ErrInvalidJoinToken)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connecting with a wrong token did not fail")
+	}
+	if got := strings.Join(hostNames(t, hub), ","); got != "hub" {
+		t.Errorf("hosts after a wrong token = %s, want hub", got)
+	}
+
+	connectAgent(t, newTestDaemon(t, FleetConfig{Name: "agent"}), hub, srv, testJoinToken)
+	if got := strings.Join(hostNames(t, hub), ","); got != "hub,agent" {
+		t.Errorf("hosts = %s, want hub,agent", got)
+	}
+}
+
+func TestFleetAuthorizeAgent(t *testing.T) {
+	hub, _ := newTestHub(t)
+	for _, name := range []string{"", "hub", protocol.AllHosts, "a/b", "a b"} {
+		if err := hub.AuthorizeAgent(testJoinToken, name); err == nil {
+			t.Errorf("agent name %q was accepted", name)
+		}
+	}
+	agent := newTestDaemon(t, FleetConfig{Name: "agent"})
+	if err := agent.AuthorizeAgent("", "other"); err != ErrFleetDisabled {
+		t.Errorf("agent accepted an agent: %v", err)
+	}
+}
+
+func TestFleetForward(t *testing.T) {
+	hub, agent := newTestFleet(t)
+	addTestService(t, agent.Daemon, "web-1")
+
+	resp := hub.HandleCommand(testAdmin, testCommand(t, "info", "web-1", "agent", nil))
+	if !resp.Success {
+		t.Fatalf("info on agent: %s", resp.Message)
+	}
+	if info := resp.Data.(ServiceInfo); info.Host != "agent" || info.Name != "web-1" || info.Status != "running" {
+		t.Errorf("info on agent = %s %s %s", info.Host, info.Name, info.Status)
+	}
+
+	if resp = hub.HandleCommand(testAdmin, testCommand(t, "stop", "web-1", "agent", nil)); !resp.Success {
+		t.Fatalf("stop on agent: %s", resp.Message)
+	}
+	resp = agent.HandleCommand(testAdmin, testCommand(t, "info", "web-1", "", nil))
+	if status := resp.Data.(ServiceInfo).Status; status != "stopped" {
+		t.Errorf("status on agent after stop = %s, want stopped", status)
+	}
+
+	if resp = hub.HandleCommand(testAdmin, testCommand(t, "info", "web-1", "", nil)); resp.Success {
+		t.Error("the hub answered for a service of the agent")
+	}
+	if resp = hub.HandleCommand(testAdmin, testCommand(t, "info", "web-1", "nowhere", nil)); resp.Code != CodeNotFound {
+		t.Errorf("info on an unknown host: got code %q, want %q", resp.Code, CodeNotFound)
+	}
+
+	viewer := &Caller{Name: "carol", Role: RoleViewer, Source: "test"}
+	if resp = hub.HandleCommand(viewer, testCommand(t, "start", "web-1", "agent", nil)); resp.Code != CodeForbidden {
+		t.Errorf("start on agent by a viewer: got code %q, want %q", resp.Code, CodeForbidden)
+	}
+}
+
+func TestFleetAllHosts(t *testing.T) {
+	hub, agent := newTestFleet(t)
+	addTestService(t, hub, "api")
+	addTestService(t, agent.Daemon, "web-1")
+
+	resp := hub.HandleCommand(testAdmin, testCommand(t, "list", "", protocol.AllHosts, nil))
+	if !resp.Success || resp.Message != "" {
+		t.Fatalf("list on all hosts: %v %s", resp.Success, resp.Message)
+	}
+	var got []string
+	for _, s := range resp.Data.([]ServiceInfo) {
+		got = append(got, s.Host+"/"+s.Name)
+	}
+	if strings.Join(got, ",") != "hub/api,agent/web-1" {
+		t.Errorf("list on all hosts = %v, want hub/api and agent/web-1", got)
+	}
+
+	resp = hub.HandleCommand(testAdmin, testCommand(t, "stop", "", protocol.AllHosts, BulkRequest{Pattern: "all"}))
+	if resp.Success || resp.Code != CodeInvalidArgument {
+		t.Errorf("stop on all hosts: got %v %q, want %q", resp.Success, resp.Code, CodeInvalidArgument)
+	}
+}
+
+func TestFleetAgentDisconnects(t *testing.T) {
+	hub, agent := newTestFleet(t)
+	addTestService(t, agent.Daemon, "web-1")
+
+	agent.conn.Close()
+	select {
+	case <-agent.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the agent kept serving a closed connection")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.fleet.agent("agent") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the hub kept the disconnected agent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := strings.Join(hostNames(t, hub), ","); got != "hub" {
+		t.Errorf("hosts after the agent disconnected = %s, want hub", got)
+	}
+	resp := hub.HandleCommand(testAdmin, testCommand(t, "info", "web-1", "agent", nil))
+	if resp.Code != CodeNotFound || !strings.Contains(resp.Message, "not connected") {
+		t.Errorf("info on the disconnected agent: got %q %s", resp.Code, resp.Message)
+	}
+	if resp = hub.HandleCommand(testAdmin, testCommand(t, "list", "", protocol.AllHosts, nil)); !resp.Success {
+		t.Errorf("list on all hosts without agents: %s", resp.Message)
+	}
+}
+
+func TestFleetBulkKeepsServiceGrants(t *testing.T) {
+	hub, agent := newTestFleet(t)
+	addTestService(t, agent.Daemon, "web-1")
+	addTestService(t, agent.Daemon, "db-1")
+
+	// stop all --host agent
+	alice := &Caller{Name: "alice", Role: RoleOperator, Services: []string{"web-*"}, Source: "test"}
+	resp := hub.HandleCommand(alice, testCommand(t, "stop", "", "agent", BulkRequest{Pattern: service.AllServices}))
+	if !resp.Success {
+		t.Fatalf("stop all on agent: %s", resp.Message)
+	}
+	var stopped []string
+	for _, r := range resp.Data.([]BulkResult) {
+		stopped = append(stopped, r.Name)
+	}
+	if strings.Join(stopped, ",") != "web-1" {
+		t.Errorf("stop all on agent by a user limited to web-* stopped %v, want web-1", stopped)
+	}
+
+	for name, want := range map[string]string{"web-1": "stopped", "db-1": "running"} {
+		resp = agent.HandleCommand(testAdmin, testCommand(t, "info", name, "", nil))
+		if status := resp.Data.(ServiceInfo).Status; status != want {
+			t.Errorf("status of %s on agent = %s, want %s", name, status, want)
+		}
+	}
+
+	resp = hub.HandleCommand(alice, testCommand(t, "stop", "", "agent", BulkRequest{Pattern: "db-*"}))
+	if resp.Success || resp.Code != CodeNotFound {
+		t.Errorf("stop db-* on agent by a user limited to web-*: got %v %q %s", resp.Success, resp.Code, resp.Message)
+	}
+}
+
+func TestFleetAgentStopsOnClose(t *testing.T) {
+	hub, srv := newTestHub(t)
+	agent := newTestDaemon(t, FleetConfig{Name: "agent", Hub: srv.URL, Token: testJoinToken})
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.fleet.agent("agent") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the agent did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	addTestService(t, agent, "web-1")
+
+	closeDaemon(t, agent)
+	if running("(*Daemon).runAgent") || running("(*Daemon).connectHub") {
+		t.Error("the agent kept running after Close")
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for hub.fleet.agent("agent") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the agent kept its connection to the hub after Close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,339 @@
+package gin
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tangthinker/controlman/internal/daemon"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// ServiceSpec is the body of PUT /api/v1/services/:name.
+type ServiceSpec struct {
+	// Exec is the executable and its arguments, run without a shell;
+	// Command is run by sh -c instead. Shell may be set with Command.
+	Exec    []string `json:"exec,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Shell   bool     `json:"shell,omitempty"`
+
+	Type         string         `json:"type,omitempty"`
+	Schedule     string         `json:"schedule,omitempty"`
+	Replicas     int            `json:"replicas,omitempty"`
+	PortTemplate string         `json:"port_template,omitempty"`
+	ReloadSignal string         `json:"reload_signal,omitempty"`
+	Hooks        *service.Hooks `json:"hooks,omitempty"`
+
+	// Labels replace those of the service; nil keeps them
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// BulkResponse answers the actions on the services chosen by a selector.
+type BulkResponse struct {
+	Message string              `json:"message"`
+	Results []daemon.BulkResult `json:"results"`
+}
+
+type LogsResponse struct {
+	Name string `json:"name"`
+	Logs string `json:"logs"`
+}
+
+// httpStatus maps the error code of a failed daemon response to an HTTP status.
+func httpStatus(resp daemon.Response) int {
+	switch resp.Code {
+	case daemon.CodeNotFound:
+		return http.StatusNotFound
+	case daemon.CodeInvalidArgument, daemon.CodeUnsupportedVersion:
+		return http.StatusBadRequest
+	case daemon.CodeAlreadyExists, daemon.CodeConflict:
+		return http.StatusConflict
+	case daemon.CodeForbidden:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(ctx *gin.Context, resp daemon.Response) {
+	code := resp.Code
+	if code == "" {
+		code = daemon.CodeInternal
+	}
+	ctx.JSON(httpStatus(resp), ErrorResponse{Error: resp.Message, Code: code})
+}
+
+func (c *Controller) ListServices(ctx *gin.Context) {
+	cmd := daemon.Command{Action: "list", Host: ctx.Query("host")}
+	if selector := ctx.Query("selector"); selector != "" {
+		cmd.Data, _ = json.Marshal(daemon.ListRequest{Selector: selector})
+	}
+	resp := c.daemon.HandleCommand(callerOf(ctx), cmd)
+	if !resp.Success {
+		writeError(ctx, resp)
+		return
+	}
+	ctx.JSON(http.StatusOK, resp.Data)
+}
+
+func (c *Controller) GetService(ctx *gin.Context) {
+	resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "info", Name: ctx.Param("name"), Host: ctx.Query("host")})
+	if !resp.Success {
+		writeError(ctx, resp)
+		return
+	}
+	ctx.JSON(http.StatusOK, resp.Data)
+}
+
+// PutService creates the service if it does not exist and updates it
+// otherwise. A changed replica count is applied by scaling the service.
+func (c *Controller) PutService(ctx *gin.Context) {
+	var spec ServiceSpec
+	if err := ctx.ShouldBindJSON(&spec); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: daemon.CodeInvalidArgument})
+		return
+	}
+	name := ctx.Param("name")
+
+	opts := daemon.ServiceOptions{
+		Exec:         spec.Exec,
+		Shell:        spec.Shell,
+		Hooks:        spec.Hooks,
+		Type:         spec.Type,
+		Schedule:     spec.Schedule,
+		PortTemplate: spec.PortTemplate,
+		ReloadSignal: spec.ReloadSignal,
+		Labels:       spec.Labels,
+	}
+
+	existing := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "info", Name: name, Host: ctx.Query("host")})
+	if !existing.Success && existing.Code != daemon.CodeNotFound {
+		writeError(ctx, existing)
+		return
+	}
+
+	if !existing.Success {
+		opts.Replicas = spec.Replicas
+		data, _ := json.Marshal(opts)
+		resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "add", Name: name, Command: spec.Command, Data: data, Host: ctx.Query("host")})
+		if !resp.Success {
+			writeError(ctx, resp)
+			return
+		}
+		c.respondWithService(ctx, http.StatusCreated, name)
+		return
+	}
+
+	// Edit merges labels: remove those left out of the spec
+	if info, ok := existing.Data.(daemon.ServiceInfo); ok && spec.Labels != nil {
+		opts.Labels = maps.Clone(spec.Labels)
+		for key := range info.Labels {
+			if _, keep := spec.Labels[key]; !keep {
+				opts.Labels[key] = ""
+			}
+		}
+	}
+	data, _ := json.Marshal(opts)
+	resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "edit", Name: name, Command: spec.Command, Data: data, Host: ctx.Query("host")})
+	if !resp.Success {
+		writeError(ctx, resp)
+		return
+	}
+
+	if info, ok := existing.Data.(daemon.ServiceInfo); ok && spec.Replicas > 0 && spec.Replicas != info.Replicas {
+		data, _ := json.Marshal(map[string]int{"replicas": spec.Replicas})
+		resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "scale", Name: name, Data: data, Host: ctx.Query("host")})
+		if !resp.Success {
+			writeError(ctx, resp)
+			return
+		}
+	}
+	c.respondWithService(ctx, http.StatusOK, name)
+}
+
+func (c *Controller) respondWithService(ctx *gin.Context, status int, name string) {
+	resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "info", Name: name, Host: ctx.Query("host")})
+	if !resp.Success {
+		writeError(ctx, resp)
+		return
+	}
+	ctx.JSON(status, resp.Data)
+}
+
+func (c *Controller) DeleteService(ctx *gin.Context) {
+	resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "delete", Name: ctx.Param("name"), Host: ctx.Query("host")})
+	if !resp.Success {
+		writeError(ctx, resp)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// ServiceAction returns a handler running a daemon action such as "start"
+// on the service named in the path.
+func (c *Controller) ServiceAction(action string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: action, Name: ctx.Param("name"), Host: ctx.Query("host")})
+		if !resp.Success {
+			writeError(ctx, resp)
+			return
+		}
+		ctx.JSON(http.StatusOK, MessageResponse{Message: resp.Message})
+	}
+}
+
+// BulkAction returns a handler running a daemon action such as "stop" on
+// every service matching the pattern and selector query parameters.
+func (c *Controller) BulkAction(action string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := daemon.BulkRequest{Pattern: ctx.Query("pattern"), Selector: ctx.Query("selector")}
+		if parallel := ctx.Query("parallel"); parallel != "" {
+			n, err := strconv.Atoi(parallel)
+			if err != nil || n < 0 {
+				ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "parallel must be a positive number", Code: daemon.CodeInvalidArgument})
+				return
+			}
+			req.Parallel = n
+		}
+		if dryRun := ctx.Query("dry_run"); dryRun != "" {
+			b, err := strconv.ParseBool(dryRun)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "dry_run must be true or false", Code: daemon.CodeInvalidArgument})
+				return
+			}
+			req.DryRun = b
+		}
+		data, _ := json.Marshal(req)
+		resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: action, Data: data, Host: ctx.Query("host")})
+		if !resp.Success {
+			writeError(ctx, resp)
+			return
+		}
+		results, _ := resp.Data.([]daemon.BulkResult)
+		ctx.JSON(http.StatusOK, BulkResponse{Message: resp.Message, Results: results})
+	}
+}
+
+func (c *Controller) GetLogs(ctx *gin.Context) {
+	name := ctx.Param("name")
+	resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "logs", Name: name, Host: ctx.Query("host")})
+	if !resp.Success {
+		writeError(ctx, resp)
+		return
+	}
+	logs, _ := resp.Data.(string)
+	ctx.JSON(http.StatusOK, LogsResponse{Name: name, Logs: logs})
+}
+
+// GetAudit returns audit log entries. since is either an RFC 3339 time or
+// a duration such as "1h" counted back from now.
+func (c *Controller) GetAudit(ctx *gin.Context) {
+	q := daemon.AuditQuery{Service: ctx.Query("service"), Actor: ctx.Query("actor")}
+	if since := ctx.Query("since"); since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			t := time.Now().Add(-d)
+			q.Since = &t
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			q.Since = &t
+		} else {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "since must be a duration or an RFC 3339 time", Code: daemon.CodeInvalidArgument})
+			return
+		}
+	}
+	if limit := ctx.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "limit must be a positive number", Code: daemon.CodeInvalidArgument})
+			return
+		}
+		q.Limit = n
+	}
+
+	data, _ := json.Marshal(q)
+	resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "audit", Data: data})
+	if !resp.Success {
+		writeError(ctx, resp)
+		return
+	}
+	ctx.JSON(http.StatusOK, resp.Data)
+}
+
+// How often an idle event stream sends a comment to keep proxies from
+// closing it
+const eventKeepAlive = 30 * time.Second
+
+// GetEvents streams service events as server-sent events until the client
+// disconnects. ?service= and ?event= (repeated or comma separated) filter
+// them.
+func (c *Controller) GetEvents(ctx *gin.Context) {
+	data, _ := json.Marshal(daemon.WatchRequest{
+		Services: queryList(ctx, "service"),
+		Events:   queryList(ctx, "event"),
+	})
+	sub, resp := c.daemon.Watch(callerOf(ctx), daemon.Command{Action: "watch", Data: data})
+	if sub == nil {
+		writeError(ctx, resp)
+		return
+	}
+	defer sub.Close()
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no") // nginx
+	ctx.Status(http.StatusOK)
+	ctx.Writer.WriteString(": watching\n\n")
+	ctx.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case <-keepAlive.C:
+			ctx.Writer.WriteString(": keep-alive\n\n")
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(ctx.Writer, "data: %s\n\n", data)
+		}
+		ctx.Writer.Flush()
+	}
+}
+
+// queryList returns the values of a repeated or comma separated parameter.
+func queryList(ctx *gin.Context, key string) []string {
+	var list []string
+	for _, v := range ctx.QueryArray(key) {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+func (c *Controller) OpenAPI(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "application/json", openAPISpec)
+}
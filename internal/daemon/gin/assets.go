@@ -0,0 +1,111 @@
+package gin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tangthinker/controlman/static"
+)
+
+// assets serves the web console embedded in the binary. Files in the
+// optional override directory take precedence, so single pages or images
+// can be customized without rebuilding.
+type assets struct {
+	embedded fs.FS
+	etags    map[string]string // embedded file -> ETag
+	override string
+}
+
+func newAssets(overrideDir string) (*assets, error) {
+	a := &assets{embedded: static.FS, etags: make(map[string]string), override: overrideDir}
+
+	err := fs.WalkDir(static.FS, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(static.FS, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		a.etags[name] = `"` + hex.EncodeToString(sum[:8]) + `"`
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to index embedded assets: %v", err)
+	}
+
+	if overrideDir != "" {
+		if info, err := os.Stat(overrideDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("static override directory %s does not exist", overrideDir)
+		}
+	}
+	return a, nil
+}
+
+// open returns the content, ETag and modification time of a file.
+func (a *assets) open(name string) ([]byte, string, time.Time, error) {
+	if a.override != "" {
+		file := filepath.Join(a.override, filepath.FromSlash(name))
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, "", time.Time{}, err
+			}
+			etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+			return data, etag, info.ModTime(), nil
+		}
+	}
+
+	etag, ok := a.etags[name]
+	if !ok {
+		return nil, "", time.Time{}, fs.ErrNotExist
+	}
+	data, err := fs.ReadFile(a.embedded, name)
+	return data, etag, time.Time{}, err
+}
+
+// serve writes a file with caching headers. Pages are revalidated on every
+// load so that an upgraded daemon is picked up at once; other assets may be
+// cached for an hour.
+func (a *assets) serve(ctx *gin.Context, name string) {
+	data, etag, modTime, err := a.open(name)
+	if err != nil {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	if strings.HasSuffix(name, ".html") {
+		ctx.Header("Cache-Control", "no-cache")
+	} else {
+		ctx.Header("Cache-Control", "public, max-age=3600")
+	}
+	ctx.Header("ETag", etag)
+	// ServeContent answers If-None-Match with 304 and sets Content-Type
+	http.ServeContent(ctx.Writer, ctx.Request, name, modTime, bytes.NewReader(data))
+}
+
+// File returns a handler serving a single file, e.g. a page.
+func (a *assets) File(name string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a.serve(ctx, name)
+	}
+}
+
+// Dir returns a handler serving the file named by the *filepath parameter.
+func (a *assets) Dir() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := path.Clean("/" + ctx.Param("filepath"))
+		a.serve(ctx, strings.TrimPrefix(name, "/"))
+	}
+}
@@ -1,29 +1,327 @@
 package gin
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tangthinker/controlman/internal/daemon"
 )
 
-type AuthParams struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+const (
+	SessionCookie     = "cm_session"
+	DefaultSessionTTL = 12 * time.Hour
+
+	// 在 loginWindow 内失败 maxLoginFailures 次后锁定 lockoutDuration
+	maxLoginFailures = 5
+	loginWindow      = 15 * time.Minute
+	lockoutDuration  = 15 * time.Minute
+)
+
+var errInvalidToken = errors.New("invalid session token")
+
+// sessionClaims is the payload of a session token.
+type sessionClaims struct {
+	User    string `json:"u"`
+	Key     string `json:"k,omitempty"` // session key of the user; see daemon.LookupSession
+	Expires int64  `json:"exp"`         // unix seconds
 }
 
-func MakeAuthMiddleware(authParams *AuthParams) gin.HandlerFunc {
-	if authParams == nil {
-		authParams = &AuthParams{
-			Username: "admin",
-			Password: "admin",
-		}
+// Sessions issues and verifies stateless session tokens of the form
+// base64(claims) "." base64(HMAC-SHA256(claims)).
+type Sessions struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewSessions(secret []byte, ttl time.Duration) *Sessions {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &Sessions{secret: secret, ttl: ttl}
+}
+
+func (s *Sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a new token for user and its expiry time. The token stays
+// valid while the session key of the user is key.
+func (s *Sessions) Issue(user, key string) (string, time.Time) {
+	expires := time.Now().Add(s.ttl)
+	claims, _ := json.Marshal(sessionClaims{User: user, Key: key, Expires: expires.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + s.sign(payload), expires
+}
+
+// Verify checks the signature and expiry of a token and returns its user
+// and the session key it was issued with.
+func (s *Sessions) Verify(token string) (user, key string, err error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return "", "", errInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", errInvalidToken
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(data, &claims); err != nil || claims.User == "" {
+		return "", "", errInvalidToken
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return "", "", errors.New("session expired")
+	}
+	return claims.User, claims.Key, nil
+}
+
+// sessionToken returns the bearer token of the request, falling back to
+// the session cookie set by the web console.
+func sessionToken(ctx *gin.Context) string {
+	if auth := ctx.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
 	}
+	token, _ := ctx.Cookie(SessionCookie)
+	return token
+}
+
+// clientSource describes where a request came from for logs and the audit log:
+// the peer of the connection, and the client it forwarded the request for
+// if it is a trusted proxy.
+func clientSource(ctx *gin.Context) string {
+	addr := ctx.Request.RemoteAddr
+	if addr == "" || addr == "@" {
+		return "http unix"
+	}
+	scheme := "http"
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+	peer := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		peer = host
+	}
+	// ClientIP only differs from the peer behind a trusted proxy
+	if client := ctx.ClientIP(); client != "" && client != peer {
+		return scheme + " " + client + " via " + peer
+	}
+	return scheme + " " + peer
+}
+
+// clientCertUser returns the common name of a verified client certificate.
+func clientCertUser(ctx *gin.Context) string {
+	state := ctx.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// MakeAuthMiddleware resolves the session, API key or client certificate
+// of the request to the caller on whose behalf its commands run. Removed
+// users and revoked keys lose access immediately.
+func MakeAuthMiddleware(d *daemon.Daemon, sessions *Sessions) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		if authParams.Username != ctx.GetHeader("Username") || authParams.Password != ctx.GetHeader("Password") {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		token := sessionToken(ctx)
+		if daemon.IsAPIKey(token) {
+			caller, err := d.AuthenticateAPIKey(token, clientSource(ctx))
+			if err != nil {
+				ctx.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unauthorized", Code: "unauthorized"})
+				ctx.Abort()
+				return
+			}
+			ctx.Set(callerKey, caller)
+			ctx.Next()
+			return
+		}
+
+		// 未携带令牌时，使用已验证的客户端证书（mTLS）中的 CN 作为用户名
+		source := clientSource(ctx)
+		var user *daemon.User
+		var err error
+		if name := clientCertUser(ctx); token != "" || name == "" {
+			var key string
+			if name, key, err = sessions.Verify(token); err == nil {
+				user, err = d.LookupSession(name, key)
+			}
+		} else {
+			source += " cert"
+			user, err = d.LookupUser(name)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unauthorized", Code: "unauthorized"})
 			ctx.Abort()
 			return
 		}
+		ctx.Set(callerKey, user.Caller(source))
 		ctx.Next()
 	}
 }
+
+const callerKey = "caller"
+
+func callerOf(ctx *gin.Context) *daemon.Caller {
+	return ctx.MustGet(callerKey).(*daemon.Caller)
+}
+
+// loginLimiter counts failed logins per client address and per username and
+// client address.
+type loginLimiter struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	locked   map[string]time.Time // key -> end of lockout
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		failures: make(map[string][]time.Time),
+		locked:   make(map[string]time.Time),
+	}
+}
+
+// retryAfter returns how long the keys are still locked out, or zero.
+func (l *loginLimiter) retryAfter(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var wait time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		until, ok := l.locked[key]
+		if !ok {
+			continue
+		}
+		if now.After(until) {
+			delete(l.locked, key)
+			continue
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func (l *loginLimiter) fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		recent := l.failures[key][:0]
+		for _, t := range l.failures[key] {
+			if now.Sub(t) < loginWindow {
+				recent = append(recent, t)
+			}
+		}
+		recent = append(recent, now)
+		if len(recent) >= maxLoginFailures {
+			l.locked[key] = now.Add(lockoutDuration)
+			delete(l.failures, key)
+			continue
+		}
+		l.failures[key] = recent
+	}
+}
+
+func (l *loginLimiter) succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+type LoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type LoginResponse struct {
+	Token     string    `json:"token"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Login checks the credentials and issues a session token, returned both
+// in the body (for API clients) and as an HttpOnly cookie (for the web console).
+func (c *Controller) Login(ctx *gin.Context) {
+	var req LoginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: daemon.CodeInvalidArgument})
+		return
+	}
+
+	// The username is limited per client too, so that failures from one
+	// client cannot lock the account out for everyone
+	keys := []string{"ip:" + ctx.ClientIP(), "user:" + req.Username + "@" + ctx.ClientIP()}
+	if wait := c.limiter.retryAfter(keys...); wait > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		ctx.JSON(http.StatusTooManyRequests, ErrorResponse{Error: "too many failed logins, try again later", Code: "locked"})
+		return
+	}
+
+	if err := c.daemon.Authenticate(req.Username, req.Password); err != nil {
+		if err == daemon.ErrInvalidCredentials {
+			c.limiter.fail(keys...)
+			ctx.JSON(http.StatusUnauthorized, ErrorResponse{Error: err.Error(), Code: "unauthorized"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error(), Code: daemon.CodeInternal})
+		return
+	}
+	c.limiter.succeed(keys...)
+
+	user, err := c.daemon.LookupUser(req.Username)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error(), Code: daemon.CodeInternal})
+		return
+	}
+
+	token, expires := c.sessions.Issue(user.Name, user.SessionKey)
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     c.cookiePath,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   ctx.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	ctx.JSON(http.StatusOK, LoginResponse{Token: token, Username: user.Name, Role: user.Role, ExpiresAt: expires})
+}
+
+// Logout clears the session cookie and ends every session of its user,
+// including the bearer tokens issued to API clients.
+func (c *Controller) Logout(ctx *gin.Context) {
+	if name, key, err := c.sessions.Verify(sessionToken(ctx)); err == nil {
+		if _, err := c.daemon.LookupSession(name, key); err == nil {
+			if err := c.daemon.EndSessions(name); err != nil {
+				ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error(), Code: daemon.CodeInternal})
+				return
+			}
+		}
+	}
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     c.cookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   ctx.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	ctx.Status(http.StatusNoContent)
+}
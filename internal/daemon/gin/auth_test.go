@@ -0,0 +1,142 @@
+package gin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tangthinker/controlman/internal/daemon"
+)
+
+func TestClientSource(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, tt := range []struct {
+		name    string
+		trusted []string
+		remote  string
+		forward string
+		want    string
+	}{
+		{"direct", nil, "192.0.2.1:4000", "", "http 192.0.2.1"},
+		{"forged header", nil, "192.0.2.1:4000", "10.1.1.1", "http 192.0.2.1"},
+		{"trusted proxy", []string{"192.0.2.1"}, "192.0.2.1:4000", "10.1.1.1", "http 10.1.1.1 via 192.0.2.1"},
+		{"untrusted proxy", []string{"192.0.2.0/30"}, "192.0.2.9:4000", "10.1.1.1", "http 192.0.2.9"},
+		{"unix socket", nil, "@", "10.1.1.1", "http unix"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ctx, engine := gin.CreateTestContext(w)
+			if err := engine.SetTrustedProxies(tt.trusted); err != nil {
+				t.Fatal(err)
+			}
+			ctx.Request = httptest.NewRequest("GET", "/", nil)
+			ctx.Request.RemoteAddr = tt.remote
+			if tt.forward != "" {
+				ctx.Request.Header.Set("X-Forwarded-For", tt.forward)
+			}
+			if got := clientSource(ctx); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestAPI returns the daemon behind a router with the API routes and a
+// function sending a request to the router from the client address remote.
+func newTestAPI(t *testing.T) (*daemon.Daemon, func(method, path, remote, token, body string) *httptest.ResponseRecorder) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("HOME", t.TempDir())
+	d, err := daemon.NewDaemon(&daemon.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := d.SetPassword("admin", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := d.SessionSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	if err := RegisterRoutes(router, d, NewSessions(secret, 0), daemon.APIConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return d, func(method, path, remote, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = remote + ":4000"
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+}
+
+func TestSessionsEnd(t *testing.T) {
+	d, do := newTestAPI(t)
+	login := func(password string) string {
+		t.Helper()
+		w := do("POST", "/api/v1/login", "192.0.2.1", "", `{"username": "admin", "password": "`+password+`"}`)
+		var resp LoginResponse
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+			t.Fatalf("login: %d %s", w.Code, w.Body)
+		}
+		return resp.Token
+	}
+	valid := func(token string) bool {
+		return do("GET", "/api/v1/services", "192.0.2.1", token, "").Code == http.StatusOK
+	}
+
+	first, second := login("secret"), login("secret")
+	if !valid(first) || !valid(second) {
+		t.Fatal("new sessions are not valid")
+	}
+	if w := do("POST", "/api/v1/logout", "192.0.2.1", first, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("logout: %d %s", w.Code, w.Body)
+	}
+	if valid(first) || valid(second) {
+		t.Error("sessions are still valid after logging out")
+	}
+
+	third := login("secret")
+	if !valid(third) {
+		t.Fatal("a session issued after logging out is not valid")
+	}
+	if err := d.SetPassword("admin", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if valid(third) {
+		t.Error("a session is still valid after changing the password")
+	}
+	if !valid(login("changed")) {
+		t.Error("a session issued with the new password is not valid")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	_, do := newTestAPI(t)
+	login := func(remote, password string) int {
+		return do("POST", "/api/v1/login", remote, "", `{"username": "admin", "password": "`+password+`"}`).Code
+	}
+
+	for i := 0; i < maxLoginFailures; i++ {
+		if code := login("192.0.2.1", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d: %d", i+1, code)
+		}
+	}
+	if code := login("192.0.2.1", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("login from the locked out client: %d, want %d", code, http.StatusTooManyRequests)
+	}
+	// Other clients can still log in as the same user
+	if code := login("192.0.2.2", "secret"); code != http.StatusOK {
+		t.Errorf("login from another client: %d, want %d", code, http.StatusOK)
+	}
+}
@@ -8,11 +8,14 @@ import (
 )
 
 type Controller struct {
-	daemon *daemon.Daemon
+	daemon     *daemon.Daemon
+	sessions   *Sessions
+	limiter    *loginLimiter
+	cookiePath string
 }
 
-func NewController(daemon *daemon.Daemon) *Controller {
-	return &Controller{daemon: daemon}
+func NewController(daemon *daemon.Daemon, sessions *Sessions, basePath string) *Controller {
+	return &Controller{daemon: daemon, sessions: sessions, limiter: newLoginLimiter(), cookiePath: basePath + "/"}
 }
 
 func (c *Controller) Command(ctx *gin.Context) {
@@ -22,6 +25,6 @@ func (c *Controller) Command(ctx *gin.Context) {
 		return
 	}
 
-	response := c.daemon.HandleCommand(cmd)
+	response := c.daemon.HandleCommand(callerOf(ctx), cmd)
 	ctx.JSON(http.StatusOK, response)
 }
@@ -0,0 +1,67 @@
+package gin
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tangthinker/controlman/internal/daemon"
+)
+
+// FleetConnect upgrades the connection of a fleet agent, authenticated by
+// the hub's join token, and sends commands to the agent over it until it
+// disconnects.
+func (c *Controller) FleetConnect(ctx *gin.Context) {
+	name := ctx.Query("name")
+	if err := c.daemon.AuthorizeAgent(sessionToken(ctx), name); err != nil {
+		switch {
+		case errors.Is(err, daemon.ErrFleetDisabled):
+			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error(), Code: daemon.CodeNotFound})
+		case errors.Is(err, daemon.ErrInvalidJoinToken):
+			ctx.JSON(http.StatusUnauthorized, ErrorResponse{Error: err.Error(), Code: daemon.CodeForbidden})
+		default:
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: daemon.CodeInvalidArgument})
+		}
+		return
+	}
+	if !strings.EqualFold(ctx.GetHeader("Upgrade"), daemon.FleetProtocol) {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "expected Upgrade: " + daemon.FleetProtocol, Code: daemon.CodeInvalidArgument})
+		return
+	}
+
+	conn, rw, err := ctx.Writer.Hijack()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error(), Code: daemon.CodeInternal})
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: " + daemon.FleetProtocol + "\r\nConnection: Upgrade\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	c.daemon.ServeAgent(name, ctx.ClientIP(), &hijackedConn{Conn: conn, r: rw.Reader})
+}
+
+// hijackedConn reads what the server had already buffered before the
+// connection itself.
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// GetHosts lists this host and the fleet agents connected to it.
+func (c *Controller) GetHosts(ctx *gin.Context) {
+	resp := c.daemon.HandleCommand(callerOf(ctx), daemon.Command{Action: "hosts"})
+	if !resp.Success {
+		writeError(ctx, resp)
+		return
+	}
+	ctx.JSON(http.StatusOK, resp.Data)
+}
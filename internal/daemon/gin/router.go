@@ -1,54 +1,203 @@
 package gin
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/tangthinker/controlman/internal/daemon"
 )
 
-func RegisterRoutes(router *gin.Engine, daemon *daemon.Daemon, authParams *AuthParams) {
-	authMiddleware := MakeAuthMiddleware(authParams)
-	controller := NewController(daemon)
+// How long Shutdown waits for in-flight requests
+const shutdownTimeout = 5 * time.Second
 
-	// 如果系统用户为root
-	prefix := "./"
-	if os.Getuid() == 0 {
-		prefix = "/root/.controlman"
+func RegisterRoutes(router *gin.Engine, daemon *daemon.Daemon, sessions *Sessions, cfg daemon.APIConfig) error {
+	basePath := cfg.NormalizedBasePath()
+	authMiddleware := MakeAuthMiddleware(daemon, sessions)
+	controller := NewController(daemon, sessions, basePath)
+
+	ui, err := newAssets(cfg.StaticDir)
+	if err != nil {
+		return err
 	}
-	router.Static("/assets", prefix+"/static")
-	router.StaticFile("/", prefix+"/static/login.html")
-	router.StaticFile("/dashboard", prefix+"/static/index.html")
-	router.StaticFile("/info", prefix+"/static/info.html")
+	base := router.Group(basePath)
+	base.GET("/assets/*filepath", ui.Dir())
+	base.GET("/", ui.File("login.html"))
+	base.GET("/dashboard", ui.File("index.html"))
+	base.GET("/info", ui.File("info.html"))
+	base.GET("/audit", ui.File("audit.html"))
+
+	// 兼容旧版客户端，失败时同样返回 200
+	base.POST("/command", authMiddleware, controller.Command)
+
+	base.GET("/api/v1/openapi.json", controller.OpenAPI)
+	base.POST("/api/v1/login", controller.Login)
+	base.POST("/api/v1/logout", controller.Logout)
+	// Agents authenticate with the fleet join token instead
+	base.GET("/api/v1/fleet/connect", controller.FleetConnect)
+	api := base.Group("/api/v1", authMiddleware)
+	api.GET("/services", controller.ListServices)
+	api.DELETE("/services", controller.BulkAction("delete"))
+	api.POST("/services/start", controller.BulkAction("start"))
+	api.POST("/services/stop", controller.BulkAction("stop"))
+	api.POST("/services/restart", controller.BulkAction("restart"))
+	api.GET("/services/:name", controller.GetService)
+	api.PUT("/services/:name", controller.PutService)
+	api.DELETE("/services/:name", controller.DeleteService)
+	api.POST("/services/:name/start", controller.ServiceAction("start"))
+	api.POST("/services/:name/stop", controller.ServiceAction("stop"))
+	api.POST("/services/:name/restart", controller.ServiceAction("restart"))
+	api.POST("/services/:name/reload", controller.ServiceAction("reload"))
+	api.GET("/services/:name/logs", controller.GetLogs)
+	api.GET("/audit", controller.GetAudit)
+	api.GET("/events", controller.GetEvents)
+	api.GET("/hosts", controller.GetHosts)
+	return nil
+}
+
+// ServerOptions configures the HTTP API server.
+type ServerOptions struct {
+	SessionTTL time.Duration
+	TLS        TLSOptions
+	Config     daemon.APIConfig
+}
 
-	router.POST("/command", authMiddleware, controller.Command)
+// Server is a running API server.
+type Server struct {
+	http  *http.Server
+	certs *certStore // nil without TLS
 }
 
-func StartServer(daemon *daemon.Daemon, authParams *AuthParams) {
-	go func() {
-		log.Println("Starting server on port 1984")
-
-		homeDir, err := os.UserHomeDir()
-		if err == nil {
-			logFilePath := filepath.Join(homeDir, ".controlman", "controlman-api.log")
-			logFile, openErr := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-			if openErr == nil {
-				// Remove os.Stdout/Stderr to stop writing logs to terminal
-				gin.DefaultWriter = logFile
-				gin.DefaultErrorWriter = logFile
+// ReloadTLS reads the certificate, key and client CA again. Connections
+// already established keep their old certificate.
+func (s *Server) ReloadTLS() error {
+	if s.certs == nil {
+		return nil
+	}
+	return s.certs.load()
+}
+
+// Shutdown stops accepting connections and waits a few seconds for
+// in-flight requests to finish.
+func (s *Server) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.http.Shutdown(ctx)
+}
+
+// StartServer opens the configured listeners and serves the API on them in
+// the background. Failing to bind any of them is an error.
+func StartServer(daemon *daemon.Daemon, opts ServerOptions) (*Server, error) {
+	secret, err := daemon.SessionSecret()
+	if err != nil {
+		return nil, err
+	}
+	sessions := NewSessions(secret, opts.SessionTTL)
+
+	// Long-lived requests such as event streams end when the server shuts down
+	baseCtx, cancel := context.WithCancel(context.Background())
+	server := &Server{http: &http.Server{BaseContext: func(net.Listener) context.Context { return baseCtx }}}
+	server.http.RegisterOnShutdown(cancel)
+	if opts.TLS.Enabled {
+		server.certs, err = newCertStore(opts.TLS)
+		if err != nil {
+			return nil, err
+		}
+		server.http.TLSConfig = server.certs.tlsConfig()
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err == nil {
+		logFilePath := filepath.Join(homeDir, ".controlman", "controlman-api.log")
+		logFile, openErr := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if openErr == nil {
+			// Remove os.Stdout/Stderr to stop writing logs to terminal
+			gin.DefaultWriter = logFile
+			gin.DefaultErrorWriter = logFile
+		} else {
+			log.Printf("Failed to open log file: %v, using stdout only", openErr)
+		}
+	} else {
+		log.Printf("Failed to get home directory: %v, using stdout only", err)
+	}
+
+	router := gin.Default()
+	// ClientIP, which the login lockout is keyed on, only believes
+	// X-Forwarded-For from the configured proxies
+	if err := router.SetTrustedProxies(opts.Config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid api trusted proxies: %v", err)
+	}
+	if err := RegisterRoutes(router, daemon, sessions, opts.Config); err != nil {
+		return nil, err
+	}
+	server.http.Handler = router
+
+	listeners, err := listen(opts.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Serve sets up TLSConfig for HTTP/2 itself, so decide on TLS up front
+	useTLS := server.certs != nil
+	for _, l := range listeners {
+		log.Printf("Starting server on %s%s", l.Addr(), opts.Config.NormalizedBasePath())
+		go func(l net.Listener) {
+			var runErr error
+			if useTLS {
+				runErr = server.http.ServeTLS(l, "", "")
 			} else {
-				log.Printf("Failed to open log file: %v, using stdout only", openErr)
+				runErr = server.http.Serve(l)
 			}
-		} else {
-			log.Printf("Failed to get home directory: %v, using stdout only", err)
+			if runErr != nil && !errors.Is(runErr, http.ErrServerClosed) {
+				log.Printf("Server on %s failed: %v", l.Addr(), runErr)
+			}
+		}(l)
+	}
+	return server, nil
+}
+
+// listen opens the TCP and unix socket listeners of the config.
+func listen(cfg daemon.APIConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
 		}
+	}
 
-		router := gin.Default()
-		RegisterRoutes(router, daemon, authParams)
-		if runErr := router.Run(":1984"); runErr != nil {
-			log.Printf("Failed to start server: %v", runErr)
+	for _, addr := range cfg.ListenAddrs() {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeAll()
+			return nil, err
 		}
-	}()
+		listeners = append(listeners, l)
+	}
+
+	if cfg.Socket != "" {
+		// 清理上次未正常退出时遗留的 socket 文件
+		if err := os.Remove(cfg.Socket); err != nil && !os.IsNotExist(err) {
+			closeAll()
+			return nil, err
+		}
+		l, err := net.Listen("unix", cfg.Socket)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if err := os.Chmod(cfg.Socket, 0660); err != nil {
+			l.Close()
+			closeAll()
+			return nil, fmt.Errorf("failed to set permissions of %s: %v", cfg.Socket, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
 }
@@ -0,0 +1,198 @@
+package gin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Validity of the generated self-signed certificate
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// TLSOptions configures HTTPS for the API. Without CertFile and KeyFile a
+// self-signed certificate is generated in ~/.controlman/tls. With
+// ClientCAFile, clients presenting a certificate signed by that CA are
+// logged in as the user named by the certificate's common name.
+type TLSOptions struct {
+	Enabled      bool
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// certStore holds the current certificate and client CA pool so that they
+// can be replaced without restarting the listener.
+type certStore struct {
+	opts TLSOptions
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertStore(opts TLSOptions) (*certStore, error) {
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("both a TLS certificate and key are required")
+	}
+	s := &certStore{opts: opts}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the certificate, key and client CA from disk, generating the
+// self-signed certificate first if needed.
+func (s *certStore) load() error {
+	certFile, keyFile := s.opts.CertFile, s.opts.KeyFile
+	if certFile == "" {
+		var err error
+		certFile, keyFile, err = ensureSelfSigned()
+		if err != nil {
+			return fmt.Errorf("failed to generate self-signed certificate: %v", err)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	var pool *x509.CertPool
+	if s.opts.ClientCAFile != "" {
+		data, err := os.ReadFile(s.opts.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", s.opts.ClientCAFile)
+		}
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.clientCAs = pool
+	s.mu.Unlock()
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		sum := sha256.Sum256(leaf.Raw)
+		log.Printf("Loaded TLS certificate %s (expires %s, sha256 %s)", certFile, leaf.NotAfter.Format(time.RFC3339), hex.EncodeToString(sum[:]))
+	}
+	return nil
+}
+
+// tlsConfig returns a config that picks up reloaded certificates for new
+// connections. Client certificates are optional so that password and API
+// key logins keep working.
+func (s *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+			}
+			if s.clientCAs != nil {
+				cfg.ClientCAs = s.clientCAs
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ensureSelfSigned returns the paths of the self-signed certificate in
+// ~/.controlman/tls, creating it if it does not exist or has expired.
+func ensureSelfSigned() (string, string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	dir := filepath.Join(homeDir, ".controlman", "tls")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().Before(leaf.NotAfter) {
+			return certFile, keyFile, nil
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "controlman", Organization: []string{"controlman"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return "", "", err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return "", "", err
+	}
+	log.Printf("Generated self-signed TLS certificate in %s", dir)
+	return certFile, keyFile, nil
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+type (
+	ServiceInfo  = protocol.ServiceInfo
+	InstanceInfo = protocol.InstanceInfo
+)
+
+func (d *Daemon) serviceInfo(s *service.Service, detail bool) ServiceInfo {
+	cpu, mem, _ := s.GetStats()
+	nextRun, lastRun := d.jobInfo(s)
+	d.mu.Lock()
+	restarts := d.restarts[s.Name]
+	d.mu.Unlock()
+
+	info := ServiceInfo{
+		Name:      s.Name,
+		Status:    s.Status,
+		PID:       s.PID,
+		CPU:       cpu,
+		Memory:    mem,
+		CreatedAt: s.CreatedAt.Format(time.RFC3339),
+		LastStart: s.LastStarted.Format(time.RFC3339),
+		Command:   s.CommandLine(),
+		Replicas:  s.DesiredInstances(),
+		Ready:     s.RunningInstances(),
+		Restarts:  restarts,
+		Labels:    s.Labels,
+		Exec:      s.Exec,
+		Type:      serviceType(s),
+		Schedule:  s.Schedule,
+		NextRun:   nextRun,
+		LastRun:   lastRun,
+	}
+	if !detail {
+		return info
+	}
+
+	info.LogFile = s.LogFile
+	info.Hooks = s.Hooks
+	info.Instances = instanceInfo(s)
+	info.PortTemplate = s.PortTemplate
+	info.ReloadSignal = reloadSignal(s)
+	return info
+}
+
+func instanceInfo(s *service.Service) []InstanceInfo {
+	if !s.IsReplicated() {
+		return nil
+	}
+	instances := make([]InstanceInfo, 0, len(s.Instances))
+	for _, inst := range s.Instances {
+		pid := inst.PID
+		if !inst.IsRunning() {
+			pid = 0
+		}
+		instances = append(instances, InstanceInfo{
+			Index:     inst.Index,
+			PID:       pid,
+			Port:      inst.Port,
+			Running:   pid != 0,
+			LastStart: inst.LastStarted.Format(time.RFC3339),
+			LogFile:   inst.LogFile,
+		})
+	}
+	return instances
+}
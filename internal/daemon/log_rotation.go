@@ -14,11 +14,19 @@ import (
 func (d *Daemon) StartLogRotationRoutine() {
 	// Check every hour
 	ticker := time.NewTicker(1 * time.Hour)
+	d.background.Add(1)
 	go func() {
+		defer d.background.Done()
+		defer ticker.Stop()
 		// Perform an initial check on startup
 		d.performLogRotation()
-		for range ticker.C {
-			d.performLogRotation()
+		for {
+			select {
+			case <-ticker.C:
+				d.performLogRotation()
+			case <-d.closed:
+				return
+			}
 		}
 	}()
 }
@@ -31,41 +39,47 @@ func (d *Daemon) performLogRotation() {
 	}
 
 	for _, s := range services {
-		// Skip if log file doesn't exist
-		info, err := os.Stat(s.LogFile)
-		if os.IsNotExist(err) {
-			continue
+		for _, logFile := range s.LogFiles() {
+			rotateLogFile(s.Name, logFile)
 		}
 
-		// Check if rotation is needed (if log file was modified before today)
-		lastModDate := info.ModTime().Format("2006-01-02")
-		today := time.Now().Format("2006-01-02")
+		// 3. Clean old logs (keep 7 days)
+		d.cleanOldLogs(filepath.Dir(s.LogFile), 14)
+	}
+}
 
-		if lastModDate != today {
-			archiveFile := s.LogFile + "." + lastModDate
+func rotateLogFile(name, logFile string) {
+	// Skip if log file doesn't exist
+	info, err := os.Stat(logFile)
+	if err != nil {
+		return
+	}
 
-			// Avoid overwriting existing archive if rotation runs multiple times
-			if _, err := os.Stat(archiveFile); err == nil {
-				continue
-			}
+	// Check if rotation is needed (if log file was modified before today)
+	lastModDate := info.ModTime().Format("2006-01-02")
+	today := time.Now().Format("2006-01-02")
 
-			// 1. Copy
-			if err := copyFile(s.LogFile, archiveFile); err != nil {
-				log.Printf("LogRotation: Failed to copy log for %s: %v", s.Name, err)
-				continue
-			}
+	if lastModDate != today {
+		archiveFile := logFile + "." + lastModDate
 
-			// 2. Truncate (clear original file)
-			if err := os.Truncate(s.LogFile, 0); err != nil {
-				log.Printf("LogRotation: Failed to truncate log for %s: %v", s.Name, err)
-				continue
-			}
+		// Avoid overwriting existing archive if rotation runs multiple times
+		if _, err := os.Stat(archiveFile); err == nil {
+			return
+		}
 
-			log.Printf("LogRotation: Rotated log for %s to %s", s.Name, archiveFile)
+		// 1. Copy
+		if err := copyFile(logFile, archiveFile); err != nil {
+			log.Printf("LogRotation: Failed to copy log for %s: %v", name, err)
+			return
 		}
 
-		// 3. Clean old logs (keep 7 days)
-		d.cleanOldLogs(filepath.Dir(s.LogFile), 14)
+		// 2. Truncate (clear original file)
+		if err := os.Truncate(logFile, 0); err != nil {
+			log.Printf("LogRotation: Failed to truncate log for %s: %v", name, err)
+			return
+		}
+
+		log.Printf("LogRotation: Rotated log for %s to %s", name, archiveFile)
 	}
 }
 
@@ -83,17 +97,14 @@ func (d *Daemon) cleanOldLogs(dir string, daysRetain int) {
 		}
 
 		name := entry.Name()
-		// Expected format: service.log.2023-11-29
-		if !strings.Contains(name, "service.log.") {
+		// Expected format: service.log.2023-11-29 or service-2.log.2023-11-29
+		idx := strings.LastIndex(name, ".log.")
+		if !strings.HasPrefix(name, "service") || idx < 0 {
 			continue
 		}
 
 		// Extract date part
-		parts := strings.Split(name, "service.log.")
-		if len(parts) < 2 {
-			continue
-		}
-		dateStr := parts[1]
+		dateStr := name[idx+len(".log."):]
 
 		fileDate, err := time.Parse("2006-01-02", dateStr)
 		if err != nil {
@@ -0,0 +1,255 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Sink delivers lifecycle events to an external system.
+type Sink interface {
+	Name() string
+	Matches(e Event) bool
+	Send(ctx context.Context, e Event) error
+}
+
+func (f SinkFilter) Matches(e Event) bool {
+	if stateEvents[e.Type] && !slices.Contains(f.Events, e.Type) {
+		return false
+	}
+	return matchesAny(f.Events, e.Type) && matchesAny(f.Services, e.Service)
+}
+
+func matchesAny(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == v || item == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSinks builds the sinks described by cfg.
+func NewSinks(cfg NotificationConfig) ([]Sink, error) {
+	var sinks []Sink
+	for i, c := range cfg.Webhooks {
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhook #%d: url is required", i+1)
+		}
+		if c.Retries != nil && *c.Retries < 0 {
+			return nil, fmt.Errorf("webhook #%d: retries must not be negative", i+1)
+		}
+		sinks = append(sinks, &webhookSink{cfg: c, client: &http.Client{Timeout: c.Timeout.Or(10 * time.Second)}, backoff: time.Second})
+	}
+	for i, c := range cfg.Exec {
+		if c.Command == "" {
+			return nil, fmt.Errorf("exec hook #%d: command is required", i+1)
+		}
+		sinks = append(sinks, &execSink{cfg: c})
+	}
+	for i, c := range cfg.Email {
+		if c.Addr == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("email #%d: addr, from and to are required", i+1)
+		}
+		sinks = append(sinks, &emailSink{cfg: c})
+	}
+	return sinks, nil
+}
+
+// startNotifier forwards every published event to the matching sinks.
+func (d *Daemon) startNotifier(sinks []Sink) {
+	if len(sinks) == 0 {
+		return
+	}
+	events, _ := d.events.subscribe(256)
+	go func() {
+		for e := range events {
+			for _, sink := range sinks {
+				if !sink.Matches(e) {
+					continue
+				}
+				// Deliver asynchronously so a slow sink doesn't delay the others
+				go func(sink Sink, e Event) {
+					ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+					defer cancel()
+					if err := sink.Send(ctx, e); err != nil {
+						log.Printf("Notify: %s failed for %s event of %s: %v", sink.Name(), e.Type, e.Service, err)
+					}
+				}(sink, e)
+			}
+		}
+	}()
+}
+
+// webhookSink POSTs the event as JSON, retrying with exponential backoff.
+type webhookSink struct {
+	cfg     WebhookSinkConfig
+	client  *http.Client
+	backoff time.Duration // wait before the first retry, doubled for each
+}
+
+func (w *webhookSink) Name() string         { return "webhook " + w.cfg.URL }
+func (w *webhookSink) Matches(e Event) bool { return w.cfg.Matches(e) }
+
+func (w *webhookSink) Send(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	retries := defaultWebhookRetries
+	if w.cfg.Retries != nil {
+		retries = *w.cfg.Retries
+	}
+
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *webhookSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "controlman")
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// execSink runs a local command with the event in its environment and on stdin.
+type execSink struct {
+	cfg ExecSinkConfig
+}
+
+func (x *execSink) Name() string         { return "exec " + x.cfg.Command }
+func (x *execSink) Matches(e Event) bool { return x.cfg.Matches(e) }
+
+func (x *execSink) Send(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	timeout := x.cfg.Timeout.Or(30 * time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", x.cfg.Command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"CONTROLMAN_EVENT="+e.Type,
+		"CONTROLMAN_SERVICE="+e.Service,
+		"CONTROLMAN_PID="+strconv.Itoa(e.PID),
+		"CONTROLMAN_STATUS="+e.Status,
+		"CONTROLMAN_MESSAGE="+e.Message,
+		"CONTROLMAN_HOST="+e.Host,
+		"CONTROLMAN_TIME="+e.Time.Format(time.RFC3339),
+	)
+
+	// Run the command in its own process group so a timeout kills everything
+	// it spawned, including processes that keep its output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// emailSink sends a plain-text mail through an SMTP server, usually the local MTA.
+type emailSink struct {
+	cfg EmailSinkConfig
+}
+
+func (m *emailSink) Name() string         { return "email " + m.cfg.Addr }
+func (m *emailSink) Matches(e Event) bool { return m.cfg.Matches(e) }
+
+func (m *emailSink) Send(ctx context.Context, e Event) error {
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		host := m.cfg.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.cfg.To, ", "))
+	// Names stored by earlier versions may hold any character; encoding the
+	// subject keeps line breaks in them from starting new headers
+	subject := fmt.Sprintf("[controlman] %s: %s on %s", e.Service, e.Type, e.Host)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Service: %s\r\n", e.Service)
+	fmt.Fprintf(&msg, "Event:   %s\r\n", e.Type)
+	fmt.Fprintf(&msg, "Status:  %s\r\n", e.Status)
+	fmt.Fprintf(&msg, "PID:     %d\r\n", e.PID)
+	fmt.Fprintf(&msg, "Host:    %s\r\n", e.Host)
+	fmt.Fprintf(&msg, "Time:    %s\r\n", e.Time.Format(time.RFC3339))
+	if e.Message != "" {
+		fmt.Fprintf(&msg, "\r\n%s\r\n", e.Message)
+	}
+
+	// smtp.SendMail has no context support; run it in the background and
+	// give up waiting when ctx expires.
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.cfg.Addr, auth, m.cfg.From, m.cfg.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
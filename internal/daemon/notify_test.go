@@ -0,0 +1,329 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testEvent() Event {
+	return Event{
+		Type:    EventCrash,
+		Service: "web",
+		PID:     42,
+		Status:  "failed",
+		Message: "exit status 1",
+		Host:    "web-1",
+		Time:    time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func newTestWebhook(t *testing.T, url string, retries *int) *webhookSink {
+	t.Helper()
+	sinks, err := NewSinks(NotificationConfig{Webhooks: []WebhookSinkConfig{{
+		URL:     url,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Retries: retries,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sinks[0].(*webhookSink)
+	w.backoff = time.Millisecond
+	return w
+}
+
+func TestWebhookDelivers(t *testing.T) {
+	var got struct {
+		method, contentType, auth string
+		body                      map[string]any
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.method = r.Method
+		got.contentType = r.Header.Get("Content-Type")
+		got.auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got.body); err != nil {
+			t.Errorf("decoding body: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	if err := newTestWebhook(t, srv.URL, nil).Send(context.Background(), testEvent()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got.method != http.MethodPost || got.contentType != "application/json" || got.auth != "Bearer secret" {
+		t.Errorf("got %s with Content-Type %q and Authorization %q", got.method, got.contentType, got.auth)
+	}
+	want := map[string]any{
+		"type":    "crash",
+		"service": "web",
+		"pid":     float64(42),
+		"status":  "failed",
+		"message": "exit status 1",
+		"host":    "web-1",
+		"time":    "2025-01-02T03:04:05Z",
+	}
+	for key, value := range want {
+		if got.body[key] != value {
+			t.Errorf("payload %s = %v, want %v", key, got.body[key], value)
+		}
+	}
+	if len(got.body) != len(want) {
+		t.Errorf("payload has fields %v, want %v", got.body, want)
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	if err := newTestWebhook(t, srv.URL, nil).Send(context.Background(), testEvent()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("got %d attempts, want 3", n)
+	}
+}
+
+func TestWebhookRetryLimit(t *testing.T) {
+	for _, tt := range []struct {
+		retries *int
+		want    int32
+	}{
+		{nil, 4},
+		{new(int), 1},
+		{ptr(1), 2},
+	} {
+		var attempts atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+
+		err := newTestWebhook(t, srv.URL, tt.retries).Send(context.Background(), testEvent())
+		srv.Close()
+		if err == nil || !strings.Contains(err.Error(), "500") {
+			t.Errorf("retries %v: got error %v, want the 500 status", tt.retries, err)
+		}
+		if n := attempts.Load(); n != tt.want {
+			t.Errorf("retries %v: got %d attempts, want %d", tt.retries, n, tt.want)
+		}
+	}
+}
+
+func TestWebhookRejectsNegativeRetries(t *testing.T) {
+	_, err := NewSinks(NotificationConfig{Webhooks: []WebhookSinkConfig{{URL: "http://localhost", Retries: ptr(-1)}}})
+	if err == nil {
+		t.Error("got no error for negative retries")
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// smtpServer is a minimal SMTP server that records the mails it receives.
+type smtpServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	mails []smtpMail
+}
+
+type smtpMail struct {
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 localhost ESMTP")
+	var mail smtpMail
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			mail.from = strings.Trim(strings.TrimPrefix(line[len("MAIL "):], "FROM:"), "<>")
+			reply("250 OK")
+		case "RCPT":
+			mail.to = append(mail.to, strings.Trim(strings.TrimPrefix(line[len("RCPT "):], "TO:"), "<>"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			mail.data = data.String()
+			s.mu.Lock()
+			s.mails = append(s.mails, mail)
+			s.mu.Unlock()
+			mail = smtpMail{}
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func newTestEmail(t *testing.T, srv *smtpServer) Sink {
+	t.Helper()
+	sinks, err := NewSinks(NotificationConfig{Email: []EmailSinkConfig{{
+		Addr: srv.ln.Addr().String(),
+		From: "controlman@localhost",
+		To:   []string{"ops@example.com", "dev@example.com"},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sinks[0]
+}
+
+func TestEmailDelivers(t *testing.T) {
+	srv := newSMTPServer(t)
+	if err := newTestEmail(t, srv).Send(context.Background(), testEvent()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.mails) != 1 {
+		t.Fatalf("got %d mails, want 1", len(srv.mails))
+	}
+	mail := srv.mails[0]
+	if mail.from != "controlman@localhost" || strings.Join(mail.to, ",") != "ops@example.com,dev@example.com" {
+		t.Errorf("got mail from %q to %v", mail.from, mail.to)
+	}
+	for _, want := range []string{
+		"Subject: [controlman] web: crash on web-1\r\n",
+		"To: ops@example.com, dev@example.com\r\n",
+		"Event:   crash\r\n",
+		"PID:     42\r\n",
+		"exit status 1\r\n",
+	} {
+		if !strings.Contains(mail.data, want) {
+			t.Errorf("mail lacks %q:\n%s", want, mail.data)
+		}
+	}
+}
+
+func TestEmailEncodesSubject(t *testing.T) {
+	srv := newSMTPServer(t)
+	e := testEvent()
+	e.Service = "web\r\nBcc: intruder@example.com"
+	if err := newTestEmail(t, srv).Send(context.Background(), e); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.mails) != 1 {
+		t.Fatalf("got %d mails, want 1", len(srv.mails))
+	}
+
+	headers, _, _ := strings.Cut(srv.mails[0].data, "\r\n\r\n")
+	var subject string
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Errorf("the service name added a header:\n%s", headers)
+		}
+		if v, ok := strings.CutPrefix(line, "Subject: "); ok {
+			subject = v
+		}
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+	if want := "[controlman] " + e.Service + ": crash on web-1"; err != nil || decoded != want {
+		t.Errorf("subject %q decodes to %q, %v; want %q", subject, decoded, err, want)
+	}
+}
+
+func TestExecDelivers(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "event")
+	sinks, err := NewSinks(NotificationConfig{Exec: []ExecSinkConfig{{
+		Command: `echo "$CONTROLMAN_EVENT $CONTROLMAN_SERVICE" > ` + out + `; cat >> ` + out,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sinks[0].Send(context.Background(), testEvent()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	data, _ := os.ReadFile(out)
+	if !strings.HasPrefix(string(data), "crash web\n{") || !strings.Contains(string(data), `"service":"web"`) {
+		t.Errorf("the command got:\n%s", data)
+	}
+}
+
+func TestExecTimesOut(t *testing.T) {
+	// The background sleep keeps the output of the command open after the
+	// shell is killed
+	sinks, err := NewSinks(NotificationConfig{Exec: []ExecSinkConfig{{
+		Command: "sleep 300 & sleep 300",
+		Timeout: Duration(100 * time.Millisecond),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = sinks[0].Send(context.Background(), testEvent())
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Errorf("Send = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send returned after %s", elapsed)
+	}
+}
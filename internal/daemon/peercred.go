@@ -0,0 +1,224 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// errPeerCredUnsupported is returned by peerCredentials on systems where
+// the daemon cannot tell who is connected. It then relies on the socket
+// file permissions alone.
+var errPeerCredUnsupported = errors.New("peer credentials are not supported on this system")
+
+// peerCred identifies the process on the other end of the command socket.
+type peerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+func (p peerCred) String() string {
+	name := "uid=" + strconv.FormatUint(uint64(p.UID), 10)
+	if u, err := user.LookupId(strconv.FormatUint(uint64(p.UID), 10)); err == nil {
+		name += "(" + u.Username + ")"
+	}
+	return fmt.Sprintf("%s gid=%d pid=%d", name, p.GID, p.PID)
+}
+
+// socketRule is a SocketAccess with the user or group resolved to an id.
+type socketRule struct {
+	uid, gid *uint32
+	role     string
+	services []string
+}
+
+// socketPolicy decides which local users may use the command socket.
+type socketPolicy struct {
+	mode  os.FileMode
+	gid   int // -1 to keep the daemon's group
+	rules []socketRule
+}
+
+func (c SocketConfig) validate() error {
+	_, err := c.policy()
+	return err
+}
+
+// policy resolves the user and group names of the config.
+func (c SocketConfig) policy() (*socketPolicy, error) {
+	p := &socketPolicy{mode: 0600, gid: -1}
+	if c.Group != "" {
+		gid, err := lookupGroupID(c.Group)
+		if err != nil {
+			return nil, fmt.Errorf("socket group: %v", err)
+		}
+		p.gid = int(gid)
+		p.mode = 0660
+	}
+	if c.Mode != "" {
+		mode, err := strconv.ParseUint(c.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid socket mode %q", c.Mode)
+		}
+		p.mode = os.FileMode(mode)
+	}
+
+	for _, a := range c.Access {
+		rule := socketRule{role: a.Role, services: a.Services}
+		if rule.role == "" {
+			rule.role = RoleViewer
+		}
+		if err := validateGrants(rule.role, rule.services); err != nil {
+			return nil, fmt.Errorf("socket access: %v", err)
+		}
+		switch {
+		case a.User != "" && a.Group != "":
+			return nil, errors.New("socket access entries name either a user or a group")
+		case a.User != "":
+			uid, err := lookupUserID(a.User)
+			if err != nil {
+				return nil, fmt.Errorf("socket access: %v", err)
+			}
+			rule.uid = &uid
+		case a.Group != "":
+			gid, err := lookupGroupID(a.Group)
+			if err != nil {
+				return nil, fmt.Errorf("socket access: %v", err)
+			}
+			rule.gid = &gid
+		default:
+			return nil, errors.New("socket access entries need a user or a group")
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+func lookupUserID(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(id), err
+}
+
+func lookupGroupID(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(id), err
+}
+
+// listen creates the command socket at path with the mode and group of
+// the policy. The socket is bound in a private directory and moved into
+// place once its permissions are set, so that it never exists with the
+// looser ones of the umask.
+func (p *socketPolicy) listen(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// Closing the listener would remove the name it was bound to, not path
+	listener.SetUnlinkOnClose(false)
+	if err := p.apply(tmp); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// apply sets the mode and group of the socket file.
+func (p *socketPolicy) apply(path string) error {
+	if p.gid >= 0 {
+		if err := os.Chown(path, -1, p.gid); err != nil {
+			return fmt.Errorf("failed to set group of %s: %v", path, err)
+		}
+	}
+	if err := os.Chmod(path, p.mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %v", path, err)
+	}
+	return nil
+}
+
+// caller returns the caller a peer acts as. The daemon's own user and root
+// are admins; other users need a matching access rule, checked by uid first
+// and then by their primary and supplementary groups. Peers without a rule
+// get a caller without a role, whose commands are all denied.
+func (p *socketPolicy) caller(peer peerCred) *Caller {
+	source := "socket " + peer.String()
+	if peer.UID == 0 || int(peer.UID) == os.Getuid() {
+		c := localCaller()
+		if u, err := user.LookupId(strconv.FormatUint(uint64(peer.UID), 10)); err == nil {
+			c.Name = u.Username
+		}
+		c.Source = source
+		return c
+	}
+
+	name := "uid:" + strconv.FormatUint(uint64(peer.UID), 10)
+	groups := map[uint32]bool{peer.GID: true}
+	if u, err := user.LookupId(strconv.FormatUint(uint64(peer.UID), 10)); err == nil {
+		name = u.Username
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+					groups[uint32(gid)] = true
+				}
+			}
+		}
+	}
+
+	caller := &Caller{Name: name, Source: source}
+	for _, rule := range p.rules {
+		if rule.uid != nil && *rule.uid == peer.UID {
+			caller.Role, caller.Services = rule.role, rule.services
+			return caller
+		}
+	}
+	for _, rule := range p.rules {
+		if rule.gid != nil && groups[*rule.gid] {
+			caller.Role, caller.Services = rule.role, rule.services
+			return caller
+		}
+	}
+	return caller
+}
+
+// connCaller identifies the peer of a socket connection.
+func (d *Daemon) connCaller(conn net.Conn) *Caller {
+	peer, err := peerCredentials(conn)
+	if err == errPeerCredUnsupported {
+		return localCaller()
+	}
+	if err != nil {
+		log.Printf("Failed to read peer credentials: %v", err)
+		return &Caller{Name: "unknown", Source: "socket"}
+	}
+	return d.socketPolicy.caller(peer)
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials reads SO_PEERCRED of a unix socket connection.
+func peerCredentials(conn net.Conn) (peerCred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return peerCred{}, fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCred{}, err
+	}
+	if credErr != nil {
+		return peerCred{}, credErr
+	}
+	return peerCred{UID: cred.Uid, GID: cred.Gid, PID: cred.Pid}, nil
+}
@@ -0,0 +1,165 @@
+//go:build linux
+
+package daemon
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The helper process connects to the socket named by CONTROLMAN_TEST_SOCKET
+// and waits for the daemon to hang up.
+func TestSocketPeerHelper(t *testing.T) {
+	path := os.Getenv("CONTROLMAN_TEST_SOCKET")
+	if path == "" {
+		t.Skip("helper process")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, conn)
+}
+
+func TestSocketPolicyListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "controlman.sock")
+	// A socket left over by an earlier daemon
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := (&socketPolicy{mode: 0600, gid: -1}).listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket %v, %v; want a socket with mode 0600", info, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("the directory of the socket holds %d entries, want only the socket", len(entries))
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dialing the moved socket: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSocketPolicyOwnUser(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "daemon end")
+	defer f.Close()
+	defer syscall.Close(fds[1])
+	conn, err := net.FileConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	peer, err := peerCredentials(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(peer.UID) != os.Getuid() || int(peer.PID) != os.Getpid() {
+		t.Errorf("peer %s, want uid %d pid %d", peer, os.Getuid(), os.Getpid())
+	}
+	d := &Daemon{socketPolicy: &socketPolicy{}}
+	if caller := d.connCaller(conn); caller.Role != RoleAdmin {
+		t.Errorf("the daemon's own user got role %q, want admin", caller.Role)
+	}
+}
+
+func TestSocketPolicyByUID(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to connect as other users")
+	}
+	policy, err := SocketConfig{
+		Mode: "0666",
+		Access: []SocketAccess{
+			{User: "65534", Role: RoleOperator, Services: []string{"web-*"}},
+			{Group: "65000", Role: RoleViewer},
+		},
+	}.policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Daemon{socketPolicy: policy}
+
+	// Other users need to reach the socket and run the test binary
+	dir, err := os.MkdirTemp("", "controlman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "daemon.test")
+	if data, err := os.ReadFile(os.Args[0]); err != nil || os.WriteFile(binary, data, 0755) != nil {
+		t.Fatalf("copying the test binary: %v", err)
+	}
+	path := filepath.Join(dir, "controlman.sock")
+	listener, err := policy.listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for _, tt := range []struct {
+		name     string
+		uid, gid uint32
+		role     string
+		services string
+	}{
+		{"allowed user", 65534, 65534, RoleOperator, "[web-*]"},
+		{"allowed group", 65533, 65000, RoleViewer, "[]"},
+		{"denied user", 65533, 65533, "", "[]"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(binary, "-test.run=^TestSocketPeerHelper$")
+			cmd.Env = append(os.Environ(), "CONTROLMAN_TEST_SOCKET="+path)
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: tt.uid, Gid: tt.gid}}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer cmd.Wait()
+
+			listener.SetDeadline(time.Now().Add(10 * time.Second))
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			caller := d.connCaller(conn)
+			conn.Close()
+
+			if caller.Role != tt.role || fmtGrants(caller.Services) != tt.services {
+				t.Errorf("uid %d got role %q with services %s, want %q with %s", tt.uid, caller.Role, fmtGrants(caller.Services), tt.role, tt.services)
+			}
+			uid, pid := "uid="+strconv.Itoa(int(tt.uid)), " pid="+strconv.Itoa(cmd.Process.Pid)
+			if !strings.HasPrefix(caller.Source, "socket "+uid) || !strings.HasSuffix(caller.Source, pid) {
+				t.Errorf("source %q does not name uid %d and pid %d", caller.Source, tt.uid, cmd.Process.Pid)
+			}
+			err = caller.Authorize(Command{Action: "list"})
+			if (err == nil) != (tt.role != "") {
+				t.Errorf("list: %v", err)
+			}
+		})
+	}
+}
+
+func fmtGrants(services []string) string {
+	return "[" + strings.Join(services, " ") + "]"
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package daemon
+
+import "net"
+
+// peerCredentials is not implemented outside Linux; access to the command
+// socket is then controlled by its file mode and group only.
+func peerCredentials(conn net.Conn) (peerCred, error) {
+	return peerCred{}, errPeerCredUnsupported
+}
@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/client"
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+// rawConn speaks the socket protocol line by line, as a client written
+// against the documentation would.
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// serveRaw serves a connection of d and returns its client end.
+func serveRaw(t *testing.T, d *Daemon) *rawConn {
+	t.Helper()
+	clientEnd, daemonEnd := net.Pipe()
+	go d.serve(daemonEnd, testAdmin)
+	t.Cleanup(func() { clientEnd.Close() })
+	clientEnd.SetDeadline(time.Now().Add(10 * time.Second))
+	return &rawConn{t: t, conn: clientEnd, r: bufio.NewReader(clientEnd)}
+}
+
+func (c *rawConn) send(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		c.t.Fatalf("sending %s: %v", line, err)
+	}
+}
+
+// receive reads one response as a generic JSON object.
+func (c *rawConn) receive() map[string]any {
+	c.t.Helper()
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatalf("reading a response: %v", err)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(line, &resp); err != nil {
+		c.t.Fatalf("response %s: %v", line, err)
+	}
+	return resp
+}
+
+func TestProtocolHandshake(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	for _, tt := range []struct {
+		name  string
+		hello string
+		want  map[string]any
+	}{
+		{"supported", `{"id": 7, "action": "hello", "data": {"version": 1, "client": "test"}}`,
+			map[string]any{"id": 7.0, "success": true, "message": "", "data": map[string]any{"version": 1.0, "min_version": 1.0}}},
+		{"without id", `{"action": "hello", "data": {"version": 1}}`,
+			map[string]any{"success": true, "message": "", "data": map[string]any{"version": 1.0, "min_version": 1.0}}},
+		{"newer", `{"id": 1, "action": "hello", "data": {"version": 99}}`,
+			map[string]any{"id": 1.0, "success": false, "code": "unsupported_version", "message": "protocol version 99 is newer than the daemon's (1), please upgrade the controlman daemon"}},
+		{"older", `{"id": 1, "action": "hello", "data": {"version": 0}}`,
+			map[string]any{"id": 1.0, "success": false, "code": "unsupported_version", "message": "protocol version 0 is no longer supported (minimum 1), please upgrade the controlman client"}},
+		{"no hello", `{"action": "list", "name": "", "command": "", "data": null}`,
+			map[string]any{"success": false, "code": "unsupported_version", "message": "the client does not speak the controlman protocol, please upgrade the controlman client"}},
+		{"invalid hello", `{"id": 3, "action": "hello", "data": "one"}`,
+			map[string]any{"id": 3.0, "success": false, "code": "invalid_argument", "message": "invalid hello request"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := serveRaw(t, d)
+			c.send(tt.hello)
+			if got := c.receive(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+			// A rejected client is hung up on
+			if tt.want["success"] == false {
+				if _, err := c.r.ReadByte(); err != io.EOF {
+					t.Errorf("the connection stayed open: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestProtocolRequests(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	c := serveRaw(t, d)
+	c.send(`{"action": "hello", "data": {"version": 1}}`)
+	c.receive()
+
+	// Requests may be sent without waiting; responses carry their IDs
+	c.send(`{"id": 41, "action": "info", "name": "missing", "command": "", "data": null}`)
+	c.send(`{"id": 42, "action": "list", "name": "", "command": "", "data": null}`)
+	c.send(`{"id": 43, "action": "no-such-action", "name": "", "command": "", "data": null}`)
+	got := map[float64]map[string]any{}
+	for range 3 {
+		resp := c.receive()
+		got[resp["id"].(float64)] = resp
+	}
+
+	if want := (map[string]any{"id": 41.0, "success": false, "code": "not_found", "message": "service not found"}); !reflect.DeepEqual(got[41], want) {
+		t.Errorf("info of a missing service: got %v, want %v", got[41], want)
+	}
+	if want := (map[string]any{"id": 42.0, "success": true, "message": "", "data": []any{}}); !reflect.DeepEqual(got[42], want) {
+		t.Errorf("list: got %v, want %v", got[42], want)
+	}
+	if resp := got[43]; resp["success"] != false || resp["code"] != "invalid_argument" {
+		t.Errorf("unknown action: got %v", resp)
+	}
+}
+
+func TestProtocolErrorCodes(t *testing.T) {
+	// The codes are part of the wire format; clients compare the strings
+	for code, want := range map[string]string{
+		protocol.CodeInvalidArgument:    "invalid_argument",
+		protocol.CodeNotFound:           "not_found",
+		protocol.CodeAlreadyExists:      "already_exists",
+		protocol.CodeConflict:           "conflict",
+		protocol.CodeForbidden:          "forbidden",
+		protocol.CodeInternal:           "internal",
+		protocol.CodeUnsupportedVersion: "unsupported_version",
+	} {
+		if code != want {
+			t.Errorf("code %q, want %q", code, want)
+		}
+	}
+}
+
+func TestProtocolClient(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	clientEnd, daemonEnd := net.Pipe()
+	go d.serve(daemonEnd, &Caller{Name: "alice", Role: RoleViewer, Source: "test"})
+	c, err := client.NewConn(clientEnd)
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if services, err := c.ListServices(ctx); err != nil || len(services) != 0 {
+		t.Errorf("ListServices = %v, %v", services, err)
+	}
+	var perr *protocol.Error
+	if _, err := c.Service(ctx, "missing"); !errors.As(err, &perr) || perr.Code != protocol.CodeNotFound {
+		t.Errorf("Service of a missing service = %v, want a %s error", err, protocol.CodeNotFound)
+	}
+	if err := c.StartService(ctx, "missing"); !errors.As(err, &perr) || perr.Code != protocol.CodeForbidden {
+		t.Errorf("StartService as a viewer = %v, want a %s error", err, protocol.CodeForbidden)
+	}
+}
+
+func TestProtocolClientVersionMismatch(t *testing.T) {
+	clientEnd, daemonEnd := net.Pipe()
+	defer daemonEnd.Close()
+	hello := make(chan protocol.Request, 1)
+	go func() {
+		var req protocol.Request
+		json.NewDecoder(daemonEnd).Decode(&req)
+		hello <- req
+		json.NewEncoder(daemonEnd).Encode(protocol.Response{ID: req.ID, Code: protocol.CodeUnsupportedVersion, Message: "protocol version 1 is no longer supported"})
+		daemonEnd.Close()
+	}()
+
+	_, err := client.NewConn(clientEnd, client.WithClientName("test-client"))
+	var perr *protocol.Error
+	if !errors.As(err, &perr) || perr.Code != protocol.CodeUnsupportedVersion || perr.Message != "protocol version 1 is no longer supported" {
+		t.Errorf("NewConn = %v, want the %s error of the daemon", err, protocol.CodeUnsupportedVersion)
+	}
+
+	req := <-hello
+	var payload protocol.HelloRequest
+	if req.Action != protocol.ActionHello || json.Unmarshal(req.Data, &payload) != nil || payload.Version != protocol.Version || payload.Client != "test-client" {
+		t.Errorf("the client sent %s %s", req.Action, req.Data)
+	}
+}
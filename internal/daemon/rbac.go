@@ -0,0 +1,121 @@
+package daemon
+
+import (
+	"fmt"
+	"os/user"
+	"path"
+	"slices"
+	"strings"
+)
+
+// User roles, from least to most privileged
+const (
+	RoleViewer   = "viewer"   // can see services and their logs
+	RoleOperator = "operator" // can also start, stop, restart, scale and run them
+	RoleAdmin    = "admin"    // can do everything, including managing users
+)
+
+var roleRank = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// actionRoles is the least privileged role allowed to run each action.
+// Actions not listed require RoleAdmin.
+var actionRoles = map[string]string{
+	"list":        RoleViewer,
+	"info":        RoleViewer,
+	"logs":        RoleViewer,
+	"runs":        RoleViewer,
+	"watch":       RoleViewer,
+	"hosts":       RoleViewer,
+	"user-passwd": RoleViewer, // own password only, see Authorize
+	"start":       RoleOperator,
+	"stop":        RoleOperator,
+	"restart":     RoleOperator,
+	"reload":      RoleOperator,
+	"run":         RoleOperator,
+	"scale":       RoleOperator,
+}
+
+// Caller identifies who sent a command.
+type Caller struct {
+	Name     string
+	Role     string
+	Services []string // service name patterns the caller is limited to; empty means all
+	Actions  []string // actions the caller is limited to (API keys); empty means all
+	Source   string   // "socket uid=... pid=..." or "http <client address>"
+}
+
+// localCaller is the admin caller of the daemon's own user, used for its
+// own user and root on the command socket (see socketPolicy.caller).
+func localCaller() *Caller {
+	name := "local"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return &Caller{Name: name, Role: RoleAdmin, Source: "socket"}
+}
+
+func validRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+func validateGrants(role string, services []string) error {
+	if !validRole(role) {
+		return fmt.Errorf("unknown role %q (expected viewer, operator or admin)", role)
+	}
+	if role == RoleAdmin && len(services) > 0 {
+		return fmt.Errorf("admins cannot be limited to services")
+	}
+	for _, pattern := range services {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid service pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// CanAccess reports whether the caller's grants cover the service.
+func (c *Caller) CanAccess(service string) bool {
+	return len(c.Services) == 0 || matchAny(c.Services, service)
+}
+
+// matchAny reports whether name matches one of the patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks the caller's role and service grants for a command.
+func (c *Caller) Authorize(cmd Command) error {
+	if !validRole(c.Role) {
+		return fmt.Errorf("permission denied: %s has no access to the daemon", c.Name)
+	}
+	required, ok := actionRoles[cmd.Action]
+	if !ok {
+		required = RoleAdmin
+	}
+	if cmd.Action == "user-passwd" && cmd.Name != c.Name {
+		required = RoleAdmin
+	}
+	if roleRank[c.Role] < roleRank[required] {
+		return fmt.Errorf("permission denied: %s requires the %s role", cmd.Action, required)
+	}
+	if len(c.Actions) > 0 && !slices.Contains(c.Actions, cmd.Action) {
+		return fmt.Errorf("permission denied: %s is not allowed for this key", cmd.Action)
+	}
+
+	// User and key commands name a user or key, not a service
+	isAccountAction := strings.HasPrefix(cmd.Action, "user-") || strings.HasPrefix(cmd.Action, "apikey-")
+	if cmd.Name != "" && !isAccountAction && !c.CanAccess(cmd.Name) {
+		return fmt.Errorf("permission denied: no access to service %s", cmd.Name)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+func TestAuthorizeRoles(t *testing.T) {
+	// The least privileged role allowed to run each action
+	for _, tt := range []struct {
+		action string
+		role   string
+	}{
+		{"list", RoleViewer},
+		{"info", RoleViewer},
+		{"logs", RoleViewer},
+		{"runs", RoleViewer},
+		{"watch", RoleViewer},
+		{"hosts", RoleViewer},
+		{"start", RoleOperator},
+		{"stop", RoleOperator},
+		{"restart", RoleOperator},
+		{"reload", RoleOperator},
+		{"run", RoleOperator},
+		{"scale", RoleOperator},
+		{"add", RoleAdmin},
+		{"edit", RoleAdmin},
+		{"delete", RoleAdmin},
+		{"audit", RoleAdmin},
+		{"user-add", RoleAdmin},
+		{"user-list", RoleAdmin},
+		{"apikey-create", RoleAdmin},
+		{"unknown-action", RoleAdmin},
+	} {
+		for _, role := range []string{RoleViewer, RoleOperator, RoleAdmin} {
+			caller := &Caller{Name: "alice", Role: role}
+			err := caller.Authorize(Command{Action: tt.action, Name: "web"})
+			if allowed := roleRank[role] >= roleRank[tt.role]; (err == nil) != allowed {
+				t.Errorf("%s %s: %v, want allowed %v", role, tt.action, err, allowed)
+			}
+		}
+	}
+
+	for _, role := range []string{"", "root", "Admin"} {
+		if err := (&Caller{Name: "alice", Role: role}).Authorize(Command{Action: "list"}); err == nil {
+			t.Errorf("role %q was allowed to list", role)
+		}
+	}
+}
+
+func TestAuthorizeOwnPassword(t *testing.T) {
+	viewer := &Caller{Name: "alice", Role: RoleViewer, Services: []string{"web"}}
+	if err := viewer.Authorize(Command{Action: "user-passwd", Name: "alice"}); err != nil {
+		t.Errorf("changing the own password: %v", err)
+	}
+	if err := viewer.Authorize(Command{Action: "user-passwd", Name: "bob"}); err == nil {
+		t.Error("a viewer changed the password of another user")
+	}
+	admin := &Caller{Name: "root", Role: RoleAdmin}
+	if err := admin.Authorize(Command{Action: "user-passwd", Name: "bob"}); err != nil {
+		t.Errorf("an admin changing a password: %v", err)
+	}
+}
+
+func TestAuthorizeGrants(t *testing.T) {
+	for _, tt := range []struct {
+		grants  []string
+		service string
+		allowed bool
+	}{
+		{nil, "anything", true},
+		{[]string{"web"}, "web", true},
+		{[]string{"web"}, "web2", false},
+		{[]string{"web"}, "we", false},
+		{[]string{"web-*"}, "web-1", true},
+		{[]string{"web-*"}, "web", false},
+		{[]string{"web-?"}, "web-12", false},
+		{[]string{"web-[12]"}, "web-2", true},
+		{[]string{"web-[12]"}, "web-3", false},
+		{[]string{"api", "web-*"}, "api", true},
+		{[]string{"api", "web-*"}, "db", false},
+		// A malformed pattern matches nothing
+		{[]string{"web-["}, "web-[", false},
+		{[]string{"web-[", "api"}, "api", true},
+	} {
+		caller := &Caller{Name: "alice", Role: RoleOperator, Services: tt.grants}
+		if got := caller.CanAccess(tt.service); got != tt.allowed {
+			t.Errorf("grants %v, CanAccess(%s) = %v, want %v", tt.grants, tt.service, got, tt.allowed)
+		}
+		err := caller.Authorize(Command{Action: "restart", Name: tt.service})
+		if (err == nil) != tt.allowed {
+			t.Errorf("grants %v, restart %s: %v, want allowed %v", tt.grants, tt.service, err, tt.allowed)
+		}
+	}
+
+	// Account commands name a user or key, which grants do not cover
+	caller := &Caller{Name: "alice", Role: RoleViewer, Services: []string{"web"}}
+	if err := caller.Authorize(Command{Action: "user-passwd", Name: "alice"}); err != nil {
+		t.Errorf("user-passwd with grants: %v", err)
+	}
+	// Commands naming no service, such as list, are filtered instead
+	if err := caller.Authorize(Command{Action: "list"}); err != nil {
+		t.Errorf("list with grants: %v", err)
+	}
+}
+
+func TestValidateGrants(t *testing.T) {
+	for _, tt := range []struct {
+		role     string
+		services []string
+		err      string
+	}{
+		{RoleViewer, nil, ""},
+		{RoleOperator, []string{"web-*", "api"}, ""},
+		{RoleAdmin, nil, ""},
+		{RoleAdmin, []string{"web"}, "admins cannot be limited"},
+		{"superuser", nil, "unknown role"},
+		{RoleViewer, []string{"web-["}, "invalid service pattern"},
+	} {
+		err := validateGrants(tt.role, tt.services)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("validateGrants(%s, %v) = %v, want %q", tt.role, tt.services, err, tt.err)
+		}
+	}
+}
+
+func TestListShowsGrantedServices(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	for _, name := range []string{"api", "web-1", "web-2"} {
+		s := &service.Service{Name: name, Command: "sleep 300", Status: service.StatusStopped, Type: service.TypeService, CreatedAt: time.Now()}
+		if err := d.serviceManager.SaveService(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		caller *Caller
+		want   string
+	}{
+		{testAdmin, "api,web-1,web-2"},
+		{&Caller{Name: "alice", Role: RoleViewer}, "api,web-1,web-2"},
+		{&Caller{Name: "alice", Role: RoleViewer, Services: []string{"web-*"}}, "web-1,web-2"},
+		{&Caller{Name: "alice", Role: RoleOperator, Services: []string{"api"}}, "api"},
+		{&Caller{Name: "alice", Role: RoleViewer, Services: []string{"db"}}, ""},
+	} {
+		resp := d.HandleCommand(tt.caller, Command{Action: "list"})
+		if !resp.Success {
+			t.Fatalf("list: %s", resp.Message)
+		}
+		var names []string
+		for _, info := range resp.Data.([]ServiceInfo) {
+			names = append(names, info.Name)
+		}
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("%s with grants %v lists %s, want %s", tt.caller.Role, tt.caller.Services, got, tt.want)
+		}
+	}
+
+	// Commands naming a service outside the grants are denied
+	viewer := &Caller{Name: "alice", Role: RoleViewer, Services: []string{"web-*"}}
+	if resp := d.HandleCommand(viewer, Command{Action: "info", Name: "api"}); resp.Success || resp.Code != CodeForbidden {
+		t.Errorf("info of a service outside the grants: %v %s %s", resp.Success, resp.Code, resp.Message)
+	}
+}
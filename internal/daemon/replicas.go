@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// validateReplicas checks the replica settings of a new or edited service.
+func validateReplicas(s *service.Service) error {
+	if s.Replicas < 0 {
+		return fmt.Errorf("replicas must not be negative")
+	}
+	if s.IsJob() && s.Replicas > 1 {
+		return fmt.Errorf("jobs cannot have replicas")
+	}
+	if _, err := service.RenderPort(s.PortTemplate, s.Name, 1); err != nil {
+		return err
+	}
+	return nil
+}
+
+// reviveInstances restarts the dead instances of a replicated service that
+// is expected to be running.
+func (d *Daemon) reviveInstances(s *service.Service) {
+	changed := false
+	for _, inst := range s.Instances {
+		if inst.IsRunning() {
+			continue
+		}
+
+		log.Printf("Instance %d of service %s is not running (expected Running), attempting to restart...", inst.Index, s.Name)
+		d.emit(EventCrash, s, fmt.Sprintf("instance %d exited unexpectedly", inst.Index))
+		if d.recordCrash(s.Name) {
+			d.emit(EventUnhealthy, s, fmt.Sprintf("crashed %d times within %s", flapThreshold, flapWindow))
+		}
+
+		if err := s.StartInstance(inst.Index); err != nil {
+			s.Status = service.StatusFailed
+			d.serviceManager.SaveService(s)
+			log.Printf("Failed to restart instance %d of service %s: %v", inst.Index, s.Name, err)
+			d.emit(EventFailed, s, err.Error())
+			return
+		}
+		changed = true
+		d.emit(EventRestart, s, fmt.Sprintf("instance %d restarted after crash", inst.Index))
+	}
+
+	if changed {
+		if err := d.serviceManager.SaveService(s); err != nil {
+			log.Printf("Failed to save restarted service state %s: %v", s.Name, err)
+		}
+	}
+}
+
+func (d *Daemon) handleScale(cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
+	}
+
+	var req protocol.ScaleRequest
+	if err := json.Unmarshal(cmd.Data, &req); err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid scale request: %v", err)}
+	}
+	if req.Replicas < 1 {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "replicas must be at least 1"}
+	}
+
+	s, err := d.serviceManager.LoadService(cmd.Name)
+	if err != nil {
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
+	}
+	if s.IsJob() {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "jobs cannot have replicas"}
+	}
+
+	log.Printf("Scaling service %s from %d to %d replicas", s.Name, s.DesiredInstances(), req.Replicas)
+	// A failed Scale leaves the replicas as they were, so the stored
+	// service stays valid
+	if err := s.Scale(req.Replicas); err != nil {
+		log.Printf("Failed to scale service %s: %v", s.Name, err)
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to scale service: %v", err)}
+	}
+
+	if err := d.serviceManager.SaveService(s); err != nil {
+		log.Printf("Failed to save scaled service %s: %v", s.Name, err)
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to save service: %v", err)}
+	}
+
+	return Response{Success: true, Message: fmt.Sprintf("service scaled to %d replicas", req.Replicas)}
+}
@@ -0,0 +1,52 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+func TestScaleKeepsStoredService(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	opts := ServiceOptions{
+		Exec: []string{"sleep", "300"},
+		// Instance 3 cannot get a port
+		PortTemplate: "{{if eq .Instance 3}}{{.Port}}{{else}}{{add 8000 .Instance}}{{end}}",
+	}
+	addTestService(t, d, "web")
+	if resp := d.HandleCommand(testAdmin, testCommand(t, "edit", "web", "", opts)); !resp.Success {
+		t.Fatalf("edit: %s", resp.Message)
+	}
+
+	info := func() ServiceInfo {
+		t.Helper()
+		resp := d.HandleCommand(testAdmin, testCommand(t, "info", "web", "", nil))
+		if !resp.Success {
+			t.Fatalf("info: %s", resp.Message)
+		}
+		return resp.Data.(ServiceInfo)
+	}
+	scale := func(n int) Response {
+		return d.HandleCommand(testAdmin, testCommand(t, "scale", "web", "", protocol.ScaleRequest{Replicas: n}))
+	}
+
+	if resp := scale(3); resp.Success {
+		t.Fatal("scaling to an instance without a port succeeded")
+	}
+	if got := info(); got.Replicas != 1 || got.Ready != 1 || got.Status != "running" {
+		t.Errorf("after a failed scale: %d replicas, %d ready, %s; want 1 running", got.Replicas, got.Ready, got.Status)
+	}
+
+	// The monitor checks every second; it must neither revive the instances
+	// scale stopped nor bring back the replicas it loaded before
+	for _, n := range []int{2, 1, 2} {
+		if resp := scale(n); !resp.Success {
+			t.Fatalf("scale %d: %s", n, resp.Message)
+		}
+		time.Sleep(1500 * time.Millisecond)
+		if got := info(); got.Replicas != n || got.Ready != n {
+			t.Errorf("scaled to %d: %d replicas, %d ready", n, got.Replicas, got.Ready)
+		}
+	}
+}
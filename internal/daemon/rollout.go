@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// rollingRestart replaces the instances of a running replicated service one
+// at a time. The caller holds the lock of the service for the whole rollout,
+// so the monitor cannot revive the instance that is being replaced from a
+// copy it loaded before, nor save that copy over the new instances.
+func (d *Daemon) rollingRestart(s *service.Service) Response {
+	log.Printf("Rolling restart of service %s (%d instances)", s.Name, len(s.Instances))
+
+	s.Status = service.StatusRestarting
+	if err := d.serviceManager.SaveService(s); err != nil {
+		log.Printf("Failed to save restarting status for service %s: %v", s.Name, err)
+	}
+
+	err := s.RollingRestart(service.DefaultReadyTimeout, func(n int) {
+		log.Printf("Instance %d of service %s restarted (PID %d)", n, s.Name, s.Instances[n-1].PID)
+		if err := d.serviceManager.SaveService(s); err != nil {
+			log.Printf("Failed to save service state %s: %v", s.Name, err)
+		}
+	})
+
+	// The instances that were not replaced are still serving, so the
+	// service stays running and the monitor takes care of dead instances.
+	s.Status = service.StatusRunning
+	if saveErr := d.serviceManager.SaveService(s); saveErr != nil {
+		log.Printf("Failed to save restarted service %s: %v", s.Name, saveErr)
+	}
+
+	if err != nil {
+		log.Printf("Rolling restart of service %s aborted: %v", s.Name, err)
+		d.emit(EventFailed, s, "rolling restart aborted: "+err.Error())
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("rolling restart aborted: %v", err)}
+	}
+
+	log.Printf("Service %s restarted successfully", s.Name)
+	d.emit(EventRestart, s, "rolling restart")
+
+	d.mu.Lock()
+	_, exists := d.monitors[s.Name]
+	d.mu.Unlock()
+	if !exists {
+		go d.monitorService(s.Name)
+	}
+
+	return Response{Success: true, Message: fmt.Sprintf("service restarted successfully (%d instances, one at a time)", len(s.Instances))}
+}
+
+func (d *Daemon) handleReload(cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
+	}
+
+	s, err := d.serviceManager.LoadService(cmd.Name)
+	if err != nil {
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
+	}
+	if s.IsJob() {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "jobs cannot be reloaded"}
+	}
+
+	if s.RunningInstances() == 0 {
+		return Response{Success: false, Code: CodeConflict, Message: "service is not running"}
+	}
+
+	sig := reloadSignal(s)
+	log.Printf("Reloading service %s with %s", s.Name, sig)
+	if err := s.Reload(); err != nil {
+		log.Printf("Failed to reload service %s: %v", s.Name, err)
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to reload service: %v", err)}
+	}
+
+	d.emit(EventReload, s, "sent "+sig)
+	return Response{Success: true, Message: fmt.Sprintf("sent %s to service", sig)}
+}
+
+func reloadSignal(s *service.Service) string {
+	if s.ReloadSignal == "" {
+		return service.DefaultReloadSignal
+	}
+	return s.ReloadSignal
+}
@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+// processes returns the number of live processes whose command line is
+// args.
+func processes(args ...string) int {
+	want := strings.Join(args, "\x00") + "\x00"
+	n := 0
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range dirs {
+		cmdline, _ := os.ReadFile(filepath.Join(dir, "cmdline"))
+		stat, _ := os.ReadFile(filepath.Join(dir, "stat"))
+		// The state follows the parenthesized command name
+		state := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		if strings.HasSuffix(string(cmdline), want) && len(state) > 0 && state[0] != "Z" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRollingRestartHoldsMonitor(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	addTestService(t, d, "web")
+	opts := ServiceOptions{Exec: []string{"sleep", "3031"}}
+	if resp := d.HandleCommand(testAdmin, testCommand(t, "edit", "web", "", opts)); !resp.Success {
+		t.Fatalf("edit: %s", resp.Message)
+	}
+	if resp := d.HandleCommand(testAdmin, testCommand(t, "scale", "web", "", protocol.ScaleRequest{Replicas: 2})); !resp.Success {
+		t.Fatalf("scale: %s", resp.Message)
+	}
+
+	// Each instance takes a second to be ready, so the monitor checks the
+	// service while the rollout replaces it
+	if resp := d.HandleCommand(testAdmin, testCommand(t, "restart", "web", "", nil)); !resp.Success {
+		t.Fatalf("restart: %s", resp.Message)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	resp := d.HandleCommand(testAdmin, testCommand(t, "info", "web", "", nil))
+	if info := resp.Data.(ServiceInfo); info.Replicas != 2 || info.Ready != 2 || info.Status != "running" {
+		t.Errorf("after the rollout: %d replicas, %d ready, %s; want 2 running", info.Replicas, info.Ready, info.Status)
+	}
+	if n := processes("sleep", "3031"); n != 2 {
+		t.Errorf("%d instance processes run after the rollout, want 2", n)
+	}
+}
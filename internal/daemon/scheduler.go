@@ -0,0 +1,276 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// validateJob checks the type and schedule of a new or edited service.
+func validateJob(s *service.Service) error {
+	switch s.Type {
+	case "", service.TypeService, service.TypeOneshot:
+		if s.Schedule != "" {
+			return fmt.Errorf("a schedule is only allowed for cron jobs")
+		}
+	case service.TypeCron:
+		if s.Schedule == "" {
+			return fmt.Errorf("cron jobs require a schedule")
+		}
+		if _, err := service.ParseSchedule(s.Schedule); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown service type %q", s.Type)
+	}
+	return nil
+}
+
+// startJob enables a job: cron jobs get their scheduler started, one-shot
+// jobs are run immediately.
+func (d *Daemon) startJob(s *service.Service) Response {
+	if s.Type == service.TypeOneshot {
+		if !d.launchJob(s.Name, service.TriggerManual) {
+			return Response{Success: false, Code: CodeConflict, Message: "job is already running"}
+		}
+		return Response{Success: true, Message: "job started"}
+	}
+
+	s.Status = service.StatusScheduled
+	if err := d.serviceManager.SaveService(s); err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to save service: %v", err)}
+	}
+
+	d.mu.Lock()
+	_, exists := d.monitors[s.Name]
+	d.mu.Unlock()
+	if !exists {
+		go d.scheduleJob(s.Name)
+	}
+
+	log.Printf("Job %s scheduled (%s)", s.Name, s.Schedule)
+	return Response{Success: true, Message: "job scheduled"}
+}
+
+// rescheduleJob restarts the scheduler of a cron job, e.g. after its schedule changed.
+func (d *Daemon) rescheduleJob(name string) {
+	d.mu.Lock()
+	if stopChan, exists := d.monitors[name]; exists {
+		close(stopChan)
+		delete(d.monitors, name)
+	}
+	d.mu.Unlock()
+	go d.scheduleJob(name)
+}
+
+// scheduleJob sleeps until the next activation of a cron job and launches
+// a run, until the job is stopped or deleted.
+func (d *Daemon) scheduleJob(name string) {
+	stopChan := make(chan struct{})
+	d.mu.Lock()
+	if !d.track() {
+		d.mu.Unlock()
+		return
+	}
+	d.monitors[name] = stopChan
+	d.mu.Unlock()
+	defer d.background.Done()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.nextRuns, name)
+		if ch, ok := d.monitors[name]; ok && ch == stopChan {
+			delete(d.monitors, name)
+		}
+		d.mu.Unlock()
+	}()
+
+	for {
+		s, err := d.serviceManager.LoadService(name)
+		if err != nil {
+			if err == os.ErrNotExist {
+				log.Printf("Job %s no longer exists, stopping scheduler", name)
+				return
+			}
+			log.Printf("Failed to load job %s for scheduling: %v", name, err)
+			select {
+			case <-stopChan:
+				return
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+
+		schedule, err := service.ParseSchedule(s.Schedule)
+		if err != nil {
+			log.Printf("Job %s has an invalid schedule: %v", name, err)
+			d.serviceManager.SetServiceStatus(name, service.StatusFailed)
+			return
+		}
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("Schedule %q of job %s never fires, stopping scheduler", s.Schedule, name)
+			return
+		}
+
+		d.mu.Lock()
+		d.nextRuns[name] = next
+		d.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stopChan:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		d.launchJob(name, service.TriggerSchedule)
+	}
+}
+
+// launchJob runs a job in the background and records the result. It
+// returns false without doing anything if a run of the job is still active
+// or the daemon is shutting down.
+func (d *Daemon) launchJob(name, trigger string) bool {
+	d.mu.Lock()
+	if _, running := d.runningJobs[name]; running {
+		d.mu.Unlock()
+		log.Printf("Job %s is still running, skipping %s run", name, trigger)
+		return false
+	}
+	if !d.track() {
+		d.mu.Unlock()
+		log.Printf("Daemon is shutting down, skipping %s run of job %s", trigger, name)
+		return false
+	}
+	d.runningJobs[name] = 0
+	d.mu.Unlock()
+
+	go func() {
+		defer d.background.Done()
+		defer func() {
+			d.mu.Lock()
+			delete(d.runningJobs, name)
+			d.mu.Unlock()
+		}()
+
+		s, err := d.serviceManager.LoadService(name)
+		if err != nil {
+			log.Printf("Failed to load job %s: %v", name, err)
+			return
+		}
+
+		log.Printf("Running job %s (%s)", name, trigger)
+		run := s.RunJob(trigger, func(pid int) {
+			// Close kills the runs it knows of; one starting after it is killed here
+			d.mu.Lock()
+			d.runningJobs[name] = pid
+			select {
+			case <-d.closed:
+				syscall.Kill(-pid, syscall.SIGKILL)
+			default:
+			}
+			d.mu.Unlock()
+
+			s.Status = service.StatusRunning
+			if err := d.serviceManager.SaveService(s); err != nil {
+				log.Printf("Failed to save job state %s: %v", name, err)
+			}
+			d.emit(EventStart, s, trigger+" run")
+		})
+
+		if err := d.serviceManager.SaveRun(name, run); err != nil {
+			log.Printf("Failed to record run of job %s: %v", name, err)
+		}
+
+		// Reload so that edits or a stop made during the run are not overwritten
+		cur, err := d.serviceManager.LoadService(name)
+		if err != nil {
+			return
+		}
+		cur.PID = 0
+		cur.LastStarted = run.StartedAt
+		switch {
+		case cur.Status == service.StatusStopped || cur.Status == service.StatusStopping:
+			cur.Status = service.StatusStopped
+		case cur.Type == service.TypeCron:
+			cur.Status = service.StatusScheduled
+		case run.ExitCode == 0:
+			cur.Status = service.StatusCompleted
+		default:
+			cur.Status = service.StatusFailed
+		}
+		if err := d.serviceManager.SaveService(cur); err != nil {
+			log.Printf("Failed to save job state %s: %v", name, err)
+		}
+
+		log.Printf("Job %s finished with exit code %d in %.1fs", name, run.ExitCode, run.Duration)
+		if run.ExitCode == 0 {
+			d.emit(EventStop, cur, fmt.Sprintf("run finished in %.1fs", run.Duration))
+		} else {
+			d.emit(EventFailed, cur, fmt.Sprintf("run failed with exit code %d: %s", run.ExitCode, run.Error))
+		}
+	}()
+	return true
+}
+
+// jobInfo returns the scheduling details shown by list and info.
+func (d *Daemon) jobInfo(s *service.Service) (nextRun string, lastRun *service.Run) {
+	if !s.IsJob() {
+		return "", nil
+	}
+	d.mu.Lock()
+	if next, ok := d.nextRuns[s.Name]; ok {
+		nextRun = next.Format(time.RFC3339)
+	}
+	d.mu.Unlock()
+
+	lastRun, err := d.serviceManager.LastRun(s.Name)
+	if err != nil {
+		log.Printf("Failed to load last run of %s: %v", s.Name, err)
+	}
+	return nextRun, lastRun
+}
+
+func (d *Daemon) handleRun(cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
+	}
+
+	s, err := d.serviceManager.LoadService(cmd.Name)
+	if err != nil {
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
+	}
+	if !s.IsJob() {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "only cron and oneshot jobs can be run"}
+	}
+
+	if !d.launchJob(s.Name, service.TriggerManual) {
+		return Response{Success: false, Code: CodeConflict, Message: "job is already running"}
+	}
+	return Response{Success: true, Message: "job started"}
+}
+
+func (d *Daemon) handleRuns(cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "service name is required"}
+	}
+
+	if _, err := d.serviceManager.LoadService(cmd.Name); err != nil {
+		return Response{Success: false, Code: CodeNotFound, Message: "service not found"}
+	}
+
+	runs, err := d.serviceManager.ListRuns(cmd.Name, 20)
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to list runs: %v", err)}
+	}
+	if runs == nil {
+		runs = []*service.Run{}
+	}
+	return Response{Success: true, Data: runs}
+}
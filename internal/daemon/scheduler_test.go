@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+func TestCloseStopsJobs(t *testing.T) {
+	d := newTestDaemon(t, FleetConfig{})
+	for _, job := range []struct {
+		name, typ, schedule string
+	}{
+		{"nightly", service.TypeCron, "0 3 * * *"},
+		{"migrate", service.TypeOneshot, ""},
+	} {
+		opts := ServiceOptions{Exec: []string{"sleep", "300"}, Type: job.typ, Schedule: job.schedule}
+		if resp := d.HandleCommand(testAdmin, testCommand(t, "add", job.name, "", opts)); !resp.Success {
+			t.Fatalf("add %s: %s", job.name, resp.Message)
+		}
+	}
+	// add schedules the cron job and runs the one-shot job
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		pid := d.runningJobs["migrate"]
+		d.mu.Unlock()
+		if pid != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the one-shot job did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !running("(*Daemon).scheduleJob") {
+		t.Fatal("the cron job is not scheduled")
+	}
+	closeDaemon(t, d)
+	if running("(*Daemon).scheduleJob") || running("(*Daemon).launchJob.func") {
+		t.Error("jobs kept running after Close")
+	}
+	if d.launchJob("migrate", service.TriggerManual) {
+		t.Error("a job was launched after Close")
+	}
+}
@@ -0,0 +1,137 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+type (
+	UserRequest = protocol.UserRequest
+	UserInfo    = protocol.UserInfo
+)
+
+func parseUserRequest(cmd Command) (*UserRequest, error) {
+	req := &UserRequest{}
+	if len(cmd.Data) > 0 {
+		if err := json.Unmarshal(cmd.Data, req); err != nil {
+			return nil, fmt.Errorf("invalid user request: %v", err)
+		}
+	}
+	if req.Password == "" {
+		return nil, fmt.Errorf("password is required")
+	}
+	return req, nil
+}
+
+func (d *Daemon) handleUserAdd(cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "user name is required"}
+	}
+	req, err := parseUserRequest(cmd)
+	if err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	if req.Role == "" {
+		req.Role = RoleViewer
+	}
+	if err := validateGrants(req.Role, req.Services); err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+
+	if _, err := d.loadUser(cmd.Name); err == nil {
+		return Response{Success: false, Code: CodeAlreadyExists, Message: "user already exists"}
+	}
+
+	if err := d.SetPassword(cmd.Name, req.Password); err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to save user: %v", err)}
+	}
+	u, err := d.loadUser(cmd.Name)
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to save user: %v", err)}
+	}
+	u.Role = req.Role
+	u.Services = req.Services
+	if err := d.saveUser(u); err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to save user: %v", err)}
+	}
+
+	log.Printf("User %s added with role %s", u.Name, u.Role)
+	return Response{Success: true, Message: "user added successfully"}
+}
+
+func (d *Daemon) handleUserList() Response {
+	users, err := d.listUsers()
+	if err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to list users: %v", err)}
+	}
+
+	list := make([]UserInfo, 0, len(users))
+	for _, u := range users {
+		list = append(list, UserInfo{
+			Name:      u.Name,
+			Role:      u.Role,
+			Services:  u.Services,
+			CreatedAt: u.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return Response{Success: true, Data: list}
+}
+
+func (d *Daemon) handleUserRemove(cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "user name is required"}
+	}
+
+	u, err := d.loadUser(cmd.Name)
+	if err != nil {
+		return Response{Success: false, Code: CodeNotFound, Message: "user not found"}
+	}
+
+	if u.Role == RoleAdmin {
+		users, err := d.listUsers()
+		if err != nil {
+			return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to list users: %v", err)}
+		}
+		admins := 0
+		for _, other := range users {
+			if other.Role == RoleAdmin {
+				admins++
+			}
+		}
+		if admins <= 1 {
+			return Response{Success: false, Code: CodeConflict, Message: "cannot remove the last admin"}
+		}
+	}
+
+	if err := d.serviceManager.DB().Delete([]byte(prefixUser+u.Name), pebble.Sync); err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to remove user: %v", err)}
+	}
+
+	log.Printf("User %s removed", u.Name)
+	return Response{Success: true, Message: "user removed successfully"}
+}
+
+func (d *Daemon) handleUserPasswd(cmd Command) Response {
+	if cmd.Name == "" {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: "user name is required"}
+	}
+	req, err := parseUserRequest(cmd)
+	if err != nil {
+		return Response{Success: false, Code: CodeInvalidArgument, Message: err.Error()}
+	}
+
+	if _, err := d.loadUser(cmd.Name); err != nil {
+		return Response{Success: false, Code: CodeNotFound, Message: "user not found"}
+	}
+	if err := d.SetPassword(cmd.Name, req.Password); err != nil {
+		return Response{Success: false, Code: CodeInternal, Message: fmt.Sprintf("failed to change password: %v", err)}
+	}
+
+	log.Printf("Password of user %s changed", cmd.Name)
+	return Response{Success: true, Message: "password changed successfully"}
+}
@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sync"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+type WatchRequest = protocol.WatchRequest
+
+// Subscription delivers the events a watcher asked for until it is closed.
+type Subscription struct {
+	C     <-chan Event
+	close func()
+}
+
+func (s *Subscription) Close() {
+	s.close()
+}
+
+// Watch authorizes a "watch" command and subscribes to the events it asks
+// for. On failure the subscription is nil and the response says why.
+func (d *Daemon) Watch(caller *Caller, cmd Command) (*Subscription, Response) {
+	if err := caller.Authorize(cmd); err != nil {
+		log.Printf("Denied %s for %s (%s): %v", cmd.Action, caller.Name, caller.Source, err)
+		resp := Response{Success: false, Code: CodeForbidden, Message: err.Error()}
+		d.audit(caller, cmd, resp)
+		return nil, resp
+	}
+
+	if cmd.Host != "" && cmd.Host != d.fleet.name {
+		return nil, Response{Success: false, Code: CodeInvalidArgument, Message: "events of other fleet hosts cannot be watched through the hub"}
+	}
+
+	var req WatchRequest
+	if len(cmd.Data) > 0 && string(cmd.Data) != "null" {
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return nil, Response{Success: false, Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid watch request: %v", err)}
+		}
+	}
+	for _, pattern := range req.Services {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, Response{Success: false, Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid service pattern %q", pattern)}
+		}
+	}
+
+	matches := func(e Event) bool {
+		if !caller.CanAccess(e.Service) || !matchesAny(req.Events, e.Type) {
+			return false
+		}
+		if len(req.Services) == 0 {
+			return true
+		}
+		for _, pattern := range req.Services {
+			if ok, _ := path.Match(pattern, e.Service); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	events, unsubscribe := d.events.subscribe(256)
+	out := make(chan Event)
+	done := make(chan struct{})
+	go func() {
+		defer close(out)
+		for e := range events {
+			if !matches(e) {
+				continue
+			}
+			select {
+			case out <- e:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	sub := &Subscription{C: out, close: func() {
+		once.Do(func() {
+			close(done)
+			unsubscribe()
+		})
+	}}
+	return sub, Response{Success: true, Message: "watching"}
+}
+
+// serveWatch streams the events of a "watch" command to a socket client
+// until the connection is closed.
+func (d *Daemon) serveWatch(caller *Caller, cmd Command, send func(protocol.Response) error, closed <-chan struct{}) {
+	sub, resp := d.Watch(caller, cmd)
+	if sub == nil {
+		send(resp.wire(cmd.ID))
+		return
+	}
+	defer sub.Close()
+
+	ack := resp.wire(cmd.ID)
+	ack.More = true
+	if err := send(ack); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-closed:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			msg := Response{Success: true, Data: e}.wire(cmd.ID)
+			msg.More = true
+			if err := send(msg); err != nil {
+				return
+			}
+		}
+	}
+}
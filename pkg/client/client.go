@@ -0,0 +1,354 @@
+// Package client is the Go client of the controlman daemon.
+//
+// A Client talks to the daemon either over its unix socket (Dial) or over the
+// HTTP API (DialHTTP). Both transports carry the same requests, see package
+// protocol, and every method takes a context for cancellation; requests
+// without a deadline get the client's default timeout.
+//
+//	c, err := client.Dial("")
+//	if err != nil { ... }
+//	defer c.Close()
+//	services, err := c.ListServices(ctx)
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// DefaultTimeout bounds requests whose context has no deadline.
+const DefaultTimeout = 30 * time.Second
+
+// Payload types shared with the daemon
+type (
+	ServiceOptions = protocol.ServiceOptions
+	ServiceInfo    = protocol.ServiceInfo
+	BulkRequest    = protocol.BulkRequest
+	BulkResult     = protocol.BulkResult
+	InstanceInfo   = protocol.InstanceInfo
+	UserOptions    = protocol.UserRequest
+	UserInfo       = protocol.UserInfo
+	APIKeyOptions  = protocol.APIKeyRequest
+	APIKeyInfo     = protocol.APIKeyInfo
+	AuditQuery     = protocol.AuditQuery
+	AuditEntry     = protocol.AuditEntry
+	WatchRequest   = protocol.WatchRequest
+	Event          = protocol.Event
+	HostInfo       = protocol.HostInfo
+	Run            = service.Run
+)
+
+// Transport sends requests to the daemon. Implementations must be safe for
+// concurrent use.
+type Transport interface {
+	Do(ctx context.Context, req *protocol.Request) (*protocol.Response, error)
+	Close() error
+}
+
+// Client is a connection to a controlman daemon. It is safe for concurrent use.
+type Client struct {
+	transport    Transport
+	timeout      time.Duration
+	pollInterval time.Duration
+	host         string
+}
+
+type options struct {
+	timeout      time.Duration
+	pollInterval time.Duration
+	name         string
+	host         string
+	httpClient   *http.Client
+}
+
+// Option configures a Client.
+type Option func(*options)
+
+// WithTimeout sets the timeout of requests whose context has no deadline.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) { o.timeout = d }
+}
+
+// WithPollInterval sets how often FollowLogs polls the daemon, and how
+// often Events polls or tries to reconnect.
+func WithPollInterval(d time.Duration) Option {
+	return func(o *options) { o.pollInterval = d }
+}
+
+// WithClientName sets the client name sent in the protocol handshake.
+func WithClientName(name string) Option {
+	return func(o *options) { o.name = name }
+}
+
+// WithHost sends every request on to a host of the fleet the daemon is the
+// hub of, or to all of them with protocol.AllHosts.
+func WithHost(host string) Option {
+	return func(o *options) { o.host = host }
+}
+
+// WithHTTPClient sets the HTTP client of DialHTTP, e.g. to trust a private
+// CA or present a client certificate.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(o *options) { o.httpClient = hc }
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{timeout: DefaultTimeout, pollInterval: time.Second, name: "controlman-go"}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// New returns a client using a custom transport.
+func New(t Transport, opts ...Option) *Client {
+	o := newOptions(opts)
+	return &Client{transport: t, timeout: o.timeout, pollInterval: o.pollInterval, host: o.host}
+}
+
+// Close closes the underlying connection.
+func (c *Client) Close() error {
+	return c.transport.Close()
+}
+
+// ErrorCode returns the protocol error code of an error returned by the
+// daemon (e.g. protocol.CodeNotFound), or "" for other errors.
+func ErrorCode(err error) string {
+	var perr *protocol.Error
+	if errors.As(err, &perr) {
+		return perr.Code
+	}
+	return ""
+}
+
+// Read-only actions are retried once when the connection drops.
+var idempotentActions = map[string]bool{
+	"list":         true,
+	"info":         true,
+	"logs":         true,
+	"runs":         true,
+	"hosts":        true,
+	"user-list":    true,
+	"apikey-list":  true,
+	"audit":        true,
+	"audit-verify": true,
+}
+
+// Do sends a request as it is and returns the response, whether it
+// succeeded or not. It is meant for proxies; the methods below are easier
+// to use otherwise.
+func (c *Client) Do(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	resp, err := c.transport.Do(ctx, req)
+	if errors.Is(err, errConnLost) && idempotentActions[req.Action] {
+		resp, err = c.transport.Do(ctx, req)
+	}
+	return resp, err
+}
+
+// do sends a request and returns the successful response.
+func (c *Client) do(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	if req.Host == "" {
+		req.Host = c.host
+	}
+	resp, err := c.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// call sends an action and decodes the response data into out, if not nil.
+func (c *Client) call(ctx context.Context, action, name string, payload, out any) error {
+	req, err := protocol.NewRequest(action, name, payload)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return resp.Decode(out)
+}
+
+// message sends an action and returns the message of the response.
+func (c *Client) message(ctx context.Context, action, name string) (string, error) {
+	resp, err := c.do(ctx, &protocol.Request{Action: action, Name: name})
+	if err != nil {
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+// ListServices returns all services and jobs.
+func (c *Client) ListServices(ctx context.Context) ([]ServiceInfo, error) {
+	var services []ServiceInfo
+	return services, c.call(ctx, "list", "", nil, &services)
+}
+
+// SelectServices returns the services whose labels match selector, such
+// as "stack=payments" (see service.ParseSelector).
+func (c *Client) SelectServices(ctx context.Context, selector string) ([]ServiceInfo, error) {
+	var services []ServiceInfo
+	return services, c.call(ctx, "list", "", protocol.ListRequest{Selector: selector}, &services)
+}
+
+// Bulk runs start, stop, restart or delete on the services chosen by req,
+// or lists them for a dry run, and returns the result for each. It fails
+// only when no service could be chosen; check the results for the services
+// that failed.
+func (c *Client) Bulk(ctx context.Context, action string, req *BulkRequest) ([]BulkResult, error) {
+	var results []BulkResult
+	return results, c.call(ctx, action, "", req, &results)
+}
+
+// Hosts returns the hosts of the fleet the daemon is the hub of, starting
+// with the daemon itself.
+func (c *Client) Hosts(ctx context.Context) ([]HostInfo, error) {
+	var hosts []HostInfo
+	return hosts, c.call(ctx, "hosts", "", nil, &hosts)
+}
+
+// Service returns the details of a service.
+func (c *Client) Service(ctx context.Context, name string) (*ServiceInfo, error) {
+	var info ServiceInfo
+	if err := c.call(ctx, "info", name, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// AddService adds and starts a service running opts.Exec, the executable
+// and its arguments. To run command with sh -c instead, opts.Shell must be
+// set and opts.Exec left empty.
+func (c *Client) AddService(ctx context.Context, name, command string, opts *ServiceOptions) error {
+	return c.callWithCommand(ctx, "add", name, command, opts)
+}
+
+// EditService changes a service. A command (with opts.Shell) or opts.Exec
+// replaces what the service runs; without either it is kept.
+func (c *Client) EditService(ctx context.Context, name, command string, opts *ServiceOptions) error {
+	return c.callWithCommand(ctx, "edit", name, command, opts)
+}
+
+func (c *Client) callWithCommand(ctx context.Context, action, name, command string, opts *ServiceOptions) error {
+	req, err := protocol.NewRequest(action, name, opts)
+	if err != nil {
+		return err
+	}
+	req.Command = command
+	_, err = c.do(ctx, req)
+	return err
+}
+
+func (c *Client) StartService(ctx context.Context, name string) error {
+	return c.call(ctx, "start", name, nil, nil)
+}
+
+func (c *Client) StopService(ctx context.Context, name string) error {
+	return c.call(ctx, "stop", name, nil, nil)
+}
+
+// RestartService restarts a service, one replica at a time.
+func (c *Client) RestartService(ctx context.Context, name string) error {
+	return c.call(ctx, "restart", name, nil, nil)
+}
+
+// ReloadService sends the reload signal of a service to its processes and
+// returns the daemon's summary.
+func (c *Client) ReloadService(ctx context.Context, name string) (string, error) {
+	return c.message(ctx, "reload", name)
+}
+
+func (c *Client) DeleteService(ctx context.Context, name string) error {
+	return c.call(ctx, "delete", name, nil, nil)
+}
+
+// ScaleService sets the number of instances of a service.
+func (c *Client) ScaleService(ctx context.Context, name string, replicas int) error {
+	return c.call(ctx, "scale", name, protocol.ScaleRequest{Replicas: replicas}, nil)
+}
+
+// RunJob runs a cron or oneshot job now.
+func (c *Client) RunJob(ctx context.Context, name string) error {
+	return c.call(ctx, "run", name, nil, nil)
+}
+
+// ListRuns returns the recent runs of a job.
+func (c *Client) ListRuns(ctx context.Context, name string) ([]Run, error) {
+	var runs []Run
+	return runs, c.call(ctx, "runs", name, nil, &runs)
+}
+
+// Logs returns the log file of a service.
+func (c *Client) Logs(ctx context.Context, name string) (string, error) {
+	var logs string
+	return logs, c.call(ctx, "logs", name, nil, &logs)
+}
+
+// NotifyTest publishes a test event to the notification sinks.
+func (c *Client) NotifyTest(ctx context.Context, name string) error {
+	return c.call(ctx, "notify-test", name, nil, nil)
+}
+
+func (c *Client) AddUser(ctx context.Context, name string, opts *UserOptions) error {
+	return c.call(ctx, "user-add", name, opts, nil)
+}
+
+func (c *Client) RemoveUser(ctx context.Context, name string) error {
+	return c.call(ctx, "user-remove", name, nil, nil)
+}
+
+func (c *Client) SetUserPassword(ctx context.Context, name, password string) error {
+	return c.call(ctx, "user-passwd", name, &UserOptions{Password: password}, nil)
+}
+
+func (c *Client) ListUsers(ctx context.Context) ([]UserInfo, error) {
+	var users []UserInfo
+	return users, c.call(ctx, "user-list", "", nil, &users)
+}
+
+// CreateAPIKey creates a key. The returned Token cannot be retrieved again.
+func (c *Client) CreateAPIKey(ctx context.Context, name string, opts *APIKeyOptions) (*APIKeyInfo, error) {
+	var key APIKeyInfo
+	if err := c.call(ctx, "apikey-create", name, opts, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context) ([]APIKeyInfo, error) {
+	var keys []APIKeyInfo
+	return keys, c.call(ctx, "apikey-list", "", nil, &keys)
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, id string) error {
+	return c.call(ctx, "apikey-revoke", id, nil, nil)
+}
+
+// Audit returns the audit log entries matching the query, oldest first.
+func (c *Client) Audit(ctx context.Context, q *AuditQuery) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	return entries, c.call(ctx, "audit", "", q, &entries)
+}
+
+// VerifyAudit checks the hash chain of the audit log.
+func (c *Client) VerifyAudit(ctx context.Context) (string, error) {
+	return c.message(ctx, "audit-verify", "")
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+// DialHTTP returns a client of the HTTP API at baseURL (including the base
+// path, e.g. "https://host:1984/cm"). token is an API key or a session
+// token from /api/v1/login; it may be empty when the HTTP client presents a
+// client certificate (see WithHTTPClient).
+func DialHTTP(baseURL, token string, opts ...Option) (*Client, error) {
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		return nil, fmt.Errorf("invalid API URL %q: expected http:// or https://", baseURL)
+	}
+	o := newOptions(opts)
+	hc := o.httpClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	t := &httpTransport{base: strings.TrimSuffix(baseURL, "/"), token: token, client: hc}
+	return New(t, opts...), nil
+}
+
+// httpTransport sends each request to the API's /command endpoint, which
+// answers with the same responses as the socket, and watches events with
+// /api/v1/events.
+type httpTransport struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func (t *httpTransport) Do(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.base+"/command", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := t.send(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var resp protocol.Response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	resp.ID = req.ID
+	return &resp, nil
+}
+
+// send adds the token to a request and turns error statuses into errors.
+func (t *httpTransport) send(req *http.Request) (*http.Response, error) {
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var apiErr struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	if apiErr.Error == "" {
+		apiErr.Error = resp.Status
+	}
+	return nil, &protocol.Error{Code: apiErr.Code, Message: apiErr.Error}
+}
+
+// Watch reads the server-sent events of /api/v1/events.
+func (t *httpTransport) Watch(ctx context.Context, req *WatchRequest, fn func(Event) error) error {
+	query := url.Values{}
+	for _, s := range req.Services {
+		query.Add("service", s)
+	}
+	for _, e := range req.Events {
+		query.Add("event", e)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, t.base+"/api/v1/events?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+	httpResp, err := t.send(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	scanner := bufio.NewScanner(httpResp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue // comments and blank separator lines
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return fmt.Errorf("invalid event: %v", err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("event stream: %w", errConnLost)
+}
+
+func (t *httpTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
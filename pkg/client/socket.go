@@ -0,0 +1,315 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+// errConnLost is wrapped by transport errors of requests whose connection
+// broke before they were answered.
+var errConnLost = errors.New("connection to daemon lost")
+
+// DefaultSocketPath returns ~/.controlman/controlman.sock.
+func DefaultSocketPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".controlman", "controlman.sock"), nil
+}
+
+// Dial connects to the daemon's unix socket; an empty path means
+// DefaultSocketPath. The connection is re-established on the next request
+// after it breaks.
+func Dial(socketPath string, opts ...Option) (*Client, error) {
+	if socketPath == "" {
+		var err error
+		if socketPath, err = DefaultSocketPath(); err != nil {
+			return nil, err
+		}
+	}
+	dialer := func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", socketPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to daemon: %v", err)
+		}
+		return conn, nil
+	}
+	return newSocketClient(dialer, opts)
+}
+
+// NewConn returns a client speaking the socket protocol over an established
+// connection, such as the one a fleet agent opens to its hub. The
+// connection is not re-established when it breaks.
+func NewConn(conn net.Conn, opts ...Option) (*Client, error) {
+	var once sync.Once
+	dialer := func(ctx context.Context) (net.Conn, error) {
+		err := errors.New("connection closed")
+		once.Do(func() { err = nil })
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return newSocketClient(dialer, opts)
+}
+
+func newSocketClient(dialer func(context.Context) (net.Conn, error), opts []Option) (*Client, error) {
+	o := newOptions(opts)
+	t := &socketTransport{dialer: dialer, name: o.name, timeout: o.timeout}
+
+	if err := t.connect(context.Background()); err != nil {
+		return nil, err
+	}
+	return New(t, opts...), nil
+}
+
+// socketTransport multiplexes requests over one socket connection. A reader
+// goroutine hands each response to the request with the same ID.
+type socketTransport struct {
+	dialer  func(context.Context) (net.Conn, error)
+	name    string
+	timeout time.Duration // of dialing
+
+	mu      sync.Mutex // guards the fields below and writes to conn
+	conn    *socketConn
+	dialing chan struct{} // closed when the connection being dialed is ready
+	nextID  uint64
+	closed  bool
+}
+
+type socketConn struct {
+	conn    net.Conn
+	enc     *json.Encoder
+	pending map[uint64]chan *protocol.Response // nil once the connection broke
+}
+
+// dial connects to the daemon and performs the handshake.
+func (t *socketTransport) dial(ctx context.Context) (net.Conn, *json.Decoder, *json.Encoder, error) {
+	conn, err := t.dialer(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	hello, err := protocol.NewRequest(protocol.ActionHello, "", protocol.HelloRequest{Version: protocol.Version, Client: t.name})
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	var resp protocol.Response
+	if err := enc.Encode(hello); err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to send handshake: %v", err)
+	}
+	if err := dec.Decode(&resp); err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to read handshake: %v", err)
+	}
+	if err := resp.Err(); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, dec, enc, nil
+}
+
+// connect opens the shared connection, or waits for the request that is
+// already opening it. It dials without holding t.mu, so that a slow daemon
+// does not hold up Close or requests giving up on their context.
+func (t *socketTransport) connect(ctx context.Context) error {
+	t.mu.Lock()
+	if dialing := t.dialing; dialing != nil {
+		t.mu.Unlock()
+		select {
+		case <-dialing:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	dialing := make(chan struct{})
+	t.dialing = dialing
+	t.mu.Unlock()
+
+	dialCtx, cancel := context.WithTimeout(ctx, t.timeout)
+	conn, dec, enc, err := t.dial(dialCtx)
+	cancel()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dialing = nil
+	close(dialing)
+	if err != nil {
+		return err
+	}
+	if t.closed {
+		conn.Close()
+		return errors.New("client is closed")
+	}
+	sc := &socketConn{conn: conn, enc: enc, pending: make(map[uint64]chan *protocol.Response)}
+	t.conn = sc
+	go t.readLoop(sc, dec)
+	return nil
+}
+
+// readLoop delivers responses until the connection breaks, then fails the
+// requests still waiting on it.
+func (t *socketTransport) readLoop(sc *socketConn, dec *json.Decoder) {
+	for {
+		var resp protocol.Response
+		if err := dec.Decode(&resp); err != nil {
+			break
+		}
+		t.mu.Lock()
+		ch, ok := sc.pending[resp.ID]
+		delete(sc.pending, resp.ID)
+		t.mu.Unlock()
+		if ok {
+			ch <- &resp
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sc.conn.Close()
+	if t.conn == sc {
+		t.conn = nil
+	}
+	for _, ch := range sc.pending {
+		close(ch)
+	}
+	sc.pending = nil
+}
+
+func (t *socketTransport) Do(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	sc, id, ch, err := t.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", req.Action, errConnLost)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		if sc.pending != nil {
+			delete(sc.pending, id)
+		}
+		t.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// send writes the request, reconnecting first if needed.
+func (t *socketTransport) send(ctx context.Context, req *protocol.Request) (*socketConn, uint64, chan *protocol.Response, error) {
+	t.mu.Lock()
+	for {
+		if t.closed {
+			t.mu.Unlock()
+			return nil, 0, nil, errors.New("client is closed")
+		}
+		if err := ctx.Err(); err != nil {
+			t.mu.Unlock()
+			return nil, 0, nil, err
+		}
+		if t.conn != nil {
+			break
+		}
+		t.mu.Unlock()
+		if err := t.connect(ctx); err != nil {
+			return nil, 0, nil, err
+		}
+		t.mu.Lock()
+	}
+	defer t.mu.Unlock()
+	sc := t.conn
+
+	t.nextID++
+	id := t.nextID
+	msg := *req
+	msg.ID = id
+	ch := make(chan *protocol.Response, 1)
+	sc.pending[id] = ch
+
+	if err := sc.enc.Encode(&msg); err != nil {
+		// The read loop notices the closed connection and fails the
+		// other pending requests
+		delete(sc.pending, id)
+		sc.conn.Close()
+		t.conn = nil
+		return nil, 0, nil, fmt.Errorf("failed to send command: %v: %w", err, errConnLost)
+	}
+	return sc, id, ch, nil
+}
+
+// Watch streams events over a connection of its own, so that a slow
+// handler does not hold up other requests.
+func (t *socketTransport) Watch(ctx context.Context, req *WatchRequest, fn func(Event) error) error {
+	dialCtx, cancel := context.WithTimeout(ctx, t.timeout)
+	conn, dec, enc, err := t.dial(dialCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	msg, err := protocol.NewRequest("watch", "", req)
+	if err != nil {
+		return err
+	}
+	msg.ID = 1
+	if err := enc.Encode(msg); err != nil {
+		return fmt.Errorf("failed to send command: %v: %w", err, errConnLost)
+	}
+	for {
+		var resp protocol.Response
+		if err := dec.Decode(&resp); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("event stream: %w", errConnLost)
+		}
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		if len(resp.Data) == 0 {
+			continue // the acknowledgement
+		}
+		var e Event
+		if err := resp.Decode(&e); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *socketTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.conn != nil {
+		return t.conn.conn.Close()
+	}
+	return nil
+}
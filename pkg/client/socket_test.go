@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/protocol"
+)
+
+// fakeDaemon answers every request on conn with success.
+func fakeDaemon(conn net.Conn) {
+	defer conn.Close()
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		var req protocol.Request
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		if err := enc.Encode(protocol.Response{ID: req.ID, Success: true}); err != nil {
+			return
+		}
+	}
+}
+
+// newSlowTransport returns a transport whose dials wait until release is
+// closed.
+func newSlowTransport() (t *socketTransport, release chan struct{}) {
+	release = make(chan struct{})
+	dialer := func(ctx context.Context) (net.Conn, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		go fakeDaemon(server)
+		return client, nil
+	}
+	return &socketTransport{dialer: dialer, timeout: time.Minute}, release
+}
+
+// waitDialing waits until a request is dialing the daemon.
+func waitDialing(t *testing.T, tr *socketTransport) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tr.mu.Lock()
+		dialing := tr.dialing != nil
+		tr.mu.Unlock()
+		if dialing {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the dial")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSocketDialDoesNotBlock(t *testing.T) {
+	tr, release := newSlowTransport()
+	defer tr.Close()
+	req := &protocol.Request{Action: "list"}
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := tr.Do(context.Background(), req)
+		first <- err
+	}()
+	waitDialing(t, tr)
+
+	// A request with a short deadline gives up instead of waiting for the dial
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := tr.Do(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Do during a dial = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Do during a dial returned after %s", elapsed)
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatalf("Do that dialed: %v", err)
+	}
+	// Later requests share the connection
+	tr.mu.Lock()
+	conn := tr.conn
+	tr.mu.Unlock()
+	if _, err := tr.Do(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if tr.conn != conn {
+		t.Error("a request dialed a connection of its own")
+	}
+}
+
+func TestSocketCloseWhileDialing(t *testing.T) {
+	tr, release := newSlowTransport()
+	first := make(chan error, 1)
+	go func() {
+		_, err := tr.Do(context.Background(), &protocol.Request{Action: "list"})
+		first <- err
+	}()
+	waitDialing(t, tr)
+
+	closed := make(chan struct{})
+	go func() {
+		tr.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waited for the dial")
+	}
+
+	close(release)
+	if err := <-first; err == nil || err.Error() != "client is closed" {
+		t.Errorf("Do dialing when the client closed = %v", err)
+	}
+	if tr.conn != nil {
+		t.Error("the connection dialed after Close was kept")
+	}
+}
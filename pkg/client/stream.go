@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// FollowLogs writes the log of a service to w and then keeps writing what
+// is appended to it, like tail -f, until ctx is done. When the log shrinks
+// (it was rotated) it is written again from the start.
+func (c *Client) FollowLogs(ctx context.Context, name string, w io.Writer) error {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+
+	written := 0
+	for {
+		logs, err := c.Logs(ctx, name)
+		if err != nil {
+			if finished(ctx) {
+				return nil
+			}
+			return err
+		}
+		if len(logs) < written {
+			written = 0
+		}
+		if len(logs) > written {
+			if _, err := io.WriteString(w, logs[written:]); err != nil {
+				return err
+			}
+			written = len(logs)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Watcher is implemented by transports that can push events. Events falls
+// back to polling for transports that cannot.
+type Watcher interface {
+	Watch(ctx context.Context, req *WatchRequest, fn func(Event) error) error
+}
+
+// Events calls fn for every event matching filter (nil for all) as it
+// happens, until ctx is done or fn returns an error. When the stream breaks,
+// for example because the daemon restarted, it is re-established; events
+// in between are lost.
+func (c *Client) Events(ctx context.Context, filter *WatchRequest, fn func(Event) error) error {
+	if filter == nil {
+		filter = &WatchRequest{}
+	}
+	w, ok := c.transport.(Watcher)
+	if !ok {
+		return c.pollEvents(ctx, filter, fn)
+	}
+
+	var fnErr error
+	handle := func(e Event) error {
+		fnErr = fn(e)
+		return fnErr
+	}
+	err := w.Watch(ctx, filter, handle)
+	reconnecting := errors.Is(err, errConnLost)
+	for reconnecting && fnErr == nil {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(c.pollInterval):
+		}
+		err = w.Watch(ctx, filter, handle)
+		// Keep trying while the stream breaks or the daemon is not back yet
+		reconnecting = err != nil && ErrorCode(err) == ""
+	}
+	if fnErr != nil {
+		return fnErr
+	}
+	if finished(ctx) {
+		return nil
+	}
+	return err
+}
+
+// pollEvents derives start, stop, restart and failure events from the
+// changes between successive service lists, so changes shorter than the
+// poll interval are missed.
+func (c *Client) pollEvents(ctx context.Context, filter *WatchRequest, fn func(Event) error) error {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+
+	var last map[string]ServiceInfo
+	for {
+		services, err := c.ListServices(ctx)
+		if err != nil {
+			if finished(ctx) {
+				return nil
+			}
+			return err
+		}
+
+		current := make(map[string]ServiceInfo, len(services))
+		for _, s := range services {
+			current[s.Name] = s
+			prev, ok := last[s.Name]
+			if last == nil || !ok {
+				continue
+			}
+			e := Event{Type: eventType(prev, s), Service: s.Name, PID: s.PID, Status: s.Status, Time: time.Now()}
+			if e.Type == "" || !filterMatches(filter, e) {
+				continue
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		last = current
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func filterMatches(filter *WatchRequest, e Event) bool {
+	if len(filter.Events) > 0 && !slices.Contains(filter.Events, e.Type) {
+		return false
+	}
+	if len(filter.Services) == 0 {
+		return true
+	}
+	for _, pattern := range filter.Services {
+		if ok, _ := path.Match(pattern, e.Service); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// eventType returns the lifecycle event between two states of a service.
+func eventType(prev, cur ServiceInfo) string {
+	switch {
+	case prev.Status == cur.Status && prev.PID == cur.PID:
+		return ""
+	case cur.Status == service.StatusFailed:
+		return "failed"
+	case cur.Status == service.StatusStopped:
+		return "stop"
+	case cur.Status == service.StatusRunning && prev.Status == service.StatusRunning:
+		return "restart"
+	case cur.Status == service.StatusRunning:
+		return "start"
+	}
+	return ""
+}
+
+// finished reports whether ctx is done, including when its deadline has
+// passed but the context has not noticed yet.
+func finished(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
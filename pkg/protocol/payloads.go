@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/tangthinker/controlman/pkg/service"
+)
+
+// Payloads of each action (request Data -> response Data):
+//
+//	add, edit           ServiceOptions -> -
+//	list                ListRequest    -> []ServiceInfo (payload optional)
+//	info                -              -> ServiceInfo
+//	logs                -              -> string
+//	scale               ScaleRequest   -> -
+//	runs                -              -> []service.Run
+//	start, stop, restart, delete without a name: BulkRequest -> []BulkResult
+//	start, stop, restart, reload, run, delete, notify-test: no payloads
+//	user-add, user-passwd UserRequest  -> -
+//	user-list           -              -> []UserInfo
+//	apikey-create       APIKeyRequest  -> APIKeyInfo (with Token)
+//	apikey-list         -              -> []APIKeyInfo
+//	audit               AuditQuery     -> []AuditEntry
+//	watch               WatchRequest   -> Event, Event, ... (streamed)
+//	hosts               -              -> []HostInfo
+//	hello               HelloRequest   -> HelloResponse
+
+// ServiceOptions carries the optional service settings of "add" and "edit".
+//
+// A service runs either Exec, its program and arguments without a shell,
+// or the Command of the request with sh -c. Shell only states the latter:
+// a Command without Exec is run by sh -c anyway.
+type ServiceOptions struct {
+	Exec  []string `json:"exec,omitempty"`  // executable followed by its arguments
+	Shell bool     `json:"shell,omitempty"` // run Command with sh -c; implied by Command
+
+	Hooks    *service.Hooks `json:"hooks,omitempty"`
+	Type     string         `json:"type,omitempty"`
+	Schedule string         `json:"schedule,omitempty"`
+
+	Replicas     int    `json:"replicas,omitempty"`
+	PortTemplate string `json:"port_template,omitempty"`
+	ReloadSignal string `json:"reload_signal,omitempty"`
+
+	// Labels are merged into those of the service by "edit"; an empty
+	// value removes the label.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ListRequest carries the filter of "list".
+type ListRequest struct {
+	Selector string `json:"selector,omitempty"` // label selector, see service.ParseSelector
+}
+
+// BulkRequest chooses the services that "start", "stop", "restart" or
+// "delete" act on when the request names none. A service is chosen if it
+// matches both Pattern and Selector; at least one of them is required.
+type BulkRequest struct {
+	Pattern  string `json:"pattern,omitempty"`  // "all", a glob such as "worker-*" or a name
+	Selector string `json:"selector,omitempty"` // label selector
+	Parallel int    `json:"parallel,omitempty"` // services acted on at once, default 1
+	DryRun   bool   `json:"dry_run,omitempty"`  // only report the chosen services
+
+	// Services limits the chosen services to those matching one of these
+	// patterns. Fleet hubs send the grants of their caller in it, as the
+	// agent runs the request on behalf of the hub.
+	Services []string `json:"services,omitempty"`
+}
+
+// BulkResult is the outcome of a bulk action for one service.
+type BulkResult struct {
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// ScaleRequest is the payload of "scale".
+type ScaleRequest struct {
+	Replicas int `json:"replicas"`
+}
+
+// ServiceInfo describes a service in the responses of "list" and "info".
+// The detail fields are only filled in by "info".
+type ServiceInfo struct {
+	Host      string  `json:"host,omitempty"` // set in responses of fleet hubs
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	PID       int     `json:"pid"`
+	CPU       float64 `json:"cpu"`    // percent
+	Memory    float64 `json:"memory"` // bytes
+	CreatedAt string  `json:"created_at"`
+	LastStart string  `json:"last_start"`
+	Command   string  `json:"command"` // shell command, or Exec quoted for display
+	Replicas  int     `json:"replicas"`
+	Ready     int     `json:"ready"`
+	Restarts  int     `json:"restarts"` // since the daemon started
+
+	Labels map[string]string `json:"labels,omitempty"`
+	Exec   *service.Exec     `json:"exec,omitempty"` // nil for shell commands
+
+	Type     string       `json:"type"`
+	Schedule string       `json:"schedule"`
+	NextRun  string       `json:"next_run"`
+	LastRun  *service.Run `json:"last_run"`
+
+	LogFile      string         `json:"log_file,omitempty"`
+	Hooks        *service.Hooks `json:"hooks,omitempty"`
+	Instances    []InstanceInfo `json:"instances,omitempty"`
+	PortTemplate string         `json:"port_template,omitempty"`
+	ReloadSignal string         `json:"reload_signal,omitempty"`
+}
+
+// InstanceInfo describes one instance of a replicated service.
+type InstanceInfo struct {
+	Index     int    `json:"index"`
+	PID       int    `json:"pid"` // 0 when the instance is not running
+	Port      string `json:"port"`
+	Running   bool   `json:"running"`
+	LastStart string `json:"last_start"`
+	LogFile   string `json:"log_file"`
+}
+
+// UserRequest carries the settings of "user-add" and "user-passwd".
+type UserRequest struct {
+	Password string   `json:"password"`
+	Role     string   `json:"role,omitempty"`
+	Services []string `json:"services,omitempty"`
+}
+
+// UserInfo describes a user in the response of "user-list".
+type UserInfo struct {
+	Name      string   `json:"name"`
+	Role      string   `json:"role"`
+	Services  []string `json:"services,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// APIKeyRequest carries the scopes of "apikey-create".
+type APIKeyRequest struct {
+	Actions  []string `json:"actions,omitempty"`
+	Services []string `json:"services,omitempty"`
+}
+
+// APIKeyInfo describes a key in the responses of "apikey-create" and
+// "apikey-list". Token is only set when the key is created.
+type APIKeyInfo struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Token     string   `json:"token,omitempty"`
+	Actions   []string `json:"actions"`
+	Services  []string `json:"services,omitempty"`
+	CreatedBy string   `json:"created_by"`
+	CreatedAt string   `json:"created_at"`
+	LastUsed  string   `json:"last_used,omitempty"`
+}
+
+// AuditQuery carries the filters of "audit".
+type AuditQuery struct {
+	Service string     `json:"service,omitempty"`
+	Actor   string     `json:"actor,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Limit   int        `json:"limit,omitempty"`
+}
+
+// AuditEntry records one command. Each entry includes the hash of the
+// previous one, so that removing or editing an entry breaks the chain
+// from that point on (see "audit-verify").
+type AuditEntry struct {
+	Seq     uint64          `json:"seq"`
+	Time    time.Time       `json:"time"`
+	Actor   string          `json:"actor"`
+	Role    string          `json:"role"`
+	Source  string          `json:"source"`
+	Action  string          `json:"action"`
+	Target  string          `json:"target,omitempty"`
+	Host    string          `json:"host,omitempty"` // fleet agent the command was sent on to
+	Command string          `json:"command,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"` // request Data with secrets redacted
+	Success bool            `json:"success"`
+	Code    string          `json:"code,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Prev    string          `json:"prev"`
+	Hash    string          `json:"hash"`
+}
+
+// WatchRequest carries the filters of "watch".
+type WatchRequest struct {
+	Services []string `json:"services,omitempty"` // service name patterns; empty means all
+	Events   []string `json:"events,omitempty"`   // event types; empty means all
+}
+
+// Event is a change of a service. Lifecycle events (start, stop, crash,
+// restart, reload, failed, unhealthy, test) are also sent to notification
+// sinks; state events (added, removed, status, pid) are mainly for watchers
+// and carry the old value in Message.
+type Event struct {
+	Type    string    `json:"type"`
+	Service string    `json:"service"`
+	PID     int       `json:"pid,omitempty"`
+	Status  string    `json:"status,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Host    string    `json:"host"`
+	Time    time.Time `json:"time"`
+}
+
+// HostInfo describes a host of a fleet in the response of "hosts": the
+// daemon itself (Local) and the agents connected to it.
+type HostInfo struct {
+	Name        string    `json:"name"`
+	Local       bool      `json:"local,omitempty"`
+	Address     string    `json:"address,omitempty"` // where the agent connected from
+	ConnectedAt time.Time `json:"connected_at"`      // zero for the local host
+}
@@ -0,0 +1,121 @@
+// Package protocol defines the messages exchanged between controlman clients
+// and the daemon over its unix socket.
+//
+// Each message is a JSON object on its own line. A connection starts with a
+// "hello" request carrying the client's protocol version; the daemon rejects
+// any other first request, and unsupported versions, with the
+// unsupported_version error code. After the handshake a client may send
+// several requests without waiting for their responses: every response
+// carries the ID of its request and they may arrive in any order. A "watch"
+// request is answered by a stream of responses with More set, the first
+// acknowledging it and each further one carrying an event, until the
+// connection is closed.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Version is the protocol version spoken by this package. MinVersion is the
+// oldest version the daemon still accepts.
+const (
+	Version    = 1
+	MinVersion = 1
+)
+
+// ActionHello is the action of the handshake request.
+const ActionHello = "hello"
+
+// Error codes of failed responses
+const (
+	CodeInvalidArgument    = "invalid_argument"    // the request is malformed or not allowed
+	CodeNotFound           = "not_found"           // the service, user or key does not exist
+	CodeAlreadyExists      = "already_exists"      // the service, user or key already exists
+	CodeConflict           = "conflict"            // the target is not in a state that allows the request
+	CodeForbidden          = "forbidden"           // the caller lacks the role or grant for the request
+	CodeInternal           = "internal"            // the request failed while being carried out
+	CodeUnsupportedVersion = "unsupported_version" // the client must upgrade (or the daemon)
+)
+
+// Request is a command sent to the daemon. Data holds the payload of the
+// action, see the types in payloads.go. Host sends the request on to a fleet
+// agent connected to the daemon; empty means the daemon itself, and
+// AllHosts asks every host (only "list" supports it).
+type Request struct {
+	ID      uint64          `json:"id,omitempty"`
+	Action  string          `json:"action"`
+	Name    string          `json:"name"`
+	Command string          `json:"command"`
+	Data    json.RawMessage `json:"data"`
+	Host    string          `json:"host,omitempty"`
+}
+
+// AllHosts is the Host of requests sent to every host of a fleet.
+const AllHosts = "*"
+
+// NewRequest builds a request with payload encoded as its Data. A nil
+// payload leaves Data empty.
+func NewRequest(action, name string, payload any) (*Request, error) {
+	req := &Request{Action: action, Name: name}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s request: %v", action, err)
+		}
+		req.Data = data
+	}
+	return req, nil
+}
+
+// Response answers the request with the same ID. Code is set when Success
+// is false; More is set when further responses to the request follow.
+type Response struct {
+	ID      uint64          `json:"id,omitempty"`
+	Success bool            `json:"success"`
+	Code    string          `json:"code,omitempty"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	More    bool            `json:"more,omitempty"`
+}
+
+// Err returns the failure of the response as an *Error, or nil.
+func (r *Response) Err() error {
+	if r.Success {
+		return nil
+	}
+	return &Error{Code: r.Code, Message: r.Message}
+}
+
+// Decode unmarshals Data into v.
+func (r *Response) Decode(v any) error {
+	if len(r.Data) == 0 {
+		return fmt.Errorf("response has no data")
+	}
+	if err := json.Unmarshal(r.Data, v); err != nil {
+		return fmt.Errorf("invalid response data: %v", err)
+	}
+	return nil
+}
+
+// Error is a failed response. Use errors.As to get at its Code.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// HelloRequest is the payload of the handshake.
+type HelloRequest struct {
+	Version int    `json:"version"`
+	Client  string `json:"client,omitempty"` // e.g. "controlman-cli"
+}
+
+// HelloResponse tells the client which version the daemon speaks.
+type HelloResponse struct {
+	Version    int `json:"version"`
+	MinVersion int `json:"min_version"`
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"a-b * * * *",
+		"* * * foo *",
+		"* * * * mon-",
+		"@never",
+	} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	for _, tt := range []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2024-01-01 10:07", "2024-01-01 10:08"},
+		{"*/15 * * * *", "2024-01-01 10:07", "2024-01-01 10:15"},
+		{"*/15 * * * *", "2024-01-01 10:15", "2024-01-01 10:30"},
+		{"5/20 * * * *", "2024-01-01 10:06", "2024-01-01 10:25"},
+		{"0,30 8-9 * * *", "2024-01-01 09:30", "2024-01-02 08:00"},
+		{"0 3 * * mon-fri", "2024-03-01 04:00", "2024-03-04 03:00"},
+		{"0 12 * * 7", "2024-05-06 00:00", "2024-05-12 12:00"},
+		{"0 0 1 jan,JUL *", "2024-02-10 00:00", "2024-07-01 00:00"},
+		{"@weekly", "2024-05-06 00:00", "2024-05-12 00:00"},
+		{"@hourly", "2024-12-31 23:30", "2025-01-01 00:00"},
+
+		// Both day fields restricted: either matches
+		{"30 9 1-7 * mon", "2024-05-02 10:00", "2024-05-03 09:30"},
+		{"30 9 1-7 * mon", "2024-05-07 10:00", "2024-05-13 09:30"},
+		// A day-of-month starting with "*" restricts nothing on its own:
+		// the odd days that are Mondays
+		{"0 0 */2 * mon", "2024-05-01 00:00", "2024-05-13 00:00"},
+		{"0 0 * * */3", "2024-04-30 12:00", "2024-05-01 00:00"},
+
+		// Month and year rollover
+		{"0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"59 23 31 12 *", "2024-12-31 23:59", "2025-12-31 23:59"},
+		{"0 0 29 2 *", "2024-02-28 12:00", "2024-02-29 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 30 2 *", "2024-01-01 00:00", ""},
+	} {
+		s, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tt.expr, err)
+			continue
+		}
+		got := s.Next(at(tt.from))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s = %s, want never", tt.expr, tt.from, got)
+			}
+			continue
+		}
+		if want := at(tt.want); !got.Equal(want) {
+			t.Errorf("%q after %s = %s, want %s", tt.expr, tt.from, got.Format("2006-01-02 15:04 Mon"), tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Exec is a program run directly, without a shell, so its arguments are
+// passed to it exactly as given.
+type Exec struct {
+	Path string   `json:"path"` // absolute path of the executable
+	Args []string `json:"args,omitempty"`
+}
+
+// ResolveExec checks that the program argv[0] exists and is executable,
+// looking it up in PATH if it has no slash, and returns it with the rest
+// of argv as its arguments.
+func ResolveExec(argv []string) (*Exec, error) {
+	if len(argv) == 0 || argv[0] == "" {
+		return nil, fmt.Errorf("executable is required")
+	}
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid executable %q: %v", argv[0], err)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, fmt.Errorf("invalid executable %q: %v", argv[0], err)
+	}
+	return &Exec{Path: path, Args: argv[1:]}, nil
+}
+
+// Argv returns the program followed by its arguments.
+func (e *Exec) Argv() []string {
+	return append([]string{e.Path}, e.Args...)
+}
+
+// IsShell reports whether the service runs its Command with sh -c rather
+// than a program given by Exec.
+func (s *Service) IsShell() bool {
+	return s.Exec == nil
+}
+
+// CommandLine shows what the service runs: its shell command, or its
+// program and arguments quoted as for a shell.
+func (s *Service) CommandLine() string {
+	if s.IsShell() {
+		return s.Command
+	}
+	return QuoteArgs(s.Exec.Argv())
+}
+
+// command returns the process running the service.
+func (s *Service) command() *exec.Cmd {
+	if s.IsShell() {
+		return exec.Command("sh", "-c", s.Command)
+	}
+	return exec.Command(s.Exec.Path, s.Exec.Args...)
+}
+
+// QuoteArgs joins args with spaces, quoting those a shell would split or
+// interpret.
+func QuoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	HookPreStart  = "pre-start"
+	HookPostStart = "post-start"
+	HookPreStop   = "pre-stop"
+	HookPostStop  = "post-stop"
+
+	DefaultHookTimeout = 30 * time.Second
+)
+
+// Hook is a shell command run around a lifecycle transition of a service.
+type Hook struct {
+	Command string `json:"command"`
+	Timeout string `json:"timeout,omitempty"` // Go duration, defaults to DefaultHookTimeout
+}
+
+// Hooks holds the optional lifecycle hooks of a service. A failing
+// pre-start hook aborts the start; failures of the other hooks are only
+// recorded in the service log.
+type Hooks struct {
+	PreStart  *Hook `json:"pre_start,omitempty"`
+	PostStart *Hook `json:"post_start,omitempty"`
+	PreStop   *Hook `json:"pre_stop,omitempty"`
+	PostStop  *Hook `json:"post_stop,omitempty"`
+}
+
+func (h *Hook) timeout() time.Duration {
+	if h.Timeout == "" {
+		return DefaultHookTimeout
+	}
+	d, err := time.ParseDuration(h.Timeout)
+	if err != nil || d <= 0 {
+		return DefaultHookTimeout
+	}
+	return d
+}
+
+// Validate checks that every hook timeout is a valid positive duration.
+func (h *Hooks) Validate() error {
+	if h == nil {
+		return nil
+	}
+	for name, hook := range h.byName() {
+		if hook == nil || hook.Timeout == "" {
+			continue
+		}
+		d, err := time.ParseDuration(hook.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s hook timeout %q", name, hook.Timeout)
+		}
+	}
+	return nil
+}
+
+// Merge overlays the hooks set in other onto h. A hook with an empty
+// command removes the existing hook.
+func (h *Hooks) Merge(other *Hooks) {
+	if other == nil {
+		return
+	}
+	merge := func(dst **Hook, src *Hook) {
+		if src == nil {
+			return
+		}
+		if src.Command == "" {
+			*dst = nil
+			return
+		}
+		hook := *src
+		*dst = &hook
+	}
+	merge(&h.PreStart, other.PreStart)
+	merge(&h.PostStart, other.PostStart)
+	merge(&h.PreStop, other.PreStop)
+	merge(&h.PostStop, other.PostStop)
+}
+
+// IsEmpty reports whether no hook is configured.
+func (h *Hooks) IsEmpty() bool {
+	return h == nil || (h.PreStart == nil && h.PostStart == nil && h.PreStop == nil && h.PostStop == nil)
+}
+
+func (h *Hooks) byName() map[string]*Hook {
+	return map[string]*Hook{
+		HookPreStart:  h.PreStart,
+		HookPostStart: h.PostStart,
+		HookPreStop:   h.PreStop,
+		HookPostStop:  h.PostStop,
+	}
+}
+
+// Get returns the named hook, or nil if it is not configured.
+func (h *Hooks) Get(name string) *Hook {
+	if h == nil {
+		return nil
+	}
+	return h.byName()[name]
+}
+
+// runHook runs the named hook if configured, appending its output to the service log.
+func (s *Service) runHook(name string) error {
+	hook := s.Hooks.Get(name)
+	if hook == nil || hook.Command == "" {
+		return nil
+	}
+
+	logFile, err := os.OpenFile(s.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	defer logFile.Close()
+
+	fmt.Fprintf(logFile, "[controlman] %s running %s hook: %s\n", time.Now().Format(time.RFC3339), name, hook.Command)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hook.timeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.Command)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.Env = append(os.Environ(),
+		"CONTROLMAN_SERVICE="+s.Name,
+		"CONTROLMAN_HOOK="+name,
+		"CONTROLMAN_PID="+strconv.Itoa(s.PID),
+	)
+	// Run the hook in its own process group so a timeout kills everything it spawned
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", hook.timeout())
+	}
+	if err != nil {
+		fmt.Fprintf(logFile, "[controlman] %s hook failed: %v\n", name, err)
+		return fmt.Errorf("%s hook failed: %v", name, err)
+	}
+	return nil
+}
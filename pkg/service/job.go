@@ -0,0 +1,97 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	TypeService = "service" // long-running process kept alive by the daemon
+	TypeCron    = "cron"    // job launched on a cron schedule
+	TypeOneshot = "oneshot" // job run once when started
+
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+)
+
+// Run is the record of one execution of a cron or one-shot job.
+type Run struct {
+	Trigger    string    `json:"trigger"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   float64   `json:"duration"` // seconds
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// IsJob reports whether the service is a cron or one-shot job rather than
+// a long-running process.
+func (s *Service) IsJob() bool {
+	return s.Type == TypeCron || s.Type == TypeOneshot
+}
+
+// RunJob executes the job in the foreground and waits for it to exit.
+// onStart is called with the PID once the process has been started.
+// The pre-start hook runs before the job and aborts it on failure; the
+// post-stop hook runs after it finished.
+func (s *Service) RunJob(trigger string, onStart func(pid int)) *Run {
+	run := &Run{Trigger: trigger, StartedAt: time.Now(), ExitCode: -1}
+	defer func() {
+		run.FinishedAt = time.Now()
+		run.Duration = run.FinishedAt.Sub(run.StartedAt).Seconds()
+	}()
+
+	if err := s.runHook(HookPreStart); err != nil {
+		run.Error = err.Error()
+		return run
+	}
+
+	logFile, err := os.OpenFile(s.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		run.Error = fmt.Sprintf("failed to open log file: %v", err)
+		return run
+	}
+	defer logFile.Close()
+
+	fmt.Fprintf(logFile, "[controlman] %s starting %s run\n", run.StartedAt.Format(time.RFC3339), trigger)
+
+	cmd := s.command()
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		run.Error = fmt.Sprintf("failed to start job: %v", err)
+		return run
+	}
+
+	s.PID = cmd.Process.Pid
+	s.LastStarted = run.StartedAt
+	if onStart != nil {
+		onStart(s.PID)
+	}
+
+	err = cmd.Wait()
+	s.PID = 0
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		run.ExitCode = 0
+	case errors.As(err, &exitErr):
+		run.ExitCode = exitErr.ExitCode()
+		run.Error = err.Error()
+	default:
+		run.Error = err.Error()
+	}
+
+	fmt.Fprintf(logFile, "[controlman] %s run finished with exit code %d\n", time.Now().Format(time.RFC3339), run.ExitCode)
+
+	_ = s.runHook(HookPostStop)
+
+	return run
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Longest label key or value
+const maxLabelLength = 63
+
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?$`)
+)
+
+// ValidateLabelKey checks that key may name a label: letters, digits and
+// ".", "_", "-" or "/" inside, at most 63 characters.
+func ValidateLabelKey(key string) error {
+	if len(key) > maxLabelLength || !labelKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	return nil
+}
+
+// ValidateLabels checks the keys and values of labels. Empty values are
+// allowed, as MergeLabels removes those labels.
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if err := ValidateLabelKey(key); err != nil {
+			return err
+		}
+		if value != "" && (len(value) > maxLabelLength || !labelValuePattern.MatchString(value)) {
+			return fmt.Errorf("invalid value %q of label %s", value, key)
+		}
+	}
+	return nil
+}
+
+// MergeLabels sets the labels of other on s. A label with an empty value
+// removes the existing label.
+func (s *Service) MergeLabels(other map[string]string) {
+	for key, value := range other {
+		if value == "" {
+			delete(s.Labels, key)
+			continue
+		}
+		if s.Labels == nil {
+			s.Labels = make(map[string]string)
+		}
+		s.Labels[key] = value
+	}
+	if len(s.Labels) == 0 {
+		s.Labels = nil
+	}
+}
+
+// FormatLabels writes labels as "key=value" pairs sorted by key and
+// separated by commas.
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Selector chooses services by their labels. Its requirements, separated
+// by commas, must all hold:
+//
+//	key=value            the label is set to value ("==" works too)
+//	key!=value           the label is not set to value, or not set at all
+//	key in (v1,v2)       the label is set to one of the values
+//	key notin (v1,v2)    the label is set to none of the values, or not set
+//	key                  the label is set
+//	!key                 the label is not set
+//
+// The empty selector matches every service.
+type Selector []labelRequirement
+
+type labelRequirement struct {
+	key    string
+	value  string
+	values []string // of "in" and "notin"
+	op     string   // "=", "!=", "in", "notin", "exists" or "!exists"
+	source string
+}
+
+var setRequirementPattern = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+// splitSelector splits a selector at the commas that are not inside the
+// parentheses of a set.
+func splitSelector(s string) ([]string, error) {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+		if depth < 0 || depth > 1 {
+			return nil, fmt.Errorf("invalid selector %q: unbalanced parentheses", s)
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("invalid selector %q: unbalanced parentheses", s)
+	}
+	return append(parts, s[start:]), nil
+}
+
+// ParseSelector parses a selector such as "stack=payments,tier!=db" or
+// "tier in (api,web)".
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	if strings.TrimSpace(s) == "" {
+		return sel, nil
+	}
+	parts, err := splitSelector(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		r := labelRequirement{source: part}
+		if m := setRequirementPattern.FindStringSubmatch(part); m != nil {
+			r.key, r.op = m[1], m[2]
+			for _, value := range strings.Split(m[3], ",") {
+				value = strings.TrimSpace(value)
+				if value == "" || len(value) > maxLabelLength || !labelValuePattern.MatchString(value) {
+					return nil, fmt.Errorf("invalid selector %q: invalid value %q", part, value)
+				}
+				r.values = append(r.values, value)
+			}
+			if err := ValidateLabelKey(r.key); err != nil {
+				return nil, fmt.Errorf("invalid selector %q: %v", part, err)
+			}
+			sel = append(sel, r)
+			continue
+		}
+		switch {
+		case strings.ContainsAny(part, "()"):
+			return nil, fmt.Errorf("invalid selector %q: expected key in (values) or key notin (values)", part)
+		case strings.Contains(part, "!="):
+			r.op = "!="
+			r.key, r.value, _ = strings.Cut(part, "!=")
+		case strings.Contains(part, "="):
+			r.op = "="
+			r.key, r.value, _ = strings.Cut(part, "=")
+			r.value = strings.TrimPrefix(r.value, "=")
+		case strings.HasPrefix(part, "!"):
+			r.op = "!exists"
+			r.key = strings.TrimPrefix(part, "!")
+		default:
+			r.op = "exists"
+			r.key = part
+		}
+		r.key, r.value = strings.TrimSpace(r.key), strings.TrimSpace(r.value)
+		if err := ValidateLabelKey(r.key); err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %v", part, err)
+		}
+		if (r.op == "=" || r.op == "!=") && r.value == "" {
+			return nil, fmt.Errorf("invalid selector %q: missing value", part)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels meet every requirement of the selector.
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, r := range sel {
+		value, ok := labels[r.key]
+		switch r.op {
+		case "=":
+			if !ok || value != r.value {
+				return false
+			}
+		case "!=":
+			if ok && value == r.value {
+				return false
+			}
+		case "in":
+			if !ok || !slices.Contains(r.values, value) {
+				return false
+			}
+		case "notin":
+			if ok && slices.Contains(r.values, value) {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Empty reports whether the selector matches every service.
+func (sel Selector) Empty() bool {
+	return len(sel) == 0
+}
+
+func (sel Selector) String() string {
+	parts := make([]string, len(sel))
+	for i, r := range sel {
+		parts[i] = r.source
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	services := map[string]map[string]string{
+		"pay-api": {"stack": "payments", "tier": "api"},
+		"pay-db":  {"stack": "payments", "tier": "db"},
+		"web":     {"stack": "shop", "tier": "api", "canary": "true"},
+		"cron":    nil,
+	}
+	names := []string{"cron", "pay-api", "pay-db", "web"}
+
+	for _, tt := range []struct {
+		selector string
+		want     string
+	}{
+		{"", "cron,pay-api,pay-db,web"},
+		{"  ", "cron,pay-api,pay-db,web"},
+		{"stack=payments", "pay-api,pay-db"},
+		{"stack==payments", "pay-api,pay-db"},
+		{" stack = payments ", "pay-api,pay-db"},
+		{"stack!=payments", "cron,web"},
+		{"stack=payments,tier!=db", "pay-api"},
+		{"stack=nothing", ""},
+		{"canary", "web"},
+		{"!canary", "cron,pay-api,pay-db"},
+		{"!stack", "cron"},
+		{"tier in (api)", "pay-api,web"},
+		{"tier in (db, api)", "pay-api,pay-db,web"},
+		{"tier in(db)", "pay-db"},
+		{"tier notin (api)", "cron,pay-db"},
+		{"stack in (payments,shop),tier notin (db)", "pay-api,web"},
+		{"tier in (api),!canary", "pay-api"},
+	} {
+		sel, err := ParseSelector(tt.selector)
+		if err != nil {
+			t.Errorf("ParseSelector(%q): %v", tt.selector, err)
+			continue
+		}
+		var matched []string
+		for _, name := range names {
+			if sel.Matches(services[name]) {
+				matched = append(matched, name)
+			}
+		}
+		if got := strings.Join(matched, ","); got != tt.want {
+			t.Errorf("%q matches %s, want %s", tt.selector, got, tt.want)
+		}
+		if sel.Empty() != (strings.TrimSpace(tt.selector) == "") {
+			t.Errorf("%q: Empty() = %v", tt.selector, sel.Empty())
+		}
+	}
+}
+
+func TestSelectorString(t *testing.T) {
+	sel, err := ParseSelector(" stack=payments , tier in (api, web),!canary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sel.String(), "stack=payments,tier in (api, web),!canary"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, tt := range []struct {
+		selector string
+		err      string
+	}{
+		{"stack=", "missing value"},
+		{"stack!=", "missing value"},
+		{"=payments", "invalid label key"},
+		{"!", "invalid label key"},
+		{"stack=payments,", "invalid label key"},
+		{",stack=payments", "invalid label key"},
+		{"sta ck=payments", "invalid label key"},
+		{"-stack", "invalid label key"},
+		{"tier in ()", "invalid value"},
+		{"tier in (api,)", "invalid value"},
+		{"tier in (a b)", "invalid value"},
+		{"tier in (api", "unbalanced parentheses"},
+		{"tier in api)", "unbalanced parentheses"},
+		{"tier in ((api))", "unbalanced parentheses"},
+		{"tier within (api)", "expected key in (values)"},
+		{"tier in (api) x", "expected key in (values)"},
+		{"t(ier in (api)", "unbalanced parentheses"},
+		{"bad/ key in (api)", "expected key in (values)"},
+	} {
+		sel, err := ParseSelector(tt.selector)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseSelector(%q) = %v, %v; want an error with %q", tt.selector, sel, err, tt.err)
+		}
+	}
+}
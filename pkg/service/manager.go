@@ -1,11 +1,13 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/pebble"
@@ -14,15 +16,28 @@ import (
 const (
 	// DB Prefix
 	prefixService = "services"
+	prefixRun     = "runs"
 	separator     = ":"
 
+	// Number of run records kept per job
+	maxRunsPerService = 100
+
 	// Field names
 	fieldCommand     = "command"
+	fieldExec        = "exec"
 	fieldStatus      = "status"
 	fieldPID         = "pid"
 	fieldCreatedAt   = "created_at"
 	fieldLastStarted = "last_started"
 	fieldLogFile     = "log_file"
+	fieldHooks       = "hooks"
+	fieldType        = "type"
+	fieldSchedule    = "schedule"
+	fieldReplicas    = "replicas"
+	fieldPortTmpl    = "port_template"
+	fieldInstances   = "instances"
+	fieldReloadSig   = "reload_signal"
+	fieldLabels      = "labels"
 
 	StatusRunning    = "running"
 	StatusStopped    = "stopped"
@@ -30,12 +45,87 @@ const (
 	StatusStarting   = "starting"
 	StatusStopping   = "stopping"
 	StatusRestarting = "restarting"
+	StatusScheduled  = "scheduled"
+	StatusCompleted  = "completed"
 	StatusUnknown    = "unknown"
 )
 
 type ServiceManager struct {
 	baseDir string
 	db      *pebble.DB
+
+	mu       sync.Mutex
+	states   map[string]serviceState // last saved state, tracked once Watch is called
+	watchers []func(Change)
+}
+
+type serviceState struct {
+	status string
+	pid    int
+}
+
+// Change describes how a save or delete changed a service. Saves that keep
+// the status and PID are not reported.
+type Change struct {
+	Name      string
+	Added     bool
+	Removed   bool
+	OldStatus string
+	Status    string
+	OldPID    int
+	PID       int
+}
+
+// Watch calls fn after every save or delete that adds or removes a service
+// or changes its status or PID. fn must not block.
+func (sm *ServiceManager) Watch(fn func(Change)) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.states == nil {
+		services, err := sm.ListServices()
+		if err != nil {
+			return err
+		}
+		sm.states = make(map[string]serviceState, len(services))
+		for _, s := range services {
+			sm.states[s.Name] = serviceState{status: s.Status, pid: s.PID}
+		}
+	}
+	sm.watchers = append(sm.watchers, fn)
+	return nil
+}
+
+// track records the new state of a service and notifies the watchers.
+func (sm *ServiceManager) track(name string, state *serviceState, removed bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.states == nil {
+		return
+	}
+
+	old, existed := sm.states[name]
+	c := Change{Name: name, OldStatus: old.status, OldPID: old.pid}
+	switch {
+	case removed:
+		if !existed {
+			return
+		}
+		delete(sm.states, name)
+		c.Removed = true
+	default:
+		if state.pid < 0 {
+			state.pid = old.pid // status-only update
+		}
+		if existed && *state == old {
+			return
+		}
+		sm.states[name] = *state
+		c.Added = !existed
+		c.Status, c.PID = state.status, state.pid
+	}
+	for _, fn := range sm.watchers {
+		fn(c)
+	}
 }
 
 func NewServiceManager() (*ServiceManager, error) {
@@ -69,13 +159,23 @@ func (sm *ServiceManager) Close() error {
 	return nil
 }
 
+// DB returns the underlying store so that other daemon state can be kept
+// next to the services. Keys must not use the service or run prefixes.
+func (sm *ServiceManager) DB() *pebble.DB {
+	return sm.db
+}
+
 func (sm *ServiceManager) GetServiceDir(name string) string {
 	return filepath.Join(sm.baseDir, name)
 }
 
 func (sm *ServiceManager) SetServiceStatus(name string, status string) error {
 	key := makeKey(name, fieldStatus)
-	return sm.db.Set(key, []byte(status), pebble.Sync)
+	if err := sm.db.Set(key, []byte(status), pebble.Sync); err != nil {
+		return err
+	}
+	sm.track(name, &serviceState{status: status, pid: -1}, false)
+	return nil
 }
 
 func (sm *ServiceManager) SaveService(s *Service) error {
@@ -94,7 +194,11 @@ func (sm *ServiceManager) SaveService(s *Service) error {
 		return err
 	}
 
-	return batch.Commit(pebble.Sync)
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return err
+	}
+	sm.track(s.Name, &serviceState{status: s.Status, pid: s.PID}, false)
+	return nil
 }
 
 func (sm *ServiceManager) saveServiceToBatch(batch *pebble.Batch, s *Service) error {
@@ -107,13 +211,58 @@ func (sm *ServiceManager) saveServiceToBatch(batch *pebble.Batch, s *Service) er
 		return batch.Set(k(field), []byte(val), nil)
 	}
 
+	hooks := ""
+	if !s.Hooks.IsEmpty() {
+		data, err := json.Marshal(s.Hooks)
+		if err != nil {
+			return err
+		}
+		hooks = string(data)
+	}
+
+	execSpec := ""
+	if s.Exec != nil {
+		data, err := json.Marshal(s.Exec)
+		if err != nil {
+			return err
+		}
+		execSpec = string(data)
+	}
+
+	labels := ""
+	if len(s.Labels) > 0 {
+		data, err := json.Marshal(s.Labels)
+		if err != nil {
+			return err
+		}
+		labels = string(data)
+	}
+
+	instances := ""
+	if s.IsReplicated() {
+		data, err := json.Marshal(s.Instances)
+		if err != nil {
+			return err
+		}
+		instances = string(data)
+	}
+
 	updates := map[string]string{
 		fieldCommand:     s.Command,
+		fieldExec:        execSpec,
 		fieldStatus:      s.Status,
 		fieldPID:         strconv.Itoa(s.PID),
 		fieldCreatedAt:   s.CreatedAt.Format(time.RFC3339),
 		fieldLastStarted: s.LastStarted.Format(time.RFC3339),
 		fieldLogFile:     s.LogFile,
+		fieldHooks:       hooks,
+		fieldType:        s.Type,
+		fieldSchedule:    s.Schedule,
+		fieldReplicas:    strconv.Itoa(s.Replicas),
+		fieldPortTmpl:    s.PortTemplate,
+		fieldInstances:   instances,
+		fieldReloadSig:   s.ReloadSignal,
+		fieldLabels:      labels,
 	}
 
 	for field, val := range updates {
@@ -199,14 +348,91 @@ func (sm *ServiceManager) DeleteService(name string) error {
 	if err := sm.db.DeleteRange(prefix, upperBound, pebble.Sync); err != nil {
 		return err
 	}
+	if err := sm.db.DeleteRange(makeRunPrefix(name), makeRunUpperBound(name), pebble.Sync); err != nil {
+		return err
+	}
+	sm.track(name, nil, true)
 
 	// Also clean up the service directory (logs, pids)
 	serviceDir := sm.GetServiceDir(name)
 	return os.RemoveAll(serviceDir)
 }
 
+// SaveRun appends a run record of a job and prunes the oldest records
+// beyond maxRunsPerService.
+func (sm *ServiceManager) SaveRun(name string, run *Run) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	key := []byte(fmt.Sprintf("%s%020d", makeRunPrefix(name), run.StartedAt.UnixNano()))
+	if err := sm.db.Set(key, data, pebble.Sync); err != nil {
+		return err
+	}
+
+	iter, err := sm.db.NewIter(&pebble.IterOptions{
+		LowerBound: makeRunPrefix(name),
+		UpperBound: makeRunUpperBound(name),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	count := 0
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		count++
+		if count > maxRunsPerService {
+			// Everything from here down is older than what we keep
+			end := append([]byte(nil), iter.Key()...)
+			end = append(end, 0)
+			return sm.db.DeleteRange(makeRunPrefix(name), end, pebble.Sync)
+		}
+	}
+	return nil
+}
+
+// ListRuns returns up to limit run records of a job, newest first.
+func (sm *ServiceManager) ListRuns(name string, limit int) ([]*Run, error) {
+	iter, err := sm.db.NewIter(&pebble.IterOptions{
+		LowerBound: makeRunPrefix(name),
+		UpperBound: makeRunUpperBound(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var runs []*Run
+	for iter.Last(); iter.Valid() && (limit <= 0 || len(runs) < limit); iter.Prev() {
+		run := &Run{}
+		if err := json.Unmarshal(iter.Value(), run); err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// LastRun returns the most recent run of a job, or nil if it never ran.
+func (sm *ServiceManager) LastRun(name string) (*Run, error) {
+	runs, err := sm.ListRuns(name, 1)
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+	return runs[0], nil
+}
+
 // Helper functions
 
+func makeRunPrefix(name string) []byte {
+	return []byte(fmt.Sprintf("%s%s%s%s", prefixRun, separator, name, separator))
+}
+
+func makeRunUpperBound(name string) []byte {
+	return []byte(fmt.Sprintf("%s%s%s;", prefixRun, separator, name))
+}
+
 func makeKey(name, field string) []byte {
 	return []byte(fmt.Sprintf("%s%s%s%s%s", prefixService, separator, name, separator, field))
 }
@@ -237,6 +463,13 @@ func parseField(s *Service, key, val string) {
 	switch field {
 	case fieldCommand:
 		s.Command = val
+	case fieldExec:
+		if val != "" {
+			s.Exec = &Exec{}
+			if err := json.Unmarshal([]byte(val), s.Exec); err != nil {
+				s.Exec = nil
+			}
+		}
 	case fieldStatus:
 		s.Status = val
 	case fieldPID:
@@ -247,5 +480,34 @@ func parseField(s *Service, key, val string) {
 		s.LastStarted, _ = time.Parse(time.RFC3339, val)
 	case fieldLogFile:
 		s.LogFile = val
+	case fieldType:
+		s.Type = val
+	case fieldSchedule:
+		s.Schedule = val
+	case fieldReplicas:
+		s.Replicas, _ = strconv.Atoi(val)
+	case fieldPortTmpl:
+		s.PortTemplate = val
+	case fieldReloadSig:
+		s.ReloadSignal = val
+	case fieldInstances:
+		if val != "" {
+			if err := json.Unmarshal([]byte(val), &s.Instances); err != nil {
+				s.Instances = nil
+			}
+		}
+	case fieldLabels:
+		if val != "" {
+			if err := json.Unmarshal([]byte(val), &s.Labels); err != nil {
+				s.Labels = nil
+			}
+		}
+	case fieldHooks:
+		if val != "" {
+			s.Hooks = &Hooks{}
+			if err := json.Unmarshal([]byte(val), s.Hooks); err != nil {
+				s.Hooks = nil
+			}
+		}
 	}
 }
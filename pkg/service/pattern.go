@@ -0,0 +1,37 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// AllServices is the pattern matching every service.
+const AllServices = "all"
+
+// IsPattern reports whether name is "all" or a glob such as "worker-*"
+// rather than the name of one service.
+func IsPattern(name string) bool {
+	return name == AllServices || strings.ContainsAny(name, "*?[")
+}
+
+// ValidateName checks that name can be told apart from a pattern.
+func ValidateName(name string) error {
+	if IsPattern(name) {
+		return fmt.Errorf("invalid service name %q: must not be %q or contain *, ? or [", name, AllServices)
+	}
+	return nil
+}
+
+// MatchName reports whether the service name matches pattern, which is
+// "all", a glob in the syntax of path.Match or a plain name.
+func MatchName(pattern, name string) (bool, error) {
+	if pattern == AllServices {
+		return true, nil
+	}
+	ok, err := path.Match(pattern, name)
+	if err != nil {
+		return false, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return ok, nil
+}
@@ -12,39 +12,86 @@ import (
 
 type Service struct {
 	Name        string
-	Command     string
+	Command     string // shell command run with sh -c, when Exec is nil
+	Exec        *Exec  // program run without a shell
 	Status      string
 	PID         int
 	CreatedAt   time.Time
 	LastStarted time.Time
 	LogFile     string
+	Hooks       *Hooks
+	Type        string // TypeService, TypeCron or TypeOneshot; empty means TypeService
+	Schedule    string // cron expression of TypeCron jobs
+
+	Replicas     int         // number of instances; 0 and 1 both mean a single process
+	PortTemplate string      // template for the PORT variable of each instance
+	Instances    []*Instance // processes of a replicated service
+	ReloadSignal string      // signal sent by reload; empty means DefaultReloadSignal
+
+	Labels map[string]string // chosen by selectors, see ParseSelector
 }
 
 func (s *Service) Start() error {
-	// 构建完整的命令，使用nohup和&，并使用 >> 追加日志
-	cmdStr := fmt.Sprintf("nohup %s >> %s 2>&1 & echo $!", s.Command, s.LogFile)
-	cmd := exec.Command("sh", "-c", cmdStr)
+	if err := s.runHook(HookPreStart); err != nil {
+		return err
+	}
 
-	// 执行命令并获取输出
-	output, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to start service: %v", err)
+	if s.IsReplicated() {
+		s.syncInstances()
+		for _, inst := range s.Instances {
+			if err := s.StartInstance(inst.Index); err != nil {
+				return err
+			}
+		}
+	} else {
+		env, _, err := s.instanceEnv(1)
+		if err != nil {
+			return err
+		}
+		pid, err := s.launch(s.LogFile, env)
+		if err != nil {
+			return err
+		}
+		s.PID = pid
+		s.LastStarted = time.Now()
 	}
 
-	// 解析PID
-	pidStr := strings.TrimSpace(string(output))
-	pid, err := strconv.Atoi(pidStr)
+	// post-start 失败只记录到服务日志，不影响已启动的进程
+	_ = s.runHook(HookPostStart)
+
+	return nil
+}
+
+// launch starts the program, or the shell command with sh -c, in the
+// background in a session of its own with its output appended to logFile
+// and returns the PID of the new process.
+func (s *Service) launch(logFile string, env []string) (int, error) {
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to parse PID: %v", err)
+		return 0, fmt.Errorf("failed to open log file: %v", err)
 	}
+	defer f.Close()
 
-	s.PID = pid
-	s.LastStarted = time.Now()
+	cmd := s.command()
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = f
+	cmd.Stderr = f
+	// 新建会话，与 nohup 一样不受守护进程终端的影响
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start service: %v", err)
+	}
 
-	return nil
+	// 回收退出的进程，否则僵尸进程仍会被当作在运行
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
 }
 
 func (s *Service) Stop() error {
+	if s.IsReplicated() {
+		return s.stopInstances()
+	}
+
 	if s.PID == 0 {
 		return nil
 	}
@@ -56,13 +103,58 @@ func (s *Service) Stop() error {
 		return nil
 	}
 
+	// pre-stop 失败同样只记录日志，仍然继续停止
+	_ = s.runHook(HookPreStop)
+
 	// 强制终止进程
-	if err := syscall.Kill(s.PID, syscall.SIGKILL); err != nil {
+	if err := kill(s.PID); err != nil {
 		return fmt.Errorf("failed to stop service: %v", err)
 	}
 
 	s.PID = 0
 
+	_ = s.runHook(HookPostStop)
+
+	return nil
+}
+
+// kill terminates a process started by launch together with the processes
+// it started; see signal.
+func kill(pid int) error {
+	return signal(pid, syscall.SIGKILL)
+}
+
+// signal sends sig to a process started by launch and to the processes it
+// started, such as those of a shell command: it leads its own process
+// group. Processes started by earlier versions, which ran shell commands
+// with nohup, lead none and get the signal alone.
+func signal(pid int, sig syscall.Signal) error {
+	if err := syscall.Kill(-pid, sig); err == nil {
+		return nil
+	}
+	return syscall.Kill(pid, sig)
+}
+
+func (s *Service) stopInstances() error {
+	if !s.IsRunning() {
+		for _, inst := range s.Instances {
+			inst.PID = 0
+		}
+		s.PID = 0
+		return nil
+	}
+
+	_ = s.runHook(HookPreStop)
+
+	for _, inst := range s.Instances {
+		if err := s.StopInstance(inst.Index); err != nil {
+			return err
+		}
+	}
+	s.PID = 0
+
+	_ = s.runHook(HookPostStop)
+
 	return nil
 }
 
@@ -74,15 +166,39 @@ func (s *Service) Restart() error {
 }
 
 func (s *Service) GetLogs() (string, error) {
-	data, err := os.ReadFile(s.LogFile)
-	if err != nil {
-		return "", fmt.Errorf("failed to read log file: %v", err)
+	if !s.IsReplicated() {
+		data, err := os.ReadFile(s.LogFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read log file: %v", err)
+		}
+		return string(data), nil
+	}
+
+	var logs strings.Builder
+	for _, inst := range s.Instances {
+		data, err := os.ReadFile(inst.LogFile)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read log file: %v", err)
+		}
+		fmt.Fprintf(&logs, "==> instance %d <==\n%s\n", inst.Index, data)
 	}
-	return string(data), nil
+	return logs.String(), nil
 }
 
 func (s *Service) IsRunning() bool {
-	if s.PID == 0 {
+	if s.IsReplicated() {
+		for _, inst := range s.Instances {
+			if inst.IsRunning() {
+				return true
+			}
+		}
+		return false
+	}
+	return processAlive(s.PID)
+}
+
+func processAlive(pid int) bool {
+	if pid == 0 {
 		return false
 	}
 
@@ -90,20 +206,37 @@ func (s *Service) IsRunning() bool {
 	// 如果返回 nil，说明进程存在且有权限发送信号
 	// 如果返回 EPERM，说明进程存在但无权限（由于我们是管理自己的进程，通常意味着存在）
 	// 如果返回 ESRCH，说明进程不存在
-	err := syscall.Kill(s.PID, 0)
+	err := syscall.Kill(pid, 0)
 	return err == nil || err == syscall.EPERM
 }
 
+// GetStats returns the CPU usage and resident memory in bytes of the
+// service, summed over all instances of a replicated service.
 func (s *Service) GetStats() (float64, float64, error) {
-	if s.PID == 0 {
+	if !s.IsReplicated() {
+		return processStats(s.PID)
+	}
+
+	var cpu, mem float64
+	for _, inst := range s.Instances {
+		// An instance may exit between the liveness check and ps; count it as idle
+		c, m, _ := processStats(inst.PID)
+		cpu += c
+		mem += m
+	}
+	return cpu, mem, nil
+}
+
+func processStats(pid int) (float64, float64, error) {
+	if pid == 0 {
 		return 0, 0, nil
 	}
 	// Check if process is running
-	if !s.IsRunning() {
+	if !processAlive(pid) {
 		return 0, 0, nil
 	}
 
-	cmd := exec.Command("ps", "-p", strconv.Itoa(s.PID), "-o", "%cpu,rss")
+	cmd := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "%cpu,rss")
 	output, err := cmd.Output()
 	if err != nil {
 		return 0, 0, err
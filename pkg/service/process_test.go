@@ -0,0 +1,70 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a few seconds passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// alive reports whether the process exists and has not exited.
+func alive(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesized command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestShellService(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "service.log")
+	s := &Service{
+		Name:    "shell",
+		Command: `echo "first $INSTANCE"; echo second >&2 && sleep 300 & echo "child $!"; wait`,
+		LogFile: logFile,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+
+	var child int
+	waitFor(t, "the command to log", func() bool {
+		data, _ := os.ReadFile(logFile)
+		for _, line := range strings.Split(string(data), "\n") {
+			if pid, ok := strings.CutPrefix(line, "child "); ok {
+				child, _ = strconv.Atoi(pid)
+			}
+		}
+		return child != 0 && strings.Contains(string(data), "second\n")
+	})
+	data, _ := os.ReadFile(logFile)
+	if !strings.Contains(string(data), "first 1\n") {
+		t.Errorf("log lacks the first command and its environment:\n%s", data)
+	}
+	if !s.IsRunning() {
+		t.Fatal("the service is not running")
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	waitFor(t, "the service to stop", func() bool { return !s.IsRunning() })
+	waitFor(t, "the process started by the shell to stop", func() bool { return !alive(child) })
+}
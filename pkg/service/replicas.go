@@ -0,0 +1,231 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// Instance is one process of a replicated service.
+type Instance struct {
+	Index       int       `json:"index"` // 1-based
+	PID         int       `json:"pid"`
+	Port        string    `json:"port,omitempty"`
+	LastStarted time.Time `json:"last_started"`
+	LogFile     string    `json:"log_file"`
+}
+
+// PortTemplateData is the data available to a port template,
+// e.g. "{{add 8000 .Instance}}".
+type PortTemplateData struct {
+	Name     string
+	Instance int // 1-based
+	Index    int // 0-based
+}
+
+var portTemplateFuncs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"mul": func(a, b int) int { return a * b },
+}
+
+// RenderPort evaluates a port template for the given 1-based instance number.
+func RenderPort(tmpl, name string, instance int) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+	t, err := template.New("port").Funcs(portTemplateFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid port template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, PortTemplateData{Name: name, Instance: instance, Index: instance - 1}); err != nil {
+		return "", fmt.Errorf("invalid port template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// IsReplicated reports whether the service runs more than one instance.
+// Single-instance services keep using PID and LogFile directly.
+func (s *Service) IsReplicated() bool {
+	return s.Replicas > 1
+}
+
+// instanceLogFile returns the log file of instance n. Instance 1 shares
+// the service log so that scaling up and down keeps its history.
+func (s *Service) instanceLogFile(n int) string {
+	if n == 1 {
+		return s.LogFile
+	}
+	return filepath.Join(filepath.Dir(s.LogFile), fmt.Sprintf("service-%d.log", n))
+}
+
+// LogFiles returns the log files of all instances.
+func (s *Service) LogFiles() []string {
+	if !s.IsReplicated() {
+		return []string{s.LogFile}
+	}
+	files := make([]string, 0, len(s.Instances))
+	for _, inst := range s.Instances {
+		files = append(files, inst.LogFile)
+	}
+	return files
+}
+
+func (s *Service) instanceEnv(n int) ([]string, string, error) {
+	env := []string{"INSTANCE=" + strconv.Itoa(n)}
+	port, err := RenderPort(s.PortTemplate, s.Name, n)
+	if err != nil {
+		return nil, "", err
+	}
+	if port != "" {
+		env = append(env, "PORT="+port)
+	}
+	return env, port, nil
+}
+
+// syncInstances makes Instances match Replicas, keeping existing instances.
+func (s *Service) syncInstances() {
+	for len(s.Instances) < s.Replicas {
+		n := len(s.Instances) + 1
+		s.Instances = append(s.Instances, &Instance{Index: n, LogFile: s.instanceLogFile(n)})
+	}
+	s.Instances = s.Instances[:s.Replicas]
+}
+
+// IsRunning reports whether the instance process is alive.
+func (inst *Instance) IsRunning() bool {
+	return processAlive(inst.PID)
+}
+
+// StartInstance starts instance n of a replicated service if it is not running.
+func (s *Service) StartInstance(n int) error {
+	if n < 1 || n > len(s.Instances) {
+		return fmt.Errorf("instance %d does not exist", n)
+	}
+	inst := s.Instances[n-1]
+	if inst.IsRunning() {
+		return nil
+	}
+
+	env, port, err := s.instanceEnv(n)
+	if err != nil {
+		return err
+	}
+	pid, err := s.launch(inst.LogFile, env)
+	if err != nil {
+		return fmt.Errorf("instance %d: %v", n, err)
+	}
+	inst.PID = pid
+	inst.Port = port
+	inst.LastStarted = time.Now()
+	s.mirrorInstances()
+	return nil
+}
+
+// StopInstance kills instance n of a replicated service.
+func (s *Service) StopInstance(n int) error {
+	if n < 1 || n > len(s.Instances) {
+		return fmt.Errorf("instance %d does not exist", n)
+	}
+	inst := s.Instances[n-1]
+	if inst.IsRunning() {
+		if err := kill(inst.PID); err != nil {
+			return fmt.Errorf("failed to stop instance %d: %v", n, err)
+		}
+	}
+	inst.PID = 0
+	s.mirrorInstances()
+	return nil
+}
+
+// RunningInstances returns the number of live processes of the service.
+func (s *Service) RunningInstances() int {
+	if !s.IsReplicated() {
+		if s.IsRunning() {
+			return 1
+		}
+		return 0
+	}
+	count := 0
+	for _, inst := range s.Instances {
+		if inst.IsRunning() {
+			count++
+		}
+	}
+	return count
+}
+
+// DesiredInstances returns the number of processes the service should run.
+func (s *Service) DesiredInstances() int {
+	if s.IsReplicated() {
+		return s.Replicas
+	}
+	return 1
+}
+
+// Scale changes the number of replicas. When the service is running, new
+// instances are started and surplus instances are stopped. If an instance
+// fails to start, those started so far are stopped again and the service
+// keeps its number of replicas.
+func (s *Service) Scale(n int) error {
+	if n < 1 {
+		return fmt.Errorf("replicas must be at least 1")
+	}
+	running := s.IsRunning()
+	replicas, instances := s.Replicas, slices.Clone(s.Instances)
+	pid, lastStarted := s.PID, s.LastStarted
+	before := s.DesiredInstances()
+
+	switch {
+	case n > 1 && !s.IsReplicated():
+		// The existing process becomes instance 1
+		port, _ := RenderPort(s.PortTemplate, s.Name, 1)
+		s.Instances = []*Instance{{Index: 1, PID: s.PID, Port: port, LastStarted: s.LastStarted, LogFile: s.LogFile}}
+	case n < len(s.Instances):
+		for i := len(s.Instances); i > n; i-- {
+			if err := s.StopInstance(i); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.Replicas = n
+	if n == 1 {
+		if len(s.Instances) > 0 {
+			s.PID = s.Instances[0].PID
+			s.LastStarted = s.Instances[0].LastStarted
+		}
+		s.Instances = nil
+		return nil
+	}
+
+	s.syncInstances()
+	if running {
+		for _, inst := range s.Instances {
+			if err := s.StartInstance(inst.Index); err != nil {
+				for _, started := range s.Instances[min(before, len(s.Instances)):] {
+					s.StopInstance(started.Index)
+				}
+				s.Replicas, s.Instances = replicas, instances
+				s.PID, s.LastStarted = pid, lastStarted
+				return err
+			}
+		}
+	}
+	s.mirrorInstances()
+	return nil
+}
+
+// mirrorInstances keeps PID and LastStarted pointing at the first instance
+// so that code unaware of replicas still sees a sensible value.
+func (s *Service) mirrorInstances() {
+	if len(s.Instances) == 0 {
+		return
+	}
+	s.PID = s.Instances[0].PID
+	s.LastStarted = s.Instances[0].LastStarted
+}
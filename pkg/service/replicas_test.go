@@ -0,0 +1,160 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRenderPort(t *testing.T) {
+	for _, tt := range []struct {
+		tmpl     string
+		instance int
+		want     string
+		err      string
+	}{
+		{"", 1, "", ""},
+		{"9000", 2, "9000", ""},
+		{"{{add 8000 .Instance}}", 1, "8001", ""},
+		{"{{add 8000 .Instance}}", 3, "8003", ""},
+		{"{{add 9000 (mul 10 .Index)}}", 3, "9020", ""},
+		{"{{.Name}}-{{.Index}}", 2, "web-1", ""},
+		{"{{.Port}}", 1, "", "can't evaluate field Port"},
+		{"{{add 8000 .Instance", 1, "", "unclosed action"},
+		{"{{sub 8000 .Instance}}", 1, "", `function "sub" not defined`},
+		{"{{add 8000 .Name}}", 1, "", "wrong type for value"},
+	} {
+		got, err := RenderPort(tt.tmpl, "web", tt.instance)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) || !strings.HasPrefix(err.Error(), "invalid port template") {
+				t.Errorf("RenderPort(%q, %d) = %q, %v; want an error with %q", tt.tmpl, tt.instance, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("RenderPort(%q, %d) = %q, %v; want %q", tt.tmpl, tt.instance, got, err, tt.want)
+		}
+	}
+}
+
+// newScaleService returns a service whose instances log their number and
+// port to the file started in dir before sleeping. The processes of its
+// instances have dir in their command line.
+func newScaleService(t *testing.T, portTemplate string) (s *Service, dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	s = &Service{
+		Name:         "web",
+		Command:      `echo "$INSTANCE $PORT" >> ` + filepath.Join(dir, "started") + `; sleep 300`,
+		LogFile:      filepath.Join(dir, "service.log"),
+		PortTemplate: portTemplate,
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s, dir
+}
+
+// processes returns the number of live processes whose command line
+// contains marker.
+func processes(marker string) int {
+	n := 0
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range dirs {
+		cmdline, _ := os.ReadFile(filepath.Join(dir, "cmdline"))
+		pid, _ := strconv.Atoi(filepath.Base(dir))
+		if strings.Contains(string(cmdline), marker) && alive(pid) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestScale(t *testing.T) {
+	s, dir := newScaleService(t, "{{add 8000 .Instance}}")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	first := s.PID
+
+	for _, tt := range []struct {
+		replicas int
+		ports    []string
+	}{
+		{3, []string{"8001", "8002", "8003"}},
+		{2, []string{"8001", "8002"}},
+		{4, []string{"8001", "8002", "8003", "8004"}},
+	} {
+		if err := s.Scale(tt.replicas); err != nil {
+			t.Fatalf("Scale(%d): %v", tt.replicas, err)
+		}
+		if s.Replicas != tt.replicas || len(s.Instances) != tt.replicas || s.RunningInstances() != tt.replicas {
+			t.Fatalf("Scale(%d): %d replicas, %d instances, %d running", tt.replicas, s.Replicas, len(s.Instances), s.RunningInstances())
+		}
+		for i, inst := range s.Instances {
+			if inst.Index != i+1 || inst.Port != tt.ports[i] {
+				t.Errorf("Scale(%d): instance %d has index %d and port %q, want port %s", tt.replicas, i+1, inst.Index, inst.Port, tt.ports[i])
+			}
+		}
+		if s.Instances[0].PID != first || s.PID != first {
+			t.Errorf("Scale(%d): instance 1 has PID %d, want the first process %d", tt.replicas, s.Instances[0].PID, first)
+		}
+		if got, want := s.Instances[1].LogFile, filepath.Join(dir, "service-2.log"); got != want {
+			t.Errorf("Scale(%d): instance 2 logs to %s, want %s", tt.replicas, got, want)
+		}
+	}
+
+	waitFor(t, "the instances to get their ports", func() bool {
+		data, _ := os.ReadFile(filepath.Join(dir, "started"))
+		return strings.Contains(string(data), "2 8002\n") && strings.Contains(string(data), "4 8004\n")
+	})
+	if err := s.Scale(1); err != nil {
+		t.Fatalf("Scale(1): %v", err)
+	}
+	if s.Replicas != 1 || s.Instances != nil || s.PID != first || !s.IsRunning() {
+		t.Errorf("Scale(1): %d replicas, instances %v, PID %d; want the first process %d alone", s.Replicas, s.Instances, s.PID, first)
+	}
+	waitFor(t, "the other instances to stop", func() bool { return processes(dir) == 1 })
+
+	if err := s.Scale(0); err == nil {
+		t.Error("Scale(0) succeeded")
+	}
+}
+
+func TestScaleStopped(t *testing.T) {
+	s, dir := newScaleService(t, "")
+	if err := s.Scale(3); err != nil {
+		t.Fatal(err)
+	}
+	if s.Replicas != 3 || len(s.Instances) != 3 || s.RunningInstances() != 0 {
+		t.Errorf("Scale(3) of a stopped service: %d replicas, %d instances, %d running", s.Replicas, len(s.Instances), s.RunningInstances())
+	}
+	if n := processes(dir); n != 0 {
+		t.Errorf("Scale of a stopped service started %d processes", n)
+	}
+
+	if err := s.Scale(1); err != nil {
+		t.Fatal(err)
+	}
+	if s.Replicas != 1 || s.Instances != nil || s.PID != 0 {
+		t.Errorf("Scale(1) of a stopped service: %d replicas, instances %v, PID %d", s.Replicas, s.Instances, s.PID)
+	}
+}
+
+func TestScaleRollsBack(t *testing.T) {
+	// Instance 3 cannot get a port
+	s, dir := newScaleService(t, "{{if eq .Instance 3}}{{.Port}}{{else}}{{add 8000 .Instance}}{{end}}")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	first := s.PID
+
+	err := s.Scale(3)
+	if err == nil || !strings.Contains(err.Error(), "invalid port template") {
+		t.Fatalf("Scale(3) = %v, want the port template error", err)
+	}
+	if s.Replicas != 0 || s.Instances != nil || s.PID != first || !s.IsRunning() {
+		t.Errorf("failed Scale(3): %d replicas, instances %v, PID %d; want the first process %d alone", s.Replicas, s.Instances, s.PID, first)
+	}
+	waitFor(t, "instance 2 to stop", func() bool { return processes(dir) == 1 })
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultReloadSignal = "SIGHUP"
+	DefaultReadyTimeout = 30 * time.Second
+
+	// An instance must stay alive at least this long to count as started
+	readySettle = time.Second
+)
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// ParseSignal parses a signal name such as "SIGHUP", "hup" or "USR2".
+func ParseSignal(name string) (syscall.Signal, error) {
+	key := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+	sig, ok := signalNames[key]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %q", name)
+	}
+	return sig, nil
+}
+
+// Reload sends the reload signal of the service to every running process
+// and the processes it started, so that the program run by a shell command
+// gets it too.
+func (s *Service) Reload() error {
+	name := s.ReloadSignal
+	if name == "" {
+		name = DefaultReloadSignal
+	}
+	sig, err := ParseSignal(name)
+	if err != nil {
+		return err
+	}
+
+	pids := []int{s.PID}
+	if s.IsReplicated() {
+		pids = pids[:0]
+		for _, inst := range s.Instances {
+			pids = append(pids, inst.PID)
+		}
+	}
+
+	sent := 0
+	for _, pid := range pids {
+		if !processAlive(pid) {
+			continue
+		}
+		if err := signal(pid, sig); err != nil {
+			return fmt.Errorf("failed to send %s to %d: %v", name, pid, err)
+		}
+		sent++
+	}
+	if sent == 0 {
+		return fmt.Errorf("service is not running")
+	}
+	return nil
+}
+
+// RollingRestart replaces the instances of a replicated service one at a
+// time, waiting for each new instance to become ready before moving on so
+// that the service never goes down completely. The pre-start hook runs once
+// before the first instance is replaced and the post-start hook after the
+// last; the stop hooks are not run because the service never stops.
+// progress is called after every replaced instance.
+func (s *Service) RollingRestart(timeout time.Duration, progress func(n int)) error {
+	if !s.IsReplicated() {
+		return s.Restart()
+	}
+
+	if err := s.runHook(HookPreStart); err != nil {
+		return err
+	}
+
+	s.syncInstances()
+	for _, inst := range s.Instances {
+		if err := s.StopInstance(inst.Index); err != nil {
+			return err
+		}
+		if err := s.StartInstance(inst.Index); err != nil {
+			return err
+		}
+		if err := inst.WaitReady(timeout); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(inst.Index)
+		}
+	}
+
+	_ = s.runHook(HookPostStart)
+
+	return nil
+}
+
+// WaitReady waits until the instance has survived startup and, if it has a
+// port, accepts TCP connections on it.
+func (inst *Instance) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	time.Sleep(readySettle)
+
+	for {
+		if !inst.IsRunning() {
+			return fmt.Errorf("instance %d exited during startup", inst.Index)
+		}
+		if inst.Port == "" || portOpen(inst.Port) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("instance %d is not listening on port %s after %s", inst.Index, inst.Port, timeout)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func portOpen(port string) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadShellService(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "service.log")
+	s := &Service{
+		Name: "shell",
+		// The program run by the shell logs the signal; so does the shell
+		// itself, which would otherwise exit on it
+		Command: `trap "echo shell reloaded" HUP; sh -c 'trap "echo program reloaded" HUP; echo ready; while :; do sleep 0.1; done' & while :; do sleep 0.1; done`,
+		LogFile: logFile,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	waitFor(t, "the program to start", func() bool {
+		data, _ := os.ReadFile(logFile)
+		return strings.Contains(string(data), "ready\n")
+	})
+
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	waitFor(t, "the program to reload", func() bool {
+		data, _ := os.ReadFile(logFile)
+		return strings.Contains(string(data), "program reloaded\n") && strings.Contains(string(data), "shell reloaded\n")
+	})
+	if !s.IsRunning() {
+		t.Error("the service stopped on reload")
+	}
+
+	s.Stop()
+	if err := s.Reload(); err == nil {
+		t.Error("Reload of a stopped service succeeded")
+	}
+}
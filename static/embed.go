@@ -0,0 +1,7 @@
+// Package static embeds the web console into the controlman binary.
+package static
+
+import "embed"
+
+//go:embed *.html *.js *.png font
+var FS embed.FS
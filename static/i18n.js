@@ -19,6 +19,13 @@ const translations = {
         "actions": "Actions",
         "loading": "Loading...",
         "no_services": "No services found.",
+        "labels": "Labels",
+        "executable": "Executable",
+        "arguments": "Arguments (one per line)",
+        "run_in_shell": "Run as a shell command (sh -c)",
+        "label_selector": "Label selector, e.g. stack=payments",
+        "filter_by_label": "Show services with this label",
+        "services_matched": "{count} services",
         "failed_load": "Failed to load services.",
         "cancel": "Cancel",
         "add": "Add",
@@ -32,13 +39,35 @@ const translations = {
         "cpu_usage": "CPU Usage",
         "memory_usage": "Memory Usage",
         "log_file_path": "Log File Path",
+        "hooks": "Hooks",
+        "instances": "Instances",
         "confirm_start": "Are you sure you want to start service \"{name}\"?",
         "confirm_stop": "Are you sure you want to stop service \"{name}\"?",
         "confirm_restart": "Are you sure you want to restart service \"{name}\"?",
+        "confirm_reload": "Send the reload signal to service \"{name}\"?",
         "confirm_delete": "Are you sure you want to DELETE service \"{name}\"? This cannot be undone.",
         "unknown_error": "Unknown error",
         "network_error": "Network error",
         "invalid_credentials": "Invalid credentials",
+        "login_locked": "Too many failed logins, please try again later",
+        "role_viewer": "Viewer",
+        "role_operator": "Operator",
+        "role_admin": "Admin",
+        "audit_log": "Audit Log",
+        "host": "Host",
+        "last_hour": "Last hour",
+        "last_day": "Last 24 hours",
+        "last_week": "Last 7 days",
+        "all_time": "All",
+        "search": "Search",
+        "verify_chain": "Verify",
+        "time": "Time",
+        "actor": "Actor",
+        "source": "Source",
+        "action": "Action",
+        "target": "Target",
+        "result": "Result",
+        "no_audit_entries": "No audit entries",
         "connection_failed": "Connection failed",
         "login_failed": "Login failed",
         "service_added": "Service added successfully",
@@ -52,6 +81,12 @@ const translations = {
         "status_stopping": "Stopping",
         "status_restarting": "Restarting",
         "status_unknown": "Unknown",
+        "status_scheduled": "Scheduled",
+        "status_completed": "Completed",
+        "schedule": "Schedule",
+        "next_run": "Next run",
+        "last_result": "Last result",
+        "type_oneshot": "One-shot",
         "cpu_history": "CPU History",
         "memory_history": "Memory History",
         "resource_monitor": "Resource Monitor",
@@ -61,6 +96,7 @@ const translations = {
         "start": "Start",
         "stop": "Stop",
         "restart": "Restart",
+        "reload": "Reload",
         "delete": "Delete",
         "logs": "Logs",
         "service_deleted": "Service deleted successfully"
@@ -85,6 +121,13 @@ const translations = {
         "actions": "操作",
         "loading": "加载中...",
         "no_services": "未找到服务。",
+        "labels": "标签",
+        "executable": "可执行文件",
+        "arguments": "参数（每行一个）",
+        "run_in_shell": "作为 shell 命令运行（sh -c）",
+        "label_selector": "标签选择器，如 stack=payments",
+        "filter_by_label": "显示带有此标签的服务",
+        "services_matched": "{count} 个服务",
         "failed_load": "加载服务失败。",
         "cancel": "取消",
         "add": "添加",
@@ -98,13 +141,35 @@ const translations = {
         "cpu_usage": "CPU 使用率",
         "memory_usage": "内存使用",
         "log_file_path": "日志文件路径",
+        "hooks": "生命周期钩子",
+        "instances": "实例",
         "confirm_start": "确定要启动服务 \"{name}\" 吗？",
         "confirm_stop": "确定要停止服务 \"{name}\" 吗？",
         "confirm_restart": "确定要重启服务 \"{name}\" 吗？",
+        "confirm_reload": "确定要向服务 \"{name}\" 发送重载信号吗？",
         "confirm_delete": "确定要删除服务 \"{name}\" 吗？此操作不可撤销。",
         "unknown_error": "未知错误",
         "network_error": "网络错误",
         "invalid_credentials": "凭证无效",
+        "login_locked": "登录失败次数过多，请稍后再试",
+        "role_viewer": "只读",
+        "role_operator": "运维",
+        "role_admin": "管理员",
+        "audit_log": "审计日志",
+        "host": "主机",
+        "last_hour": "最近 1 小时",
+        "last_day": "最近 24 小时",
+        "last_week": "最近 7 天",
+        "all_time": "全部",
+        "search": "查询",
+        "verify_chain": "校验",
+        "time": "时间",
+        "actor": "操作者",
+        "source": "来源",
+        "action": "操作",
+        "target": "对象",
+        "result": "结果",
+        "no_audit_entries": "没有审计记录",
         "connection_failed": "连接失败",
         "login_failed": "登录失败",
         "service_added": "服务添加成功",
@@ -118,6 +183,12 @@ const translations = {
         "status_stopping": "停止中",
         "status_restarting": "重启中",
         "status_unknown": "未知",
+        "status_scheduled": "已调度",
+        "status_completed": "已完成",
+        "schedule": "调度",
+        "next_run": "下次运行",
+        "last_result": "上次结果",
+        "type_oneshot": "一次性任务",
         "cpu_history": "CPU 历史曲线",
         "memory_history": "内存历史曲线",
         "resource_monitor": "资源监控",
@@ -127,6 +198,7 @@ const translations = {
         "start": "启动",
         "stop": "停止",
         "restart": "重启",
+        "reload": "重载",
         "delete": "删除",
         "logs": "日志",
         "service_deleted": "服务删除成功"